@@ -0,0 +1,141 @@
+package overseer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/willas/overseer/fetcher"
+	"golang.org/x/mod/semver"
+)
+
+//Check verifies each fetched binary before it can replace the
+//current binary (see Config.Checks). An error rejects the binary.
+type Check struct {
+	//Name identifies the check in errors
+	Name string
+	//Run checks the temp binary at path, meta describes the
+	//binary as declared by the fetcher
+	Run func(path string, meta fetcher.Metadata) error
+}
+
+//ChecksumCheck rejects binaries which don't match the size and
+//SHA-256 checksum declared by the fetcher (see fetcher.Metadata)
+var ChecksumCheck = Check{Name: "checksum", Run: checkChecksum}
+
+//PlatformCheck rejects binaries built for another OS or architecture
+var PlatformCheck = Check{Name: "platform", Run: func(path string, _ fetcher.Metadata) error {
+	return checkPlatform(path)
+}}
+
+func checkChecksum(path string, meta fetcher.Metadata) error {
+	if meta.Size < 0 && meta.SHA256 == nil {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if meta.Size >= 0 && n != meta.Size {
+		return fmt.Errorf("binary size mismatch (declared %d bytes, got %d)", meta.Size, n)
+	}
+	if meta.SHA256 != nil && !bytes.Equal(hash.Sum(nil), meta.SHA256) {
+		return fmt.Errorf("binary checksum mismatch (declared sha256 %x)", meta.SHA256)
+	}
+	return nil
+}
+
+//declaredReader verifies the size and SHA-256 checksum declared by the
+//fetcher as the binary is read, ending it with an error on a mismatch
+type declaredReader struct {
+	io.Reader
+	meta fetcher.Metadata
+	hash hash.Hash
+	read int64
+}
+
+func newDeclaredReader(r io.Reader, meta fetcher.Metadata) *declaredReader {
+	return &declaredReader{Reader: r, meta: meta, hash: sha256.New()}
+}
+
+func (d *declaredReader) Read(b []byte) (int, error) {
+	n, err := d.Reader.Read(b)
+	d.hash.Write(b[:n])
+	d.read += int64(n)
+	if size := d.meta.Size; size >= 0 && d.read > size {
+		return n, fmt.Errorf("binary size mismatch (declared %d bytes, got more)", size)
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if size := d.meta.Size; size >= 0 && d.read != size {
+		return n, fmt.Errorf("binary size mismatch (declared %d bytes, got %d)", size, d.read)
+	}
+	if d.meta.SHA256 != nil && !bytes.Equal(d.hash.Sum(nil), d.meta.SHA256) {
+		return n, fmt.Errorf("binary checksum mismatch (declared sha256 %x)", d.meta.SHA256)
+	}
+	return n, err
+}
+
+//check runs the Checks against the temp binary at path
+func (mp *master) check(path string, meta fetcher.Metadata) error {
+	for _, c := range mp.Config.Checks {
+		if c.Run == nil {
+			continue
+		}
+		if err := c.Run(path, meta); err != nil {
+			return fmt.Errorf("binary rejected by %s check: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+//checkVersion rejects a temp binary with an older
+//version than the current binary (see Config.VersionOf)
+func (mp *master) checkVersion(path string) error {
+	if mp.Config.VersionOf == nil || mp.Config.AllowDowngrade {
+		return nil
+	}
+	next, err := mp.Config.VersionOf(path)
+	if err != nil {
+		return fmt.Errorf("failed to read binary version: %s", err)
+	}
+	current, err := mp.Config.VersionOf(mp.binPath)
+	if err != nil {
+		mp.warnf("failed to read current binary version, skipping downgrade check: %s", err)
+		return nil
+	}
+	if isDowngrade(current, next) {
+		return fmt.Errorf("binary rejected: downgrade from version %s to %s (see Config.AllowDowngrade)", current, next)
+	}
+	return nil
+}
+
+//isDowngrade returns true if next is an older
+//semantic version than current
+func isDowngrade(current, next string) bool {
+	c, n := canonicalVersion(current), canonicalVersion(next)
+	if !semver.IsValid(c) || !semver.IsValid(n) {
+		return false
+	}
+	return semver.Compare(n, c) < 0
+}
+
+//canonicalVersion adds the "v" prefix required by semver
+func canonicalVersion(v string) string {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "v") {
+		v = "v" + v
+	}
+	return v
+}
@@ -0,0 +1,85 @@
+package overseer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/willas/overseer/fetcher"
+)
+
+//Cosign configures a CosignCheck. Set Key to verify binaries signed
+//with a key pair, or Identity and Issuer to verify keyless signatures.
+type Cosign struct {
+	//Key is the public key which signs the binaries, the path of
+	//a PEM file or a KMS URI (e.g. "awskms:///alias/release")
+	Key string
+	//Identity and Issuer are the subject (e.g. the workflow URL
+	//or email) and the OIDC issuer of keyless signing certificates
+	Identity string
+	Issuer   string
+	//Bundle opens the cosign bundle of the binary described by meta,
+	//which holds its signature and transparency log entry, e.g. by
+	//requesting it from next to the binary. It is required.
+	Bundle func(meta fetcher.Metadata) (io.ReadCloser, error)
+	//Command is the cosign executable, defaults to "cosign"
+	Command string
+}
+
+//CosignCheck rejects binaries without a valid Sigstore signature,
+//verified by the cosign CLI (v2 or later) with their bundle, which
+//must also prove their inclusion in the transparency log. Since it
+//runs on the fetched binary, it works with every fetcher. Add it to
+//Config.Checks, its failures match ErrUnverified.
+func CosignCheck(c Cosign) Check {
+	return Check{Name: "cosign", Run: func(path string, meta fetcher.Metadata) error {
+		if err := c.verify(path, meta); err != nil {
+			return &unverifiedError{err}
+		}
+		return nil
+	}}
+}
+
+func (c Cosign) verify(path string, meta fetcher.Metadata) error {
+	args := []string{"verify-blob"}
+	if c.Key != "" {
+		args = append(args, "--key", c.Key)
+	} else if c.Identity != "" && c.Issuer != "" {
+		args = append(args, "--certificate-identity", c.Identity, "--certificate-oidc-issuer", c.Issuer)
+	} else {
+		return errors.New("Key, or Identity and Issuer, required")
+	}
+	if c.Bundle == nil {
+		return errors.New("Bundle required")
+	}
+	bundle, err := c.Bundle(meta)
+	if err != nil {
+		return fmt.Errorf("failed to get bundle: %s", err)
+	}
+	defer bundle.Close()
+	f, err := ioutil.TempFile("", "overseer-bundle-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, bundle)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read bundle: %s", err)
+	}
+	command := c.Command
+	if command == "" {
+		command = "cosign"
+	}
+	args = append(args, "--bundle", f.Name(), path)
+	if out, err := exec.Command(command, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("invalid signature: %s (%s)", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
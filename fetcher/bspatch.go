@@ -0,0 +1,106 @@
+package fetcher
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//bsdiffMagic starts patches produced by bsdiff 4.x
+var bsdiffMagic = []byte("BSDIFF40")
+
+//bspatch applies the bsdiff patch to old, writing the new binary
+//to w. The patch's control, diff and extra blocks are read with
+//independent readers, while old is read on demand, so neither
+//binary is held in memory.
+func bspatch(old io.ReaderAt, oldSize int64, patch io.ReaderAt, patchSize int64, w io.Writer) error {
+	header := make([]byte, 32)
+	if _, err := patch.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("invalid patch header (%s)", err)
+	}
+	if !bytes.Equal(header[:8], bsdiffMagic) {
+		return errors.New("invalid patch header (not a bsdiff patch)")
+	}
+	ctrlLen, diffLen, newSize := offtin(header[8:]), offtin(header[16:]), offtin(header[24:])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || 32+ctrlLen+diffLen > patchSize {
+		return errors.New("invalid patch header (corrupt lengths)")
+	}
+	ctrl := bzip2.NewReader(io.NewSectionReader(patch, 32, ctrlLen))
+	diff := bzip2.NewReader(io.NewSectionReader(patch, 32+ctrlLen, diffLen))
+	extra := bzip2.NewReader(io.NewSectionReader(patch, 32+ctrlLen+diffLen, patchSize-32-ctrlLen-diffLen))
+	buf := make([]byte, 32*1024)
+	oldBuf := make([]byte, len(buf))
+	c := make([]byte, 24)
+	var oldPos, newPos int64
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, c); err != nil {
+			return fmt.Errorf("corrupt patch control block (%s)", err)
+		}
+		add, copyLen, seek := offtin(c), offtin(c[8:]), offtin(c[16:])
+		if add < 0 || copyLen < 0 || newPos+add+copyLen > newSize {
+			return errors.New("corrupt patch control block")
+		}
+		//add the diff block to old
+		for add > 0 {
+			n := int64(len(buf))
+			if add < n {
+				n = add
+			}
+			if _, err := io.ReadFull(diff, buf[:n]); err != nil {
+				return fmt.Errorf("corrupt patch diff block (%s)", err)
+			}
+			if err := readOld(old, oldSize, oldPos, oldBuf[:n]); err != nil {
+				return fmt.Errorf("failed to read current binary (%s)", err)
+			}
+			for i := range buf[:n] {
+				buf[i] += oldBuf[i]
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			add -= n
+			oldPos += n
+			newPos += n
+		}
+		//copy the extra block as-is
+		if _, err := io.CopyN(w, extra, copyLen); err != nil {
+			return fmt.Errorf("corrupt patch extra block (%s)", err)
+		}
+		newPos += copyLen
+		oldPos += seek
+	}
+	return nil
+}
+
+//readOld fills b from old at off, bytes outside of old are zero
+func readOld(old io.ReaderAt, oldSize, off int64, b []byte) error {
+	for i := range b {
+		b[i] = 0
+	}
+	start, end := off, off+int64(len(b))
+	if start < 0 {
+		start = 0
+	}
+	if end > oldSize {
+		end = oldSize
+	}
+	if start >= end {
+		return nil
+	}
+	_, err := old.ReadAt(b[start-off:end-off], start)
+	return err
+}
+
+//offtin decodes bsdiff's sign-magnitude little-endian int64
+func offtin(b []byte) int64 {
+	y := int64(b[7] & 0x7f)
+	for i := 6; i >= 0; i-- {
+		y = y<<8 | int64(b[i])
+	}
+	if b[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
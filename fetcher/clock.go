@@ -0,0 +1,87 @@
+package fetcher
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Clock abstracts the time package so tests can control
+// fetch intervals deterministically (see overseertest.Clock)
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// TimerClock can optionally be implemented by a Clock so waits
+// which end early (e.g. cancelled fetches) can release them.
+// Otherwise each such wait leaves a goroutine blocked in
+// Sleep until it ends.
+type TimerClock interface {
+	Clock
+	//NewTimer returns a channel which receives the time once d
+	//has passed, and a func which stops the timer
+	NewTimer(d time.Duration) (<-chan time.Time, func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTimer(d)
+	return t.C, func() { t.Stop() }
+}
+
+//clk is used by all fetchers, tests may replace it
+var clk Clock = realClock{}
+
+// SetClock replaces the clock used by all fetchers, a nil
+// Clock restores the real one. It is intended for tests and
+// must be called before any fetcher is running.
+func SetClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	clk = c
+}
+
+//newTimer returns a channel which receives once d has passed on
+//clk, stop releases the timer of a wait which ends early
+func newTimer(d time.Duration) (c <-chan time.Time, stop func()) {
+	if tc, ok := clk.(TimerClock); ok {
+		return tc.NewTimer(d)
+	}
+	slept := make(chan time.Time, 1)
+	go func() {
+		clk.Sleep(d)
+		slept <- clk.Now()
+	}()
+	return slept, func() {}
+}
+
+//sleep blocks for d or until ctx is done,
+//whichever comes first
+func sleep(ctx context.Context, d time.Duration) error {
+	slept, stop := newTimer(d)
+	defer stop()
+	select {
+	case <-slept:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//jitter randomly offsets d by up to +/- j
+func jitter(d, j time.Duration) time.Duration {
+	if j <= 0 || d < 0 {
+		return d
+	}
+	d += time.Duration(rand.Int63n(int64(2*j))) - j
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,76 @@
+package fetcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+//the state of the companion config file (see HTTP.ConfigURL)
+//is kept along with the check headers of the binary
+const (
+	configETagKey    = "Config-ETag"
+	configVersionKey = "Config-SHA256"
+)
+
+//maxConfigSize bounds config files, which are held in memory
+const maxConfigSize = 16 * 1024 * 1024
+
+//fetchConfig requests the config file from ConfigURL and returns
+//whether it changed since the last fetched binary. Once a config is
+//held, a conditional GET skips the download of an unchanged config.
+func (h *HTTP) fetchConfig() (bool, error) {
+	req, err := http.NewRequestWithContext(h.context(), "GET", h.ConfigURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("config GET request failed (%w)", err)
+	}
+	for k, v := range h.Headers {
+		req.Header[k] = v
+	}
+	if etag := h.lasts[configETagKey]; etag != "" && h.config != nil {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := do(h.client, req, h.DownloadTimeout)
+	if err != nil {
+		return false, fmt.Errorf("config GET request failed (%w)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && h.config != nil {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, &statusError{"config GET", resp.StatusCode}
+	}
+	config, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxConfigSize+1))
+	if err != nil {
+		return false, transient(fmt.Errorf("failed to read config (%w)", err))
+	}
+	if len(config) > maxConfigSize {
+		return false, fmt.Errorf("config exceeds %d bytes", maxConfigSize)
+	}
+	sum := sha256.Sum256(config)
+	version := hex.EncodeToString(sum[:8])
+	changed := h.lasts[configVersionKey] != version
+	h.lasts[configETagKey] = resp.Header.Get("ETag")
+	h.lasts[configVersionKey] = version
+	h.config = config
+	return changed, nil
+}
+
+//restoreConfig restores the config state of the last fetched binary,
+//when a changed config wasn't fetched along with a binary, so the
+//next poll fetches it again
+func (h *HTTP) restoreConfig(prev map[string]string, config []byte) {
+	for _, key := range []string{configETagKey, configVersionKey} {
+		if v, ok := prev[key]; ok {
+			h.lasts[key] = v
+		} else {
+			delete(h.lasts, key)
+		}
+	}
+	h.config = config
+	h.persistState()
+}
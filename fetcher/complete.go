@@ -0,0 +1,53 @@
+package fetcher
+
+import "io"
+
+//completeReader reports whether a binary was completely read, so
+//a fetcher only keeps the version of a binary which downloaded.
+//done is called once the binary has been read to its end, failed
+//when reading it fails or it is closed before its end (e.g. a
+//timed out or cancelled download), then it's retried on the next
+//poll.
+type completeReader struct {
+	io.Reader
+	done, failed func()
+	finished     bool
+}
+
+//onComplete wraps r, either func may be nil
+func onComplete(r io.Reader, done, failed func()) io.Reader {
+	return &completeReader{Reader: r, done: done, failed: failed}
+}
+
+func (r *completeReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && !r.finished {
+		r.finished = true
+		if err == io.EOF {
+			if r.done != nil {
+				r.done()
+			}
+		} else if r.failed != nil {
+			r.failed()
+		}
+	}
+	return n, err
+}
+
+// Size passes through the size of the binary
+func (r *completeReader) Size() int64 {
+	return sizeOf(r.Reader)
+}
+
+func (r *completeReader) Close() error {
+	if !r.finished {
+		r.finished = true
+		if r.failed != nil {
+			r.failed()
+		}
+	}
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package fetcher
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+//checkContentType errors unless the response's media type
+//matches one of allowed (e.g. "application/octet-stream" or
+//"application/*"). An empty allowed list permits any type.
+func checkContentType(allowed []string, header http.Header) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	ct := header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(ct))
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == mediaType || strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(a, "*")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("content type %q not allowed", ct)
+}
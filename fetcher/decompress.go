@@ -0,0 +1,138 @@
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//compression formats, identified by file suffix and magic bytes
+var formats = []struct {
+	suffix string
+	magic  []byte
+	reader func(io.Reader) (io.ReadCloser, error)
+}{
+	{".gz", []byte{0x1f, 0x8b, 0x08}, func(r io.Reader) (io.ReadCloser, error) {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		//read concatenated members (e.g. from parallel gzip
+		//tools) as one stream, never just the first member
+		z.Multistream(true)
+		return z, nil
+	}},
+	{".bz2", []byte("BZh"), func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}},
+	{".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}},
+}
+
+//decompress wraps rc with the decompressor matching the
+//suffix of name (.gz, .bz2 or .zst), or when sniff is set,
+//matching the magic bytes at the start of rc. If rc doesn't
+//start with the format's magic bytes (e.g. the server has
+//already decompressed it) it is streamed as-is, so a
+//misdetected format won't break every fetch. Closing the
+//returned reader closes both the decompressor and rc. Streams
+//passed through as-is keep the size of rc (see Sized).
+func decompress(rc io.ReadCloser, name string, sniff bool) (io.Reader, error) {
+	br := bufio.NewReader(rc)
+	buffered := &bufferedReadCloser{Reader: br, Closer: rc, size: sizeOf(rc)}
+	b, _ := br.Peek(4)
+	for _, f := range formats {
+		if !sniff && !strings.HasSuffix(name, f.suffix) {
+			continue
+		}
+		if !bytes.HasPrefix(b, f.magic) {
+			continue
+		}
+		d, err := f.reader(buffered)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return &decompressReadCloser{ReadCloser: d, src: rc}, nil
+	}
+	return buffered, nil
+}
+
+//encoded returns whether the body of resp is still gzip encoded.
+//The transport only decompresses (and sets Uncompressed) bodies
+//when it requested gzip itself, not when Accept-Encoding was provided
+//in Headers or for ranged requests, so a Content-Encoding of gzip
+//may remain. Binaries without a .gz suffix are then sniffed instead.
+func encoded(resp *http.Response) bool {
+	if resp.Uncompressed {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		return true
+	}
+	return false
+}
+
+type decompressReadCloser struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (d *decompressReadCloser) Close() error {
+	d.ReadCloser.Close()
+	return d.src.Close()
+}
+
+type bufferedReadCloser struct {
+	*bufio.Reader
+	io.Closer
+	size int64
+}
+
+func (b *bufferedReadCloser) Size() int64 {
+	return b.size
+}
+
+//sizeOf returns the size of r in bytes, or -1 when unknown
+func sizeOf(r io.Reader) int64 {
+	switch r := r.(type) {
+	case Sized:
+		return r.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+//sizedBody returns the body of resp, sized by its Content-Length
+func sizedBody(resp *http.Response) io.ReadCloser {
+	if resp.ContentLength < 0 {
+		return resp.Body
+	}
+	return &sizedReadCloser{ReadCloser: resp.Body, size: resp.ContentLength}
+}
+
+type sizedReadCloser struct {
+	io.ReadCloser
+	size int64
+}
+
+func (s *sizedReadCloser) Size() int64 {
+	return s.size
+}
@@ -0,0 +1,32 @@
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDecompressConcatenatedGzip(t *testing.T) {
+	//as written by parallel gzip tools, one member per chunk
+	gz := &bytes.Buffer{}
+	parts := []string{"first member,", "second member"}
+	for _, part := range parts {
+		w := gzip.NewWriter(gz)
+		w.Write([]byte(part))
+		w.Close()
+	}
+	for _, sniff := range []bool{false, true} {
+		r, err := decompress(ioutil.NopCloser(bytes.NewReader(gz.Bytes())), "app.gz", sniff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := parts[0] + parts[1]; string(b) != want {
+			t.Fatalf("sniff %v: read %q, expected %q", sniff, b, want)
+		}
+	}
+}
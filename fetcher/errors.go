@@ -0,0 +1,82 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors returned by fetchers can be matched against these kinds
+// with errors.Is, for example to alert on ErrAuth while quietly
+// retrying ErrTransient failures.
+var (
+	// ErrNotFound is matched when the binary (or its release,
+	// object, blob, etc) does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrAuth is matched when the credentials are missing or
+	// were rejected
+	ErrAuth = errors.New("access denied")
+	// ErrTransient is matched by failures which may succeed
+	// when retried, such as network errors, timeouts, rate
+	// limits and server errors
+	ErrTransient = errors.New("transient failure")
+	// ErrCircuitOpen is matched when a Breaker skipped the
+	// fetch, as its source has been failing
+	ErrCircuitOpen = errors.New("circuit open")
+)
+
+//kindError is an error which matches kind with errors.Is
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+//errorf formats an error which matches kind
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, err: fmt.Errorf(format, args...)}
+}
+
+//transient marks a failed request as transient unless it was
+//cancelled, the error message is unchanged
+func transient(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &kindError{kind: ErrTransient, err: err}
+}
+
+//statusError is returned when a request fails with an unexpected status code
+type statusError struct {
+	method string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s request failed (status code %d)", e.method, e.code)
+}
+
+//Is matches the error kind of the status code
+func (e *statusError) Is(target error) bool {
+	switch e.code {
+	case http.StatusNotFound, http.StatusGone:
+		return target == ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return target == ErrAuth
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return target == ErrTransient
+	}
+	return e.code >= 500 && target == ErrTransient
+}
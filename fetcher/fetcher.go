@@ -1,6 +1,16 @@
 package fetcher
 
-import "io"
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Manual can be used as the Interval of the fetchers in this
+// package to disable polling. After checking once on startup,
+// they only check for updates when triggered (by overseer.Fetch
+// or Config.FetchSignal), for sources updated out-of-band.
+const Manual time.Duration = -1
 
 // Interface defines the required fetcher functions
 type Interface interface {
@@ -18,7 +28,39 @@ type Interface interface {
 	Fetch() (io.Reader, error)
 }
 
-// Func converts a fetch function into the fetcher interface
+// Versioned can optionally be implemented by fetchers
+// to identify the most recently fetched binary by its
+// source version (e.g. an ETag or release tag).
+type Versioned interface {
+	Version() string
+}
+
+// Pinnable can optionally be implemented by fetchers which
+// can fetch a specific version (as reported by Versioned),
+// ignoring newer versions until the pin is cleared.
+type Pinnable interface {
+	Pin(version string)
+}
+
+// Lister can optionally be implemented by fetchers to
+// enumerate the versions available from their source without
+// downloading them (e.g. for operator dashboards).
+type Lister interface {
+	List() ([]VersionInfo, error)
+}
+
+// VersionInfo describes a version available from a fetcher's source
+type VersionInfo struct {
+	//ID identifies the version, as reported by Versioned
+	ID           string
+	Size         int64
+	LastModified time.Time
+}
+
+// Func converts a fetch function into the fetcher interface,
+// useful for tests and custom (e.g. push based) sources. Like
+// Fetch, fn is called repeatedly and should block until an
+// update is available, returning a nil io.Reader to skip.
 func Func(fn func() (io.Reader, error)) Interface {
 	return &fetcher{fn}
 }
@@ -34,3 +76,125 @@ func (f fetcher) Init() error {
 func (f fetcher) Fetch() (io.Reader, error) {
 	return f.fn()
 }
+
+// Sized can optionally be implemented by the io.Reader returned
+// from Fetch to report the binary's size in bytes, or -1 when it
+// is unknown (e.g. while decompressing), so that overseer can
+// report download progress.
+type Sized interface {
+	Size() int64
+}
+
+// Metadata describes a fetched binary, as read from the io.Reader
+// returned alongside it. Any field may be unset.
+type Metadata struct {
+	//Version identifies the binary, as reported by Versioned
+	Version string
+	//Size of the binary in bytes, or -1 when unknown
+	Size int64
+	//ContentType of the binary, as reported by its source
+	ContentType string
+	//SHA256 is the binary's declared checksum
+	SHA256 []byte
+	//Rollout is the declared percentage (0 to 100) of nodes
+	//which should adopt the binary, or -1 for all nodes
+	Rollout float64
+	//Config is the companion config file fetched along with the
+	//binary (see HTTP.ConfigURL), nil when there is none
+	Config []byte
+}
+
+// MetadataFetcher can optionally be implemented by fetchers to
+// describe each binary they fetch. overseer checks a declared
+// Size and SHA256 against the binary once it has been read.
+type MetadataFetcher interface {
+	FetchMetadata() (io.Reader, Metadata, error)
+}
+
+// FetchMetadata fetches a binary from f along with its Metadata.
+// Fetchers which don't implement MetadataFetcher are described
+// by their Version (see Versioned) and Size (see Sized).
+func FetchMetadata(f Interface) (io.Reader, Metadata, error) {
+	if mf, ok := f.(MetadataFetcher); ok {
+		return mf.FetchMetadata()
+	}
+	r, err := f.Fetch()
+	if r == nil || err != nil {
+		return r, Metadata{Size: -1, Rollout: -1}, err
+	}
+	meta := Metadata{Size: sizeOf(r), Rollout: -1}
+	if v, ok := f.(Versioned); ok {
+		meta.Version = v.Version()
+	}
+	return r, meta, nil
+}
+
+// Cancellable can optionally be implemented by fetchers
+// to allow overseer to interrupt a pending Fetch. overseer
+// will call SetContext before Init and will cancel the
+// provided context when the master process is shutting down.
+type Cancellable interface {
+	SetContext(ctx context.Context)
+}
+
+// Logger receives fetcher events, it is satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Loggable can optionally be implemented by fetchers to
+// report fetch events (e.g. fetch started, update skipped,
+// download size). overseer will call SetLogger before Init
+// with Config.Logger. Fetch errors are still returned to,
+// and logged by, overseer.
+type Loggable interface {
+	SetLogger(l Logger)
+}
+
+// Triggerable can optionally be implemented by fetchers
+// which wait between fetches. Trigger should cut the
+// current wait short, it is a no-op while fetching.
+type Triggerable interface {
+	Trigger()
+}
+
+// Acceptable can optionally be implemented by fetchers to learn
+// which of their binaries overseer accepted. Accepted is called
+// once the binary last fetched has passed every check and replaced
+// (or been staged to replace) the current binary, or when it turned
+// out to be the current binary.
+type Acceptable interface {
+	Accepted()
+}
+
+// Adjustable can optionally be implemented by fetchers which
+// poll at an Interval, to change it at runtime (e.g. to poll
+// faster during an incident). A zero d restores the configured
+// Interval. The new interval applies to the current wait.
+type Adjustable interface {
+	SetInterval(d time.Duration)
+}
+
+// Scheduled can optionally be implemented by fetchers to report
+// when they next poll their source, accounting for their current
+// interval and jitter. While a poll is in progress, NextPoll returns
+// the time it started. It returns the zero time when the next poll
+// isn't yet known, or is only made when triggered (see Manual).
+type Scheduled interface {
+	NextPoll() time.Time
+}
+
+//nextPoll returns the earliest NextPoll of fetchers (see Scheduled)
+func nextPoll(fetchers ...Interface) time.Time {
+	next := time.Time{}
+	for _, f := range fetchers {
+		s, ok := f.(Scheduled)
+		if !ok {
+			continue
+		}
+		if t := s.NextPoll(); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next
+}
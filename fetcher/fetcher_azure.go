@@ -0,0 +1,266 @@
+package fetcher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const azureVersion = "2020-10-02"
+
+//AzureBlob uses the Azure Blob Storage REST API to poll a
+//given blob with conditional GET requests. If its ETag
+//changes, it will return the blob's io.Reader stream.
+type AzureBlob struct {
+	//Account, Container and Blob name of the binary
+	Account, Container, Blob string
+	//AccountKey is the base64 encoded storage account key
+	//used to sign requests (Shared Key authorization)
+	AccountKey string
+	//SASToken is a shared access signature query string
+	//(e.g. "sv=...&sig=..."), used instead of AccountKey.
+	//Leave both empty for public containers.
+	SASToken string
+	//EncryptionKey is the blob's customer-provided AES-256 key,
+	//it is sent with each request instead of being stored by Azure
+	EncryptionKey []byte
+	//Endpoint of the blob service, defaults to
+	//https://<Account>.blob.core.windows.net
+	Endpoint string
+	//Interval between checks
+	Interval time.Duration
+	//Jitter randomly offsets each Interval by up to +/- Jitter,
+	//spreading out the polls of a fleet sharing an Interval
+	Jitter time.Duration
+	//DelayFirstFetch waits an Interval before the first check too,
+	//rather than checking as soon as the fetcher starts
+	DelayFirstFetch bool
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	//OnNewVersion is called when a new version is detected, before it
+	//is downloaded. Returning an error defers the download to a later
+	//poll (e.g. to throttle a fleet-wide rollout).
+	OnNewVersion func(oldVersion, newVersion string) error
+	//AllowedContentTypes optionally restricts the Content-Type of
+	//downloaded binaries (e.g. "application/octet-stream"), so an
+	//error page served with a 200 is never mistaken for a binary
+	AllowedContentTypes []string
+	//SkipNotFound treats a missing binary (404) as no update, rather
+	//than an error, for sources where it is temporarily removed
+	SkipNotFound bool
+	//DownloadTimeout bounds each request, including reading the
+	//binary, so a stalled download fails and is retried on the
+	//next poll. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//StateFile is an optional path where the version of the last
+	//fetched binary is saved, so restarting the master process
+	//won't re-download an unchanged binary
+	StateFile string
+	//internal state
+	key      []byte
+	blobURL  string
+	delay    bool
+	lastETag string
+	intervalPoller
+}
+
+// Init validates the provided config
+func (a *AzureBlob) Init() error {
+	if a.Account == "" {
+		return fmt.Errorf("Account required")
+	}
+	a.delay = a.DelayFirstFetch
+	if a.Container == "" {
+		return fmt.Errorf("Container required")
+	}
+	if a.Blob == "" {
+		return fmt.Errorf("Blob required")
+	}
+	if a.AccountKey != "" && a.SASToken != "" {
+		return fmt.Errorf("AccountKey and SASToken cannot both be set")
+	}
+	if a.AccountKey != "" {
+		key, err := base64.StdEncoding.DecodeString(a.AccountKey)
+		if err != nil {
+			return fmt.Errorf("invalid AccountKey (%s)", err)
+		}
+		a.key = key
+	}
+	if a.EncryptionKey != nil && len(a.EncryptionKey) != 32 {
+		return fmt.Errorf("invalid EncryptionKey (AES-256 requires 32 bytes, got %d)", len(a.EncryptionKey))
+	}
+	//apply defaults
+	if a.Endpoint == "" {
+		a.Endpoint = "https://" + a.Account + ".blob.core.windows.net"
+	}
+	if a.Interval == 0 {
+		a.Interval = 5 * time.Minute
+	}
+	a.blobURL = strings.TrimSuffix(a.Endpoint, "/") + "/" +
+		url.PathEscape(a.Container) + "/" + (&url.URL{Path: a.Blob}).EscapedPath()
+	if a.SASToken != "" {
+		a.blobURL += "?" + strings.TrimPrefix(a.SASToken, "?")
+	}
+	if a.StateFile != "" {
+		s := azureState{}
+		if loadState(a.StateFile, &s) {
+			a.lastETag = s.ETag
+		}
+	}
+	return nil
+}
+
+//azureState is persisted to the StateFile
+type azureState struct {
+	ETag string `json:"etag"`
+}
+
+// Fetch the binary from Azure Blob Storage
+func (a *AzureBlob) Fetch() (io.Reader, error) {
+	//delay fetches after first
+	if a.delay {
+		if err := a.waitInterval(a.Interval, a.Jitter); err != nil {
+			return nil, err
+		}
+	}
+	a.delay = true
+	a.logf("checking %s/%s", a.Container, a.Blob)
+	//conditional binary fetch, unchanged blobs return 304
+	req, err := http.NewRequestWithContext(a.context(), "GET", a.blobURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET request failed (%w)", err)
+	}
+	if a.lastETag != "" {
+		req.Header.Set("If-None-Match", a.lastETag)
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if a.EncryptionKey != nil {
+		sum := sha256.Sum256(a.EncryptionKey)
+		req.Header.Set("x-ms-encryption-key", base64.StdEncoding.EncodeToString(a.EncryptionKey))
+		req.Header.Set("x-ms-encryption-key-sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		req.Header.Set("x-ms-encryption-algorithm", "AES256")
+	}
+	if a.key != nil {
+		a.sign(req)
+	}
+	resp, err := do(http.DefaultClient, req, a.DownloadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("GET request failed (%w)", err)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		a.logf("%s/%s unchanged, skipping", a.Container, a.Blob)
+		return nil, nil //skip, etag match
+	}
+	if resp.StatusCode == http.StatusNotFound && a.SkipNotFound {
+		resp.Body.Close()
+		a.logf("%s/%s not found, skipping", a.Container, a.Blob)
+		return nil, nil //skip, blob missing
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &statusError{"GET", resp.StatusCode}
+	}
+	if err := checkContentType(a.AllowedContentTypes, resp.Header); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if a.OnNewVersion != nil {
+		//the body is yet to be read, this
+		//aborts the download if it's deferred
+		if err := a.OnNewVersion(a.lastETag, resp.Header.Get("ETag")); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("download deferred (%s)", err)
+		}
+	}
+	prev := a.lastETag
+	a.lastETag = resp.Header.Get("ETag")
+	a.logf("downloading %s/%s (%d bytes)", a.Container, a.Blob, resp.ContentLength)
+	//a failed download is retried on the next poll
+	restore := func() {
+		a.lastETag = prev
+	}
+	//extract compressed files
+	r, err := decompress(sizedBody(resp), a.Blob, a.AutoDecompress || encoded(resp))
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	//saved once downloaded, so an interrupted
+	//download is retried after a restart too
+	return onComplete(r, a.persistState, restore), nil
+}
+
+//persistState saves the last ETag to the StateFile
+func (a *AzureBlob) persistState() {
+	if a.StateFile == "" {
+		return
+	}
+	if err := saveState(a.StateFile, azureState{a.lastETag}); err != nil {
+		a.logf("failed to save state (%s)", err)
+	}
+}
+
+//sign adds a Shared Key Authorization header to req, see
+//https://learn.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (a *AzureBlob) sign(req *http.Request) {
+	h := req.Header
+	//canonicalized x-ms-* headers
+	msHeaders := []string{}
+	for k := range h {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k)
+		}
+	}
+	sort.Strings(msHeaders)
+	canonHeaders := ""
+	for _, k := range msHeaders {
+		canonHeaders += k + ":" + strings.TrimSpace(h.Get(k)) + "\n"
+	}
+	//canonicalized resource
+	canonResource := "/" + a.Account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := []string{}
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		vals := query[k]
+		sort.Strings(vals)
+		canonResource += "\n" + strings.ToLower(k) + ":" + strings.Join(vals, ",")
+	}
+	toSign := strings.Join([]string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		"", //Content-Length
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", //Date, x-ms-date is used instead
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+		canonHeaders + canonResource,
+	}, "\n")
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(toSign))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	h.Set("Authorization", "SharedKey "+a.Account+":"+sig)
+}
+
+// Version returns the ETag of the last fetched binary
+func (a *AzureBlob) Version() string {
+	return a.lastETag
+}
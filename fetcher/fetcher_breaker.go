@@ -0,0 +1,141 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+//Breaker wraps another fetcher with a circuit breaker. Once
+//Threshold fetches in a row have failed, the circuit opens and
+//fetches fail fast with ErrCircuitOpen, without reaching the
+//source, until Cooldown has passed. A single probe fetch is then
+//let through, closing the circuit if it succeeds or re-opening
+//it for another Cooldown if it fails.
+type Breaker struct {
+	//Fetcher retrieves the binary itself
+	Fetcher Interface
+	//Threshold is the number of consecutive failed fetches
+	//which open the circuit, defaults to 5
+	Threshold int
+	//Cooldown is how long the circuit stays open before
+	//probing the source, defaults to 5 minutes
+	Cooldown time.Duration
+	//internal state
+	logger   Logger
+	failures int
+	openedAt time.Time
+}
+
+// Init validates the provided config and initialises the wrapped fetcher
+func (b *Breaker) Init() error {
+	if b.Fetcher == nil {
+		return errors.New("Fetcher required")
+	}
+	if b.Threshold <= 0 {
+		b.Threshold = 5
+	}
+	if b.Cooldown <= 0 {
+		b.Cooldown = 5 * time.Minute
+	}
+	return b.Fetcher.Init()
+}
+
+// SetContext passes ctx through to the wrapped fetcher
+func (b *Breaker) SetContext(ctx context.Context) {
+	if c, ok := b.Fetcher.(Cancellable); ok {
+		c.SetContext(ctx)
+	}
+}
+
+// SetLogger passes l through to the wrapped fetcher
+func (b *Breaker) SetLogger(l Logger) {
+	b.logger = l
+	if lg, ok := b.Fetcher.(Loggable); ok {
+		lg.SetLogger(l)
+	}
+}
+
+// Pin passes through to the wrapped fetcher
+func (b *Breaker) Pin(version string) {
+	if p, ok := b.Fetcher.(Pinnable); ok {
+		p.Pin(version)
+	}
+}
+
+// Trigger passes through to the wrapped fetcher
+func (b *Breaker) Trigger() {
+	if t, ok := b.Fetcher.(Triggerable); ok {
+		t.Trigger()
+	}
+}
+
+// Accepted passes through to the wrapped fetcher
+func (b *Breaker) Accepted() {
+	if a, ok := b.Fetcher.(Acceptable); ok {
+		a.Accepted()
+	}
+}
+
+// SetInterval passes through to the wrapped fetcher
+func (b *Breaker) SetInterval(d time.Duration) {
+	if a, ok := b.Fetcher.(Adjustable); ok {
+		a.SetInterval(d)
+	}
+}
+
+// NextPoll passes through to the wrapped fetcher
+func (b *Breaker) NextPoll() time.Time {
+	return nextPoll(b.Fetcher)
+}
+
+// Fetch the binary from the wrapped fetcher, unless the circuit is open
+func (b *Breaker) Fetch() (io.Reader, error) {
+	r, _, err := b.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata fetches the binary and its Metadata from the
+// wrapped fetcher, unless the circuit is open
+func (b *Breaker) FetchMetadata() (io.Reader, Metadata, error) {
+	if b.failures >= b.Threshold {
+		if wait := b.Cooldown - clk.Now().Sub(b.openedAt); wait > 0 {
+			return nil, Metadata{Size: -1, Rollout: -1}, errorf(ErrCircuitOpen,
+				"circuit open after %d failed fetches (probing in %s)", b.failures, wait.Round(time.Second))
+		}
+		b.logf("circuit cooldown passed, probing the source")
+	}
+	r, meta, err := FetchMetadata(b.Fetcher)
+	switch {
+	case err == nil:
+		if b.failures >= b.Threshold {
+			b.logf("circuit closed, the source has recovered")
+		}
+		b.failures = 0
+	case errors.Is(err, context.Canceled):
+		//shutting down, not a failure of the source
+	default:
+		b.failures++
+		if b.failures >= b.Threshold {
+			b.openedAt = clk.Now()
+			b.logf("circuit opened after %d failed fetches (%s), pausing fetches for %s", b.failures, err, b.Cooldown)
+		}
+	}
+	return r, meta, err
+}
+
+//logf reports a circuit event, it is a no-op without a logger
+func (b *Breaker) logf(f string, args ...interface{}) {
+	if b.logger != nil {
+		b.logger.Printf("[overseer fetcher] "+f, args...)
+	}
+}
+
+// Version returns the version reported by the wrapped fetcher
+func (b *Breaker) Version() string {
+	if ver, ok := b.Fetcher.(Versioned); ok {
+		return ver.Version()
+	}
+	return ""
+}
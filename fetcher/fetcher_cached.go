@@ -0,0 +1,282 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const cachePrefix = "overseer-cache-"
+
+//Cached wraps another fetcher and keeps a copy of each binary
+//it fetches in Dir, once overseer has accepted it (see Acceptable),
+//so binaries which fail its checks are never cached. If the first
+//fetch fails (e.g. a fresh device starting offline), the most
+//recently cached binary is returned instead, so the last-known-good
+//version can still run. Later fetches are passed through as normal.
+type Cached struct {
+	//Fetcher retrieves the binary itself
+	Fetcher Interface
+	//Dir is where binaries are cached, it is created if missing
+	Dir string
+	//Keep is the number of cached binaries to retain, defaults to 1
+	Keep int
+	//internal state
+	logger  Logger
+	ready   bool
+	fetched bool
+	pending string //read, awaiting Accepted
+}
+
+// Init validates the provided config and initialises the wrapped fetcher
+func (c *Cached) Init() error {
+	if c.Fetcher == nil {
+		return errors.New("Fetcher required")
+	}
+	if c.Dir == "" {
+		return errors.New("Dir required")
+	}
+	if c.Keep <= 0 {
+		c.Keep = 1
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache dir (%s)", err)
+	}
+	//binaries never accepted before a restart of the master process
+	if tmps, err := filepath.Glob(filepath.Join(c.Dir, "."+cachePrefix+"*")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+	if err := c.Fetcher.Init(); err != nil {
+		//offline devices may fail to init, start with
+		//the cache and retry the init on each fetch
+		if c.latest() == "" {
+			return err
+		}
+		c.logf("fetcher init failed (%s), using cached binary", err)
+		return nil
+	}
+	c.ready = true
+	return nil
+}
+
+// SetContext passes ctx through to the wrapped fetcher
+func (c *Cached) SetContext(ctx context.Context) {
+	if cc, ok := c.Fetcher.(Cancellable); ok {
+		cc.SetContext(ctx)
+	}
+}
+
+// SetLogger passes l through to the wrapped fetcher
+func (c *Cached) SetLogger(l Logger) {
+	c.logger = l
+	if lg, ok := c.Fetcher.(Loggable); ok {
+		lg.SetLogger(l)
+	}
+}
+
+// Pin passes through to the wrapped fetcher
+func (c *Cached) Pin(version string) {
+	if p, ok := c.Fetcher.(Pinnable); ok {
+		p.Pin(version)
+	}
+}
+
+// Trigger passes through to the wrapped fetcher
+func (c *Cached) Trigger() {
+	if t, ok := c.Fetcher.(Triggerable); ok {
+		t.Trigger()
+	}
+}
+
+// Accepted caches the binary last fetched, then
+// passes through to the wrapped fetcher
+func (c *Cached) Accepted() {
+	if c.pending != "" {
+		c.commit(c.pending)
+		c.pending = ""
+	}
+	if a, ok := c.Fetcher.(Acceptable); ok {
+		a.Accepted()
+	}
+}
+
+// SetInterval passes through to the wrapped fetcher
+func (c *Cached) SetInterval(d time.Duration) {
+	if a, ok := c.Fetcher.(Adjustable); ok {
+		a.SetInterval(d)
+	}
+}
+
+// NextPoll passes through to the wrapped fetcher
+func (c *Cached) NextPoll() time.Time {
+	return nextPoll(c.Fetcher)
+}
+
+// Fetch the binary from the wrapped fetcher, caching it as it is read
+func (c *Cached) Fetch() (io.Reader, error) {
+	r, _, err := c.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata fetches the binary and its Metadata from the
+// wrapped fetcher, caching the binary as it is read. A cached
+// binary is only described by its Size.
+func (c *Cached) FetchMetadata() (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	first := !c.fetched
+	c.fetched = true
+	var r io.Reader
+	meta := none
+	var err error
+	if !c.ready {
+		if err = c.Fetcher.Init(); err == nil {
+			c.ready = true
+		} else {
+			err = fmt.Errorf("fetcher init failed (%w)", err)
+		}
+	}
+	if c.ready {
+		r, meta, err = FetchMetadata(c.Fetcher)
+	}
+	if err != nil {
+		if first {
+			if path := c.latest(); path != "" {
+				if f, ferr := os.Open(path); ferr == nil {
+					c.logf("fetch failed (%s), using cached binary %s", err, path)
+					return f, Metadata{Size: sizeOf(f), Rollout: -1}, nil
+				}
+			}
+		}
+		return nil, none, err
+	}
+	if r == nil {
+		return nil, none, nil
+	}
+	f, err := ioutil.TempFile(c.Dir, "."+cachePrefix)
+	if err != nil {
+		c.logf("failed to cache binary (%s)", err)
+		return r, meta, nil
+	}
+	return &cacheWriter{Reader: r, f: f, c: c}, meta, nil
+}
+
+//latest returns the path of the most recently cached binary
+func (c *Cached) latest() string {
+	paths := c.cached()
+	if len(paths) == 0 {
+		return ""
+	}
+	return paths[len(paths)-1]
+}
+
+//cached returns the paths of all cached binaries, oldest first
+func (c *Cached) cached() []string {
+	entries, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil
+	}
+	paths := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), cachePrefix) {
+			paths = append(paths, filepath.Join(c.Dir, e.Name()))
+		}
+	}
+	//names are fixed width timestamps
+	sort.Strings(paths)
+	return paths
+}
+
+//discardPending removes a binary which wasn't accepted
+func (c *Cached) discardPending() {
+	if c.pending != "" {
+		os.Remove(c.pending)
+		c.pending = ""
+	}
+}
+
+//commit moves a completely read binary into the cache
+//and removes all but the Keep most recent binaries
+func (c *Cached) commit(tmp string) {
+	path := filepath.Join(c.Dir, fmt.Sprintf("%s%020d", cachePrefix, time.Now().UnixNano()))
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		c.logf("failed to cache binary (%s)", err)
+		return
+	}
+	paths := c.cached()
+	for len(paths) > c.Keep {
+		os.Remove(paths[0])
+		paths = paths[1:]
+	}
+}
+
+//logf reports a fetch event, it is a no-op without a logger
+func (c *Cached) logf(f string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf("[overseer fetcher] "+f, args...)
+	}
+}
+
+//cacheWriter copies the binary into the cache as it is read,
+//complete binaries are pending until Accepted
+type cacheWriter struct {
+	io.Reader
+	f *os.File
+	c *Cached
+}
+
+func (w *cacheWriter) Read(p []byte) (int, error) {
+	n, err := w.Reader.Read(p)
+	if n > 0 && w.f != nil {
+		if _, werr := w.f.Write(p[:n]); werr != nil {
+			w.c.logf("failed to cache binary (%s)", werr)
+			w.discard()
+		}
+	}
+	if err == io.EOF && w.f != nil {
+		name := w.f.Name()
+		if cerr := w.f.Close(); cerr == nil {
+			//the previous binary wasn't accepted
+			w.c.discardPending()
+			w.c.pending = name
+		} else {
+			os.Remove(name)
+		}
+		w.f = nil
+	}
+	return n, err
+}
+
+func (w *cacheWriter) Close() error {
+	w.discard()
+	if c, ok := w.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+//discard removes a partially cached binary
+func (w *cacheWriter) discard() {
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		w.f = nil
+	}
+}
+
+// Version returns the version reported by the wrapped fetcher
+func (c *Cached) Version() string {
+	if ver, ok := c.Fetcher.(Versioned); ok {
+		return ver.Version()
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package fetcher
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+//binaryFetcher returns each of its binaries in turn, then fails
+type binaryFetcher struct {
+	binaries []string
+}
+
+func (f *binaryFetcher) Init() error { return nil }
+
+func (f *binaryFetcher) Fetch() (io.Reader, error) {
+	if len(f.binaries) == 0 {
+		return nil, errors.New("offline")
+	}
+	b := f.binaries[0]
+	f.binaries = f.binaries[1:]
+	return strings.NewReader(b), nil
+}
+
+func TestCachedKeepsAcceptedBinaries(t *testing.T) {
+	dir := t.TempDir()
+	c := &Cached{Fetcher: &binaryFetcher{[]string{"good", "rejected"}}, Dir: dir}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i, accepted := range []bool{true, false} {
+		r, err := c.Fetch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		r.(io.Closer).Close()
+		if accepted {
+			c.Accepted()
+		}
+		if n := len(c.cached()); n != 1 {
+			t.Fatalf("fetch #%d: %d cached binaries, expected 1", i+1, n)
+		}
+	}
+	//as if the master process restarted offline
+	c = &Cached{Fetcher: &binaryFetcher{}, Dir: dir}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil || string(b) != "good" {
+		t.Fatalf("fell back to %q, %v, expected the accepted binary", b, err)
+	}
+}
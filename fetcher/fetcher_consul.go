@@ -0,0 +1,211 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Consul watches a key in Consul's KV store with blocking queries,
+//so updates are seen as soon as the key is written. The key's value
+//is the location of the current binary (e.g. a URL) and when it
+//changes, the binary is downloaded from the new location.
+type Consul struct {
+	//Address of the Consul agent, defaults to the CONSUL_HTTP_ADDR
+	//environment or http://127.0.0.1:8500
+	Address string
+	//Key holding the location of the binary
+	Key string
+	//Token is an optional ACL token, defaults to the
+	//CONSUL_HTTP_TOKEN environment
+	Token string
+	//Wait is the longest each blocking query is held open
+	//before it is repeated, defaults to 5 minutes
+	Wait time.Duration
+	//Fetcher optionally returns the fetcher which downloads the
+	//binary at each new location, it is initialised and fetched
+	//once. Defaults to an HTTP GET of the location.
+	Fetcher func(location string) (Interface, error)
+	//Headers are added to the default binary requests
+	Headers http.Header
+	//DownloadTimeout bounds the default binary requests,
+	//including reading the binary. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	//StateFile is an optional path where the location of the last
+	//fetched binary is saved, so restarting the master process
+	//won't re-download an unchanged binary
+	StateFile string
+	//internal state
+	kvURL string
+	index uint64
+	value string
+	poller
+}
+
+//consulState is persisted to the StateFile
+type consulState struct {
+	Location string `json:"location"`
+}
+
+// Init validates the provided config
+func (c *Consul) Init() error {
+	if c.Key == "" {
+		return errors.New("Key required")
+	}
+	if c.Address == "" {
+		c.Address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if c.Address == "" {
+		c.Address = "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(c.Address, "://") {
+		c.Address = "http://" + c.Address
+	}
+	if c.Token == "" {
+		c.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if c.Wait <= 0 {
+		c.Wait = 5 * time.Minute
+	}
+	c.kvURL = strings.TrimSuffix(c.Address, "/") + "/v1/kv/" + strings.TrimPrefix(c.Key, "/")
+	if c.StateFile != "" {
+		s := consulState{}
+		if loadState(c.StateFile, &s) {
+			c.value = s.Location
+		}
+	}
+	return nil
+}
+
+// Fetch blocks until the key changes, then fetches the binary
+// from its new location
+func (c *Consul) Fetch() (io.Reader, error) {
+	location, err := c.watch()
+	if err != nil {
+		return nil, err
+	}
+	if location == "" {
+		c.logf("%s is empty, skipping", c.Key)
+		return nil, nil //skip, no location
+	}
+	if location == c.value {
+		return nil, nil //skip, location unchanged
+	}
+	c.logf("%s changed to %s", c.Key, location)
+	r, err := c.download(location)
+	if err != nil {
+		//retry the download with the next query
+		c.index = 0
+		return nil, err
+	}
+	prev := c.value
+	c.value = location
+	//a failed download is retried with the next query
+	restore := func() {
+		c.value = prev
+		c.index = 0
+	}
+	//saved once downloaded, so an interrupted
+	//download is retried after a restart too
+	return onComplete(r, c.persistState, restore), nil
+}
+
+//persistState saves the last location to the StateFile
+func (c *Consul) persistState() {
+	if c.StateFile == "" {
+		return
+	}
+	if err := saveState(c.StateFile, consulState{Location: c.value}); err != nil {
+		c.logf("failed to save state (%s)", err)
+	}
+}
+
+//watch blocks until the key's index moves past the last seen
+//index (the first query returns immediately), or Trigger is
+//called, returning the key's value
+func (c *Consul) watch() (string, error) {
+	ctx, cancel := context.WithCancel(c.context())
+	defer cancel()
+	triggered := make(chan bool, 1)
+	go func() {
+		select {
+		case <-c.wake():
+			triggered <- true
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	u := c.kvURL + "?raw"
+	if c.index > 0 {
+		u += fmt.Sprintf("&index=%d&wait=%ds", c.index, int(c.Wait/time.Second))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", fmt.Errorf("KV request failed (%w)", err)
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		select {
+		case <-triggered:
+			//query the current value immediately
+			c.index = 0
+			return c.watch()
+		default:
+		}
+		return "", fmt.Errorf("KV request failed (%w)", transient(err))
+	}
+	defer resp.Body.Close()
+	//an unchanged index means the query timed out, though indexes
+	//may go backwards (e.g. after a snapshot restore), the next
+	//query must then start over
+	if index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64); err == nil && index >= c.index {
+		c.index = index
+	} else {
+		c.index = 0
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &statusError{"KV", resp.StatusCode}
+	}
+	//locations are small, cap them at 64KB
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read KV value (%w)", transient(err))
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+//download the binary at location with the Fetcher
+func (c *Consul) download(location string) (io.Reader, error) {
+	var f Interface = &HTTP{
+		URL:             location,
+		Conditional:     true,
+		Headers:         c.Headers,
+		DownloadTimeout: c.DownloadTimeout,
+		AutoDecompress:  c.AutoDecompress,
+	}
+	if c.Fetcher != nil {
+		var err error
+		if f, err = c.Fetcher(location); err != nil {
+			return nil, fmt.Errorf("invalid location %s (%s)", location, err)
+		}
+	}
+	return c.fetchOnce(f)
+}
+
+// Version returns the location of the last fetched binary
+func (c *Consul) Version() string {
+	return c.value
+}
@@ -0,0 +1,148 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+//Decrypted wraps another fetcher whose binaries are encrypted
+//at the application layer (e.g. envelope encrypted with a KMS
+//data key), decrypting each new binary before it is returned.
+//Any decryption error, including one while reading the
+//decrypted stream, aborts the upgrade.
+type Decrypted struct {
+	//Fetcher retrieves the encrypted binary
+	Fetcher Interface
+	//Decrypt is called with each new encrypted binary and
+	//returns its plaintext. If the returned reader is also an
+	//io.Closer, it is closed once the binary has been read.
+	Decrypt func(io.Reader) (io.Reader, error)
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes after decryption. Binaries are compressed
+	//before they are encrypted, so the wrapped fetcher's own suffix
+	//and AutoDecompress checks can't detect them.
+	AutoDecompress bool
+}
+
+// Init validates the provided config and initialises the wrapped fetcher
+func (d *Decrypted) Init() error {
+	if d.Fetcher == nil {
+		return errors.New("Fetcher required")
+	}
+	if d.Decrypt == nil {
+		return errors.New("Decrypt required")
+	}
+	return d.Fetcher.Init()
+}
+
+// SetContext passes ctx through to the wrapped fetcher
+func (d *Decrypted) SetContext(ctx context.Context) {
+	if c, ok := d.Fetcher.(Cancellable); ok {
+		c.SetContext(ctx)
+	}
+}
+
+// SetLogger passes l through to the wrapped fetcher
+func (d *Decrypted) SetLogger(l Logger) {
+	if lg, ok := d.Fetcher.(Loggable); ok {
+		lg.SetLogger(l)
+	}
+}
+
+// Pin passes through to the wrapped fetcher
+func (d *Decrypted) Pin(version string) {
+	if p, ok := d.Fetcher.(Pinnable); ok {
+		p.Pin(version)
+	}
+}
+
+// Trigger passes through to the wrapped fetcher
+func (d *Decrypted) Trigger() {
+	if t, ok := d.Fetcher.(Triggerable); ok {
+		t.Trigger()
+	}
+}
+
+// Accepted passes through to the wrapped fetcher
+func (d *Decrypted) Accepted() {
+	if a, ok := d.Fetcher.(Acceptable); ok {
+		a.Accepted()
+	}
+}
+
+// SetInterval passes through to the wrapped fetcher
+func (d *Decrypted) SetInterval(interval time.Duration) {
+	if a, ok := d.Fetcher.(Adjustable); ok {
+		a.SetInterval(interval)
+	}
+}
+
+// NextPoll passes through to the wrapped fetcher
+func (d *Decrypted) NextPoll() time.Time {
+	return nextPoll(d.Fetcher)
+}
+
+// Fetch the binary from the wrapped fetcher and decrypt it
+func (d *Decrypted) Fetch() (io.Reader, error) {
+	r, _, err := d.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata fetches the binary and its Metadata from the
+// wrapped fetcher and decrypts it. The declared SHA256 and Size
+// are of the encrypted binary, so they are cleared.
+func (d *Decrypted) FetchMetadata() (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	r, meta, err := FetchMetadata(d.Fetcher)
+	if r == nil || err != nil {
+		return r, none, err
+	}
+	meta.SHA256 = nil
+	meta.Size = -1
+	src, ok := r.(io.ReadCloser)
+	if !ok {
+		src = ioutil.NopCloser(r)
+	}
+	plain, err := d.Decrypt(src)
+	if err != nil {
+		src.Close()
+		return nil, none, fmt.Errorf("failed to decrypt binary (%s)", err)
+	}
+	if plain == nil {
+		src.Close()
+		return nil, none, errors.New("failed to decrypt binary (no plaintext)")
+	}
+	rc := &decryptedReadCloser{Reader: plain, src: src}
+	if !d.AutoDecompress {
+		return rc, meta, nil
+	}
+	dr, err := decompress(rc, "", true)
+	if err != nil {
+		return nil, none, err
+	}
+	return dr, meta, nil
+}
+
+type decryptedReadCloser struct {
+	io.Reader
+	src io.Closer
+}
+
+func (d *decryptedReadCloser) Close() error {
+	if c, ok := d.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return d.src.Close()
+}
+
+// Version returns the version reported by the wrapped fetcher
+func (d *Decrypted) Version() string {
+	if ver, ok := d.Fetcher.(Versioned); ok {
+		return ver.Version()
+	}
+	return ""
+}
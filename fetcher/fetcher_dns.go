@@ -0,0 +1,200 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DNS polls a TXT record which points to the current binary, so updates
+//are distributed without a central API, for example:
+//
+//	app.example.com. TXT "url=https://example.com/app-1.2.0 sha256=9f86d0... version=1.2.0"
+//
+//When the record changes, the binary at its url is downloaded and only
+//returned once it matches the record's sha256 (and size, when set), as
+//with a Manifest. The record may also declare a rollout percentage. Its
+//version defaults to the sha256, other TXT records of Name (e.g. SPF)
+//are ignored.
+//
+//The system resolver does not validate DNSSEC, so unless Resolver is
+//a trusted validating resolver, set PublicKey: the record must then
+//end with a sig field, the base64 Ed25519 signature of the record up
+//to " sig=", so a spoofed record is rejected.
+type DNS struct {
+	//Name of the TXT record
+	Name string
+	//Interval between checks
+	Interval time.Duration
+	//Jitter randomly offsets each Interval by up to +/- Jitter,
+	//spreading out the polls of a fleet sharing an Interval
+	Jitter time.Duration
+	//DelayFirstFetch waits an Interval before the first check too,
+	//rather than checking as soon as the fetcher starts
+	DelayFirstFetch bool
+	//Resolver optionally replaces the system resolver
+	Resolver *net.Resolver
+	//PublicKey optionally requires a signed record
+	PublicKey ed25519.PublicKey
+	//Headers are added to binary requests (e.g. Authorization)
+	Headers http.Header
+	//DownloadTimeout bounds the download of each binary, so a
+	//stalled download fails and is retried with the next poll.
+	//Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//NodeID and Rollout decide whether this node adopts a binary
+	//with a rollout (see Manifest)
+	NodeID  string
+	Rollout func(meta Metadata, nodeID string) bool
+	//internal state
+	manifest Manifest
+	delay    bool
+	intervalPoller
+}
+
+// Init validates the provided config
+func (d *DNS) Init() error {
+	if d.Name == "" {
+		return errors.New("Name required")
+	}
+	d.delay = d.DelayFirstFetch
+	if d.PublicKey != nil && len(d.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid PublicKey (%d bytes)", len(d.PublicKey))
+	}
+	if d.Interval == 0 {
+		d.Interval = 5 * time.Minute
+	}
+	if d.Resolver == nil {
+		d.Resolver = net.DefaultResolver
+	}
+	d.manifest.Headers = d.Headers
+	d.manifest.DownloadTimeout = d.DownloadTimeout
+	d.manifest.NodeID = d.NodeID
+	d.manifest.Rollout = d.Rollout
+	return d.manifest.init()
+}
+
+// SetContext sets the context used to cancel fetches
+func (d *DNS) SetContext(ctx context.Context) {
+	d.poller.SetContext(ctx)
+	d.manifest.SetContext(ctx)
+}
+
+// SetLogger sets the logger used to report fetch events
+func (d *DNS) SetLogger(l Logger) {
+	d.poller.SetLogger(l)
+	d.manifest.logger = l
+}
+
+// Fetch the binary when the record has changed
+func (d *DNS) Fetch() (io.Reader, error) {
+	r, _, err := d.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata fetches the binary along with the version,
+// size and (unless it is decompressed) SHA-256 of its record
+func (d *DNS) FetchMetadata() (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	//delay fetches after first
+	if d.delay {
+		if err := d.waitInterval(d.Interval, d.Jitter); err != nil {
+			return nil, none, err
+		}
+	}
+	d.delay = true
+	d.logf("checking %s", d.Name)
+	mf, err := d.lookup()
+	if err != nil {
+		return nil, none, err
+	}
+	return d.manifest.fetch(mf)
+}
+
+//lookup queries and parses the record of the binary
+func (d *DNS) lookup() (manifestFile, error) {
+	mf := manifestFile{}
+	records, err := d.Resolver.LookupTXT(d.context(), d.Name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return mf, errorf(ErrNotFound, "TXT lookup of %s failed (%s)", d.Name, err)
+		}
+		return mf, transient(fmt.Errorf("TXT lookup of %s failed (%w)", d.Name, err))
+	}
+	found := ""
+	for _, r := range records {
+		if !strings.HasPrefix(r, "url=") && !strings.Contains(r, " url=") {
+			continue //another record
+		}
+		if found != "" {
+			return mf, fmt.Errorf("%s has more than one binary record", d.Name)
+		}
+		found = r
+	}
+	if found == "" {
+		return mf, errorf(ErrNotFound, "%s has no binary record", d.Name)
+	}
+	if err := d.verify(found); err != nil {
+		return mf, err
+	}
+	for _, field := range strings.Fields(found) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return mf, fmt.Errorf("invalid record %q (bad field %q)", found, field)
+		}
+		switch v := kv[1]; kv[0] {
+		case "url":
+			mf.URL = v
+		case "sha256":
+			mf.SHA256 = v
+		case "version":
+			mf.Version = v
+		case "size":
+			if mf.Size, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return mf, fmt.Errorf("invalid record (bad size %q)", v)
+			}
+		case "rollout":
+			r, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return mf, fmt.Errorf("invalid record (bad rollout %q)", v)
+			}
+			mf.Rollout = &r
+		}
+	}
+	if mf.URL == "" || mf.SHA256 == "" {
+		return mf, errors.New("invalid record (url and sha256 required)")
+	}
+	if mf.Version == "" {
+		mf.Version = mf.SHA256
+	}
+	return mf, nil
+}
+
+//verify the signature of record, when a PublicKey is set
+func (d *DNS) verify(record string) error {
+	if d.PublicKey == nil {
+		return nil
+	}
+	i := strings.LastIndex(record, " sig=")
+	if i < 0 {
+		return fmt.Errorf("record of %s is not signed", d.Name)
+	}
+	sig, err := base64.StdEncoding.DecodeString(record[i+len(" sig="):])
+	if err != nil || !ed25519.Verify(d.PublicKey, []byte(record[:i]), sig) {
+		return fmt.Errorf("record of %s has an invalid signature", d.Name)
+	}
+	return nil
+}
+
+// Version returns the record version of the last fetched binary
+func (d *DNS) Version() string {
+	return d.manifest.Version()
+}
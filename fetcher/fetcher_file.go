@@ -5,19 +5,40 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 // File checks the provided Path, at the provided
 // Interval for new Go binaries. When a new binary
 // is found it will replace the currently running
-// binary.
+// binary. Paths ending in .gz, .bz2 or .zst will be
+// decompressed.
 type File struct {
 	Path     string
 	Interval time.Duration
+	// Notify uses filesystem notifications (inotify,
+	// kqueue, etc) to detect changes as they happen,
+	// Interval is then only used as a fallback.
+	Notify bool
+	// AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	// by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	// Resolve follows the symlinks in Path, for release layouts
+	// such as /opt/app/current/bin where current is flipped to
+	// point at /opt/app/releases/<version>. The resolved path then
+	// identifies the binary (see Version) and is what gets read,
+	// so flipping the link mid-read can't mix two releases.
+	Resolve bool
 	// hash is the file modify time and its size
-	hash  string
-	delay bool
+	hash     string
+	resolved string
+	links    []string
+	delay    bool
+	watcher  *fsnotify.Watcher
+	intervalPoller
 }
 
 // Init sets the Path and Interval options
@@ -25,12 +46,35 @@ func (f *File) Init() error {
 	if f.Path == "" {
 		return fmt.Errorf("Path required")
 	}
-	if f.Interval < 1*time.Second {
+	if f.Interval >= 0 && f.Interval < 1*time.Second {
 		f.Interval = 1 * time.Second
 	}
 	if err := f.updateHash(); err != nil {
 		return err
 	}
+	if f.Notify {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return fmt.Errorf("Watcher error: %s", err)
+		}
+		//watch the directory to catch files being
+		//replaced, not just written in-place
+		dirs := []string{filepath.Dir(f.Path)}
+		if f.Resolve {
+			//and the directories of the links, to catch them being flipped
+			f.links = symlinks(f.Path)
+			for _, l := range f.links {
+				dirs = append(dirs, filepath.Dir(l))
+			}
+		}
+		for _, dir := range dirs {
+			if err := w.Add(dir); err != nil {
+				w.Close()
+				return fmt.Errorf("Watch error: %s", err)
+			}
+		}
+		f.watcher = w
+	}
 	return nil
 }
 
@@ -38,19 +82,27 @@ func (f *File) Init() error {
 func (f *File) Fetch() (io.Reader, error) {
 	//only delay after first fetch
 	if f.delay {
-		time.Sleep(f.Interval)
+		if err := f.waitForChange(); err != nil {
+			return nil, err
+		}
 	}
 	f.delay = true
+	f.logf("checking %s", f.Path)
 	lastHash := f.hash
 	if err := f.updateHash(); err != nil {
 		return nil, err
 	}
 	// no change
 	if lastHash == f.hash {
+		f.logf("%s unchanged, skipping", f.Path)
 		return nil, nil
 	}
 	// changed!
-	file, err := os.Open(f.Path)
+	path := f.Path
+	if f.Resolve {
+		path = f.resolved
+	}
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -66,7 +118,10 @@ func (f *File) Fetch() (io.Reader, error) {
 		}
 		attempt++
 		//sleep
-		time.Sleep(rate)
+		if err := sleep(f.context(), rate); err != nil {
+			file.Close()
+			return nil, err
+		}
 		//check hash!
 		if err := f.updateHash(); err != nil {
 			file.Close()
@@ -78,11 +133,64 @@ func (f *File) Fetch() (io.Reader, error) {
 		}
 		lastHash = f.hash
 	}
-	return file, nil
+	if f.Resolve && f.resolved != path {
+		//the link was flipped again, read its latest target
+		file.Close()
+		path = f.resolved
+		if file, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+	f.logf("reading %s", path)
+	return decompress(file, path, f.AutoDecompress)
+}
+
+//wait for the next Interval, or when
+//notifying, the next change to Path
+func (f *File) waitForChange() error {
+	if f.watcher == nil {
+		return f.waitInterval(f.Interval, 0)
+	}
+	ctx := f.context()
+	var timeout <-chan time.Time
+	if d := f.every(f.Interval); d >= 0 {
+		timeout = time.After(d)
+	}
+	for {
+		select {
+		case e, ok := <-f.watcher.Events:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			if name := filepath.Clean(e.Name); name == filepath.Clean(f.Path) || contains(f.links, name) {
+				return nil
+			}
+		case err := <-f.watcher.Errors:
+			return fmt.Errorf("Watch error: %s", err)
+		case <-timeout:
+			return nil
+		case <-f.wake():
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (f *File) updateHash() error {
-	file, err := os.Open(f.Path)
+	path := f.Path
+	if f.Resolve {
+		resolved, err := filepath.EvalSymlinks(f.Path)
+		if err != nil {
+			//link (or its target) does not exist, skip
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("Resolve path error: %s", err)
+		}
+		path = resolved
+	}
+	file, err := os.Open(path)
 	if err != nil {
 		//binary does not exist, skip
 		if os.IsNotExist(err) {
@@ -96,5 +204,40 @@ func (f *File) updateHash() error {
 		return fmt.Errorf("Get file stat error: %s", err)
 	}
 	f.hash = fmt.Sprintf("%d|%d", s.ModTime().UnixNano(), s.Size())
+	if f.Resolve {
+		f.resolved = path
+		f.hash = path + "|" + f.hash
+	}
 	return nil
 }
+
+// Version returns the modify time and size of the last fetched
+// binary, or with Resolve, its resolved path
+func (f *File) Version() string {
+	if f.Resolve {
+		return f.resolved
+	}
+	return f.hash
+}
+
+//symlinks returns the symlinks among path and its parent directories
+func symlinks(path string) []string {
+	links := []string{}
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if info, err := os.Lstat(p); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			links = append(links, p)
+		}
+		if filepath.Dir(p) == p {
+			return links
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
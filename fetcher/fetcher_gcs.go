@@ -0,0 +1,269 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+//GCS uses the Google Cloud Storage JSON API to poll the
+//generation of a given object. If its generation changes,
+//it will fetch and return its io.Reader stream.
+type GCS struct {
+	//Bucket and Object of the binary
+	Bucket, Object string
+	//Interval between checks
+	Interval time.Duration
+	//Jitter randomly offsets each Interval by up to +/- Jitter,
+	//spreading out the polls of a fleet sharing an Interval
+	Jitter time.Duration
+	//DelayFirstFetch waits an Interval before the first check too,
+	//rather than checking as soon as the fetcher starts
+	DelayFirstFetch bool
+	//CredentialsFile is an optional path to a service account
+	//JSON key. When empty, Application Default Credentials are used.
+	CredentialsFile string
+	//EncryptionKey is the object's customer-supplied AES-256 key,
+	//it is sent with each request instead of being stored by GCS
+	EncryptionKey []byte
+	//UserProject is the project billed for requests, required
+	//by buckets with Requester Pays enabled
+	UserProject string
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	//OnNewVersion is called when a new version is detected, before it
+	//is downloaded. Returning an error defers the download to a later
+	//poll (e.g. to throttle a fleet-wide rollout).
+	OnNewVersion func(oldVersion, newVersion string) error
+	//AllowedContentTypes optionally restricts the Content-Type of
+	//downloaded binaries (e.g. "application/octet-stream"), so an
+	//error page served with a 200 is never mistaken for a binary
+	AllowedContentTypes []string
+	//SkipNotFound treats a missing binary (404) as no update, rather
+	//than an error, for sources where it is temporarily removed
+	SkipNotFound bool
+	//DownloadTimeout bounds each request, including reading the
+	//binary, so a stalled download fails and is retried on the
+	//next poll. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//StateFile is an optional path where the version of the last
+	//fetched binary is saved, so restarting the master process
+	//won't re-download an unchanged binary
+	StateFile string
+	//internal state
+	keyHeaders     http.Header
+	client         *http.Client
+	objectURL      string
+	delay          bool
+	lastGeneration string
+	intervalPoller
+	pinner
+}
+
+// Init validates the provided config
+func (g *GCS) Init() error {
+	if g.Bucket == "" {
+		return fmt.Errorf("Bucket required")
+	}
+	g.delay = g.DelayFirstFetch
+	if g.Object == "" {
+		return fmt.Errorf("Object required")
+	}
+	if g.EncryptionKey != nil {
+		if len(g.EncryptionKey) != 32 {
+			return fmt.Errorf("invalid EncryptionKey (AES-256 requires 32 bytes, got %d)", len(g.EncryptionKey))
+		}
+		sum := sha256.Sum256(g.EncryptionKey)
+		g.keyHeaders = http.Header{
+			"X-Goog-Encryption-Algorithm":  {"AES256"},
+			"X-Goog-Encryption-Key":        {base64.StdEncoding.EncodeToString(g.EncryptionKey)},
+			"X-Goog-Encryption-Key-Sha256": {base64.StdEncoding.EncodeToString(sum[:])},
+		}
+	}
+	//apply defaults
+	if g.Interval == 0 {
+		g.Interval = 5 * time.Minute
+	}
+	ctx := context.Background()
+	var creds *google.Credentials
+	if g.CredentialsFile != "" {
+		b, err := ioutil.ReadFile(g.CredentialsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read credentials file (%s)", err)
+		}
+		if creds, err = google.CredentialsFromJSON(ctx, b, gcsScope); err != nil {
+			return fmt.Errorf("invalid credentials file (%s)", err)
+		}
+	} else {
+		var err error
+		if creds, err = google.FindDefaultCredentials(ctx, gcsScope); err != nil {
+			return fmt.Errorf("failed to find default credentials (%s)", err)
+		}
+	}
+	g.client = oauth2.NewClient(ctx, creds.TokenSource)
+	g.objectURL = "https://storage.googleapis.com/storage/v1/b/" +
+		url.PathEscape(g.Bucket) + "/o/" + url.PathEscape(g.Object)
+	if g.StateFile != "" {
+		s := gcsState{}
+		if loadState(g.StateFile, &s) {
+			g.lastGeneration = s.Generation
+		}
+	}
+	return nil
+}
+
+//gcsState is persisted to the StateFile
+type gcsState struct {
+	Generation string `json:"generation"`
+}
+
+// Fetch the binary from GCS
+func (g *GCS) Fetch() (io.Reader, error) {
+	//delay fetches after first
+	if g.delay {
+		if err := g.waitInterval(g.Interval, g.Jitter); err != nil {
+			return nil, err
+		}
+	}
+	g.delay = true
+	g.logf("checking gs://%s/%s", g.Bucket, g.Object)
+	//status check using object metadata
+	metaURL := g.objectURL + "?fields=generation"
+	if gen := g.pinned(); gen != "" {
+		metaURL += "&generation=" + url.QueryEscape(gen)
+	}
+	resp, err := g.get(metaURL)
+	if err != nil {
+		return nil, fmt.Errorf("metadata request failed (%w)", err)
+	}
+	if resp.StatusCode == http.StatusNotFound && g.SkipNotFound {
+		resp.Body.Close()
+		g.logf("gs://%s/%s not found, skipping", g.Bucket, g.Object)
+		return nil, nil //skip, object missing
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &statusError{"metadata", resp.StatusCode}
+	}
+	meta := struct {
+		Generation string `json:"generation"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&meta)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata (%s)", err)
+	}
+	if meta.Generation != "" && g.lastGeneration == meta.Generation {
+		g.logf("gs://%s/%s generation %s unchanged, skipping", g.Bucket, g.Object, meta.Generation)
+		return nil, nil //skip, generation match
+	}
+	if g.OnNewVersion != nil {
+		if err := g.OnNewVersion(g.lastGeneration, meta.Generation); err != nil {
+			return nil, fmt.Errorf("download deferred (%s)", err)
+		}
+	}
+	//binary fetch of this exact generation
+	resp, err = g.get(g.objectURL + "?alt=media&generation=" + url.QueryEscape(meta.Generation))
+	if err != nil {
+		return nil, fmt.Errorf("GET request failed (%w)", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &statusError{"GET", resp.StatusCode}
+	}
+	if err := checkContentType(g.AllowedContentTypes, resp.Header); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	prev := g.lastGeneration
+	g.lastGeneration = meta.Generation
+	g.logf("downloading gs://%s/%s generation %s (%d bytes)", g.Bucket, g.Object, meta.Generation, resp.ContentLength)
+	//a failed download is retried on the next poll
+	restore := func() {
+		g.lastGeneration = prev
+	}
+	//extract compressed files
+	r, err := decompress(sizedBody(resp), g.Object, g.AutoDecompress || encoded(resp))
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	//saved once downloaded, so an interrupted
+	//download is retried after a restart too
+	return onComplete(r, g.persistState, restore), nil
+}
+
+//persistState saves the last generation to the StateFile
+func (g *GCS) persistState() {
+	if g.StateFile == "" {
+		return
+	}
+	if err := saveState(g.StateFile, gcsState{g.lastGeneration}); err != nil {
+		g.logf("failed to save state (%s)", err)
+	}
+}
+
+//get requests u, which must have a query string
+func (g *GCS) get(u string) (*http.Response, error) {
+	if g.UserProject != "" {
+		u += "&userProject=" + url.QueryEscape(g.UserProject)
+	}
+	req, err := http.NewRequestWithContext(g.context(), "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range g.keyHeaders {
+		req.Header[k] = v
+	}
+	return do(g.client, req, g.DownloadTimeout)
+}
+
+// List the generations of the object, noncurrent generations
+// are only listed when the bucket has object versioning enabled
+func (g *GCS) List() ([]VersionInfo, error) {
+	resp, err := g.get("https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(g.Bucket) +
+		"/o?versions=true&fields=items(name,generation,size,updated)&prefix=" + url.QueryEscape(g.Object))
+	if err != nil {
+		return nil, fmt.Errorf("list request failed (%w)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{"list", resp.StatusCode}
+	}
+	list := struct {
+		Items []struct {
+			Name       string    `json:"name"`
+			Generation string    `json:"generation"`
+			Size       int64     `json:"size,string"`
+			Updated    time.Time `json:"updated"`
+		} `json:"items"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid list (%s)", err)
+	}
+	versions := []VersionInfo{}
+	for _, o := range list.Items {
+		if o.Name == g.Object {
+			versions = append(versions, VersionInfo{ID: o.Generation, Size: o.Size, LastModified: o.Updated})
+		}
+	}
+	return versions, nil
+}
+
+// Version returns the object generation of the last fetched binary
+func (g *GCS) Version() string {
+	return g.lastGeneration
+}
@@ -1,13 +1,14 @@
 package fetcher
 
 import (
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,23 +20,57 @@ import (
 type Github struct {
 	//Github username and repository name
 	User, Repo string
+	//Token is an optional personal access token, required
+	//for private repositories and raises the rate limit.
+	Token string
 	//Interval between fetches
 	Interval time.Duration
+	//Jitter randomly offsets each Interval by up to +/- Jitter,
+	//spreading out the polls of a fleet sharing an Interval
+	Jitter time.Duration
+	//DelayFirstFetch waits an Interval before the first check too,
+	//rather than checking as soon as the fetcher starts
+	DelayFirstFetch bool
 	//Asset is used to find matching release asset.
 	//By default a file will match if it contains
 	//both GOOS and GOARCH.
 	Asset func(filename string) bool
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	//OnNewVersion is called when a new version is detected, before it
+	//is downloaded. Returning an error defers the download to a later
+	//poll (e.g. to throttle a fleet-wide rollout).
+	OnNewVersion func(oldVersion, newVersion string) error
+	//AllowedContentTypes optionally restricts the Content-Type of
+	//downloaded binaries (e.g. "application/octet-stream"), so an
+	//error page served with a 200 is never mistaken for a binary
+	AllowedContentTypes []string
+	//DownloadTimeout bounds each request, including reading the
+	//binary, so a stalled download fails and is retried on the
+	//next poll. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//StateFile is an optional path where the version of the last
+	//fetched binary is saved, so restarting the master process
+	//won't re-download an unchanged binary
+	StateFile string
 	//internal state
 	releaseURL    string
 	delay         bool
 	lastETag      string
+	lastTag       string
+	releaseETag   string
+	rateLimitedTo time.Time
 	latestRelease struct {
 		TagName string `json:"tag_name"`
 		Assets  []struct {
-			Name string `json:"name"`
-			URL  string `json:"browser_download_url"`
+			Name   string `json:"name"`
+			URL    string `json:"browser_download_url"`
+			APIURL string `json:"url"`
 		} `json:"assets"`
 	}
+	intervalPoller
+	pinner
 }
 
 func (h *Github) defaultAsset(filename string) bool {
@@ -48,6 +83,7 @@ func (h *Github) Init() error {
 	if h.User == "" {
 		return fmt.Errorf("User required")
 	}
+	h.delay = h.DelayFirstFetch
 	if h.Repo == "" {
 		return fmt.Errorf("Repo required")
 	}
@@ -57,88 +93,245 @@ func (h *Github) Init() error {
 	h.releaseURL = "https://api.github.com/repos/" + h.User + "/" + h.Repo + "/releases/latest"
 	if h.Interval == 0 {
 		h.Interval = 5 * time.Minute
-	} else if h.Interval < 1*time.Minute {
+	} else if h.Interval > 0 && h.Interval < 1*time.Minute && h.Token == "" {
 		log.Printf("[overseer.github] warning: intervals less than 1 minute will surpass the public rate limit")
 	}
+	if h.StateFile != "" {
+		s := githubState{}
+		if loadState(h.StateFile, &s) {
+			h.lastTag, h.lastETag, h.releaseETag = s.Tag, s.ETag, s.ReleaseETag
+		}
+	}
 	return nil
 }
 
+//githubState is persisted to the StateFile
+type githubState struct {
+	Tag         string `json:"tag"`
+	ETag        string `json:"etag"`
+	ReleaseETag string `json:"release_etag"`
+}
+
 // Fetch the binary from the provided Repository
 func (h *Github) Fetch() (io.Reader, error) {
 	//delay fetches after first
 	if h.delay {
-		time.Sleep(h.Interval)
+		if err := h.waitInterval(h.Interval, h.Jitter); err != nil {
+			return nil, err
+		}
 	}
 	h.delay = true
-	//check release status
-	resp, err := http.Get(h.releaseURL)
+	//wait out the rate limit
+	if d := time.Until(h.rateLimitedTo); d > 0 {
+		h.setNextPoll(h.rateLimitedTo)
+		if err := h.wait(d); err != nil {
+			return nil, err
+		}
+		h.setNextPoll(clk.Now())
+	}
+	releaseURL := h.releaseURL
+	if tag := h.pinned(); tag != "" {
+		releaseURL = "https://api.github.com/repos/" + h.User + "/" + h.Repo + "/releases/tags/" + url.PathEscape(tag)
+	}
+	h.logf("checking %s", releaseURL)
+	//check release status, unchanged releases
+	//return 304 and do not count towards the rate limit
+	req, err := h.newAPIRequest("GET", releaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("release info request failed (%w)", err)
+	}
+	if h.releaseETag != "" {
+		req.Header.Set("If-None-Match", h.releaseETag)
+	}
+	resp, err := do(http.DefaultClient, req, h.DownloadTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("release info request failed (%s)", err)
+		return nil, fmt.Errorf("release info request failed (%w)", err)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		h.logf("release not modified, skipping")
+		return nil, nil //skip, release match
 	}
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, fmt.Errorf("release info request failed (status code %d)", resp.StatusCode)
+		return nil, h.apiError("release info", resp)
 	}
+	releaseETag := resp.Header.Get("ETag")
 	//clear assets
 	h.latestRelease.Assets = nil
 	if err := json.NewDecoder(resp.Body).Decode(&h.latestRelease); err != nil {
 		return nil, fmt.Errorf("invalid request info (%s)", err)
 	}
 	resp.Body.Close()
+	if h.latestRelease.TagName != "" && h.lastTag == h.latestRelease.TagName {
+		h.releaseETag = releaseETag
+		h.logf("release %s unchanged, skipping", h.lastTag)
+		return nil, nil //skip, tag match
+	}
 	//find appropriate asset
-	assetURL := ""
+	assetURL, assetAPIURL := "", ""
 	for _, a := range h.latestRelease.Assets {
 		if h.Asset(a.Name) {
 			assetURL = a.URL
+			assetAPIURL = a.APIURL
 			break
 		}
 	}
 	if assetURL == "" {
 		return nil, fmt.Errorf("no matching assets in this release (%s)", h.latestRelease.TagName)
 	}
-	//fetch location
-	req, _ := http.NewRequest("HEAD", assetURL, nil)
+	if h.OnNewVersion != nil {
+		if err := h.OnNewVersion(h.lastTag, h.latestRelease.TagName); err != nil {
+			return nil, fmt.Errorf("download deferred (%s)", err)
+		}
+	}
+	//fetch location, private assets must be
+	//requested via the API with a token
+	if h.Token != "" {
+		req, _ = h.newAPIRequest("GET", assetAPIURL)
+		req.Header.Set("Accept", "application/octet-stream")
+	} else {
+		req, _ = http.NewRequestWithContext(h.context(), "HEAD", assetURL, nil)
+	}
 	resp, err = http.DefaultTransport.RoundTrip(req)
 	if err != nil {
-		return nil, fmt.Errorf("release location request failed (%s)", err)
+		return nil, fmt.Errorf("release location request failed (%w)", transient(err))
 	}
 	resp.Body.Close()
 	if resp.StatusCode != http.StatusFound {
-		return nil, fmt.Errorf("release location request failed (status code %d)", resp.StatusCode)
+		return nil, h.apiError("release location", resp)
 	}
 	s3URL := resp.Header.Get("Location")
 	//pseudo-HEAD request
-	req, err = http.NewRequest("GET", s3URL, nil)
+	req, err = http.NewRequestWithContext(h.context(), "GET", s3URL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("release location url error (%s)", err)
 	}
 	req.Header.Set("Range", "bytes=0-0") // HEAD not allowed so we request for 1 byte
 	resp, err = http.DefaultTransport.RoundTrip(req)
 	if err != nil {
-		return nil, fmt.Errorf("release location request failed (%s)", err)
+		return nil, fmt.Errorf("release location request failed (%w)", transient(err))
 	}
 	resp.Body.Close()
 	if resp.StatusCode != http.StatusPartialContent {
-		return nil, fmt.Errorf("release location request failed (status code %d)", resp.StatusCode)
+		return nil, &statusError{"release location", resp.StatusCode}
 	}
 	etag := resp.Header.Get("ETag")
 	if etag != "" && h.lastETag == etag {
+		h.lastTag = h.latestRelease.TagName
+		h.releaseETag = releaseETag
+		h.logf("release %s asset unchanged, skipping", h.lastTag)
 		return nil, nil //skip, hash match
 	}
 	//get binary request
-	resp, err = http.Get(s3URL)
+	req, _ = http.NewRequestWithContext(h.context(), "GET", s3URL, nil)
+	resp, err = do(http.DefaultClient, req, h.DownloadTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("release binary request failed (%s)", err)
+		return nil, fmt.Errorf("release binary request failed (%w)", err)
 	}
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, fmt.Errorf("release binary request failed (status code %d)", resp.StatusCode)
+		return nil, &statusError{"release binary", resp.StatusCode}
 	}
+	if err := checkContentType(h.AllowedContentTypes, resp.Header); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	prev := githubState{h.lastTag, h.lastETag, h.releaseETag}
 	h.lastETag = etag
-	//success!
-	//extract gz files
-	if strings.HasSuffix(assetURL, ".gz") && resp.Header.Get("Content-Encoding") != "gzip" {
-		return gzip.NewReader(resp.Body)
+	h.lastTag = h.latestRelease.TagName
+	h.releaseETag = releaseETag
+	h.logf("downloading release %s asset %s (%d bytes)", h.lastTag, assetURL, resp.ContentLength)
+	//a failed download is retried on the next poll
+	restore := func() {
+		h.lastTag, h.lastETag, h.releaseETag = prev.Tag, prev.ETag, prev.ReleaseETag
 	}
-	return resp.Body, nil
+	//extract compressed files
+	r, err := decompress(sizedBody(resp), assetURL, h.AutoDecompress || encoded(resp))
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	//saved once downloaded, so an interrupted
+	//download is retried after a restart too
+	return onComplete(r, h.persistState, restore), nil
+}
+
+//persistState saves the last release to the StateFile
+func (h *Github) persistState() {
+	if h.StateFile == "" {
+		return
+	}
+	if err := saveState(h.StateFile, githubState{h.lastTag, h.lastETag, h.releaseETag}); err != nil {
+		h.logf("failed to save state (%s)", err)
+	}
+}
+
+func (h *Github) newAPIRequest(method, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(h.context(), method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.Token != "" {
+		req.Header.Set("Authorization", "token "+h.Token)
+	}
+	return req, nil
+}
+
+//apiError describes a failed API response, recording
+//when the rate limit will reset if it has been exceeded
+func (h *Github) apiError(request string, resp *http.Response) error {
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			h.rateLimitedTo = time.Unix(reset, 0)
+			return errorf(ErrTransient, "%s request rate limited until %s", request, h.rateLimitedTo.Format(time.RFC3339))
+		}
+		return errorf(ErrTransient, "%s request rate limited", request)
+	}
+	if resp.StatusCode == http.StatusNotFound && h.Token == "" {
+		return errorf(ErrNotFound, "%s request failed (status code 404), private repositories require a Token", request)
+	}
+	return &statusError{request, resp.StatusCode}
+}
+
+// List the releases of the repository containing a matching asset
+func (h *Github) List() ([]VersionInfo, error) {
+	req, err := h.newAPIRequest("GET", "https://api.github.com/repos/"+h.User+"/"+h.Repo+"/releases?per_page=100")
+	if err != nil {
+		return nil, fmt.Errorf("releases request failed (%w)", err)
+	}
+	resp, err := do(http.DefaultClient, req, h.DownloadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("releases request failed (%w)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, h.apiError("releases", resp)
+	}
+	releases := []struct {
+		TagName string `json:"tag_name"`
+		Assets  []struct {
+			Name      string    `json:"name"`
+			Size      int64     `json:"size"`
+			UpdatedAt time.Time `json:"updated_at"`
+		} `json:"assets"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return nil, fmt.Errorf("invalid releases (%s)", err)
+	}
+	versions := []VersionInfo{}
+	for _, r := range releases {
+		for _, a := range r.Assets {
+			if h.Asset(a.Name) {
+				versions = append(versions, VersionInfo{ID: r.TagName, Size: a.Size, LastModified: a.UpdatedAt})
+				break
+			}
+		}
+	}
+	return versions, nil
+}
+
+// Version returns the release tag of the last fetched binary
+func (h *Github) Version() string {
+	return h.latestRelease.TagName
 }
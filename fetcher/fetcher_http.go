@@ -1,25 +1,133 @@
 package fetcher
 
 import (
-	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 //HTTP fetcher uses HEAD requests to poll the status of a given
 //file. If it detects this file has been updated, it will fetch
-//and return its io.Reader stream.
+//and return its io.Reader stream. Alternatively, it can poll
+//with conditional GET requests.
 type HTTP struct {
 	//URL to poll for new binaries
-	URL          string
-	Interval     time.Duration
+	URL      string
+	Interval time.Duration
+	//CheckHeaders identify the binary, when any of them differs from
+	//the previous response, the binary has been updated. Timestamps
+	//(e.g. Last-Modified) are only compared with those of the server,
+	//never the local clock, so clock skew can't hide or repeat an
+	//update. Defaults to ETag, Last-Modified and Content-Length.
 	CheckHeaders []string
+	//Jitter randomly offsets each Interval by up to +/- Jitter,
+	//spreading out the polls of a fleet sharing an Interval
+	Jitter time.Duration
+	//DelayFirstFetch waits an Interval before the first check too,
+	//rather than checking as soon as the fetcher starts
+	DelayFirstFetch bool
+	//RequestJitter randomly delays each poll (including the first and
+	//triggered polls) by up to RequestJitter, immediately before its
+	//request, so a fleet polling in step (e.g. started by one deploy,
+	//or triggered together) doesn't hit the origin all at once when
+	//a CDN cache expires. Especially useful with Conditional.
+	RequestJitter time.Duration
+	//Conditional replaces HEAD polling with conditional GET
+	//requests (using If-None-Match and If-Modified-Since),
+	//unchanged binaries are then skipped with a 304. Servers
+	//which don't honor conditional GETs fall back to HEAD polling.
+	Conditional bool
+	//Headers are added to every request (e.g. Authorization)
+	Headers http.Header
+	//Concurrency optionally downloads binaries with this many parallel
+	//ranged GET requests of PartSize bytes (defaults to 8MB), when the
+	//server accepts ranges. It requires HEAD polling (not Conditional).
+	Concurrency int
+	PartSize    int64
+	//DownloadTimeout bounds each request, including reading the
+	//binary, so a stalled download fails and is retried on the
+	//next poll. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//Proxy is an optional proxy URL (e.g. http://proxy:3128), by
+	//default the HTTP_PROXY and HTTPS_PROXY environment is used
+	Proxy string
+	//ClientCertFile and ClientKeyFile are optional paths to a PEM
+	//encoded certificate and key, presented to servers requiring
+	//mutual TLS. Alternatively, provide the PEM bytes themselves
+	//with ClientCert and ClientKey.
+	ClientCertFile, ClientKeyFile string
+	ClientCert, ClientKey         []byte
+	//RootCAs is an optional bundle of PEM encoded root certificates
+	//trusted instead of the system roots, for devices whose trust
+	//store is stale. Include every root the server may rotate to.
+	RootCAs []byte
+	//Transport optionally tunes the connection timeouts and
+	//keepalives, e.g. for flaky mobile or edge links
+	Transport TransportOptions
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	//OnNewVersion is called when a new version is detected, before it
+	//is downloaded. Returning an error defers the download to a later
+	//poll (e.g. to throttle a fleet-wide rollout).
+	OnNewVersion func(oldVersion, newVersion string) error
+	//AllowedContentTypes optionally restricts the Content-Type of
+	//downloaded binaries (e.g. "application/octet-stream"), so an
+	//error page served with a 200 is never mistaken for a binary
+	AllowedContentTypes []string
+	//SkipNotFound treats a missing binary (404) as no update, rather
+	//than an error, for sources where it is temporarily removed
+	SkipNotFound bool
+	//RequiredHeaders gate upgrades on the metadata of the binary, its
+	//response headers must have these values, otherwise it is skipped
+	//as if unchanged. For example, with S3 object metadata, a node may
+	//only adopt binaries with {"X-Amz-Meta-Stage": "canary"}.
+	RequiredHeaders map[string]string
+	//BuildHeader optionally names a response header holding a monotonic
+	//build number (e.g. the S3 object metadata "X-Amz-Meta-Build"). A
+	//binary with a lower build than the last fetched binary, or with no
+	//build, is skipped as a downgrade. The last build is kept in the
+	//StateFile, so a republished stale binary is refused even after
+	//the master process restarts.
+	BuildHeader string
+	//StateFile is an optional path where the version of the last
+	//fetched binary is saved, so restarting the master process
+	//won't re-download an unchanged binary
+	StateFile string
+	//VerifyMD5 checks each downloaded binary against the MD5 declared
+	//by its Content-MD5 header or, as with S3 compatible storage, its
+	//ETag (skipped for multipart ETags with a "-" suffix). A mismatch
+	//fails the download, which is then retried on the next poll.
+	VerifyMD5 bool
+	//ResumeFile is an optional path where binaries are downloaded, so
+	//a download interrupted by a failed request, or even a reboot, is
+	//resumed from its last byte by the next fetch (with a ranged GET
+	//request), rather than restarted. It requires servers accepting
+	//ranges, with an ETag or Last-Modified to identify the binary. The
+	//assembled binary is verified against its Content-MD5 or ETag (see
+	//VerifyMD5) when declared. It takes precedence over Concurrency.
+	ResumeFile string
+	//ConfigURL optionally locates a companion config file of the binary
+	//(e.g. its URL with a ".yaml" suffix), requested on each poll and
+	//returned with the binary in its Metadata.Config. Versions then
+	//identify both, so when only the config changed, the binary is
+	//fetched again with it, and overseer restarts (or reloads) the
+	//program with the current binary and the changed config.
+	ConfigURL string
 	//internal state
-	delay bool
-	lasts map[string]string
+	client      *http.Client
+	socket      string //dialed instead of the URL's host (see Unix)
+	delay       bool
+	lasts       map[string]string
+	contentType string
+	config      []byte
+	intervalPoller
 }
 
 //if any of these change, the binary has been updated
@@ -31,6 +139,7 @@ func (h *HTTP) Init() error {
 	if h.URL == "" {
 		return fmt.Errorf("URL required")
 	}
+	h.delay = h.DelayFirstFetch
 	h.lasts = map[string]string{}
 	if h.Interval == 0 {
 		h.Interval = 5 * time.Minute
@@ -38,6 +147,36 @@ func (h *HTTP) Init() error {
 	if h.CheckHeaders == nil {
 		h.CheckHeaders = defaultHTTPCheckHeaders
 	}
+	if h.PartSize <= 0 {
+		h.PartSize = 8 * 1024 * 1024
+	}
+	cert, err := clientCertificate(h.ClientCertFile, h.ClientKeyFile, h.ClientCert, h.ClientKey)
+	if err != nil {
+		return err
+	}
+	roots, err := rootPool(h.RootCAs)
+	if err != nil {
+		return err
+	}
+	client, err := newClient(h.Proxy, cert, roots, h.Transport)
+	if err != nil {
+		return err
+	}
+	if h.socket != "" {
+		t := client.Transport.(*http.Transport)
+		t.Proxy = nil
+		dial := t.DialContext
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx, "unix", h.socket)
+		}
+	}
+	h.client = client
+	if h.StateFile != "" {
+		lasts := map[string]string{}
+		if loadState(h.StateFile, &lasts) && lasts != nil {
+			h.lasts = lasts
+		}
+	}
 	return nil
 }
 
@@ -45,44 +184,319 @@ func (h *HTTP) Init() error {
 func (h *HTTP) Fetch() (io.Reader, error) {
 	//delay fetches after first
 	if h.delay {
-		time.Sleep(h.Interval)
+		if err := h.waitInterval(h.Interval, h.Jitter); err != nil {
+			return nil, err
+		}
 	}
 	h.delay = true
-	//status check using HEAD
-	resp, err := http.Head(h.URL)
+	if err := h.waitRequest(h.RequestJitter); err != nil {
+		return nil, err
+	}
+	h.logf("checking %s", h.URL)
+	prev := map[string]string{}
+	for k, v := range h.lasts {
+		prev[k] = v
+	}
+	config := h.config
+	configChanged := false
+	if h.ConfigURL != "" {
+		changed, err := h.fetchConfig()
+		if err != nil {
+			return nil, err
+		}
+		configChanged = changed
+	}
+	r, err := h.fetch(prev, configChanged)
+	if r == nil && configChanged {
+		h.restoreConfig(prev, config)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("HEAD request failed (%s)", err)
+		//the check headers are of a binary which wasn't
+		//downloaded, it's retried on the next poll
+		h.mismatch(prev)()
+	}
+	if r == nil || err != nil {
+		return r, err
+	}
+	//saved once downloaded, so an interrupted
+	//download is retried after a restart too
+	return onComplete(r, h.persistState, func() {
+		h.config = config
+		h.mismatch(prev)()
+	}), nil
+}
+
+//fetch the binary if it changed since prev, or if its config changed
+func (h *HTTP) fetch(prev map[string]string, configChanged bool) (io.Reader, error) {
+	if !h.Conditional {
+		//status check using HEAD
+		req, err := h.newRequest("HEAD")
+		if err != nil {
+			return nil, fmt.Errorf("HEAD request failed (%w)", err)
+		}
+		resp, err := do(h.client, req, h.DownloadTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("HEAD request failed (%w)", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && h.SkipNotFound {
+			h.logf("%s not found, skipping", h.URL)
+			return nil, nil //skip, file missing
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, &statusError{"HEAD", resp.StatusCode}
+		}
+		if name := mismatchedHeader(h.RequiredHeaders, resp.Header); name != "" {
+			h.logf("%s has %s %q, skipping", h.URL, name, resp.Header.Get(name))
+			return nil, nil //skip, not for this node
+		}
+		//if all headers match, skip update
+		if h.checkHeaders(resp.Header) && !configChanged {
+			h.logf("%s unchanged, skipping", h.URL)
+			return nil, nil //skip, file match
+		}
+		if h.downgrade(resp.Header, prev) {
+			return nil, nil //skip, older build
+		}
+		if err := h.newVersion(prev); err != nil {
+			return nil, err
+		}
+		//resumable binary fetch using a ranged GET
+		if h.ResumeFile != "" && resumable(resp.Header, resp.ContentLength) != "" {
+			if err := checkContentType(h.AllowedContentTypes, resp.Header); err != nil {
+				return nil, err
+			}
+			h.logf("downloading %s (%d bytes, resumable)", h.URL, resp.ContentLength)
+			f, err := h.resume(resp.Header, resp.ContentLength, nil, prev)
+			if err != nil {
+				return nil, err
+			}
+			h.contentType = resp.Header.Get("Content-Type")
+			return decompress(f, req.URL.Path, h.AutoDecompress || encoded(resp))
+		}
+		//parallel binary fetch using ranged GETs
+		if h.Concurrency > 1 && resp.Header.Get("Accept-Ranges") == "bytes" && resp.ContentLength > h.PartSize {
+			if err := checkContentType(h.AllowedContentTypes, resp.Header); err != nil {
+				return nil, err
+			}
+			h.logf("downloading %s (%d bytes, %d ranges at a time)", h.URL, resp.ContentLength, h.Concurrency)
+			tmp, err := h.downloadRanges(resp.ContentLength, resp.Header.Get("ETag"))
+			if err != nil {
+				return nil, err
+			}
+			h.contentType = resp.Header.Get("Content-Type")
+			if h.VerifyMD5 {
+				tmp = verifyMD5(tmp, resp.Header, h.mismatch(prev))
+			}
+			return decompress(tmp, req.URL.Path, h.AutoDecompress || encoded(resp))
+		}
+	}
+	//binary fetch using GET
+	req, err := h.newRequest("GET")
+	if err != nil {
+		return nil, fmt.Errorf("GET request failed (%w)", err)
+	}
+	if h.Conditional && !configChanged {
+		if etag := h.lasts["ETag"]; etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if modified := h.lasts["Last-Modified"]; modified != "" {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	resp, err := do(h.client, req, h.DownloadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("GET request failed (%w)", err)
+	}
+	if h.Conditional && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		h.logf("%s not modified, skipping", h.URL)
+		return nil, nil //skip, file match
+	}
+	if resp.StatusCode == http.StatusNotFound && h.SkipNotFound {
+		resp.Body.Close()
+		h.logf("%s not found, skipping", h.URL)
+		return nil, nil //skip, file missing
 	}
-	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HEAD request failed (status code %d)", resp.StatusCode)
+		resp.Body.Close()
+		return nil, &statusError{"GET", resp.StatusCode}
+	}
+	if err := checkContentType(h.AllowedContentTypes, resp.Header); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if name := mismatchedHeader(h.RequiredHeaders, resp.Header); name != "" {
+		resp.Body.Close()
+		h.logf("%s has %s %q, skipping", h.URL, name, resp.Header.Get(name))
+		return nil, nil //skip, not for this node
 	}
-	//if all headers match, skip update
+	if h.Conditional && h.checkHeaders(resp.Header) && len(h.lasts) > 0 && !configChanged {
+		//unchanged, yet the server ignored the
+		//conditional headers, fall back to HEAD polling
+		resp.Body.Close()
+		h.Conditional = false
+		h.logf("%s ignored conditional GET, falling back to HEAD requests", h.URL)
+		return nil, nil //skip, file match
+	}
+	if h.Conditional && h.downgrade(resp.Header, prev) {
+		resp.Body.Close()
+		return nil, nil //skip, older build
+	}
+	if h.Conditional {
+		if err := h.newVersion(prev); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	if h.ResumeFile != "" && !resp.Uncompressed && resumable(resp.Header, resp.ContentLength) != "" {
+		h.logf("downloading %s (%d bytes, resumable)", h.URL, resp.ContentLength)
+		f, err := h.resume(resp.Header, resp.ContentLength, resp.Body, prev)
+		if err != nil {
+			return nil, err
+		}
+		h.contentType = resp.Header.Get("Content-Type")
+		return decompress(f, req.URL.Path, h.AutoDecompress || encoded(resp))
+	}
+	h.logf("downloading %s (%d bytes)", h.URL, resp.ContentLength)
+	h.contentType = resp.Header.Get("Content-Type")
+	body := sizedBody(resp)
+	if h.VerifyMD5 && !resp.Uncompressed {
+		body = verifyMD5(body, resp.Header, h.mismatch(prev))
+	}
+	//extract compressed files
+	return decompress(body, req.URL.Path, h.AutoDecompress || encoded(resp))
+}
+
+// FetchMetadata fetches the binary along with its Version,
+// Content-Length, Content-Type and config (see ConfigURL)
+func (h *HTTP) FetchMetadata() (io.Reader, Metadata, error) {
+	r, err := h.Fetch()
+	if r == nil || err != nil {
+		return r, Metadata{Size: -1, Rollout: -1}, err
+	}
+	return r, Metadata{Version: h.Version(), Size: sizeOf(r), ContentType: h.contentType, Config: h.config, Rollout: -1}, nil
+}
+
+//persistState saves the check headers to the StateFile
+func (h *HTTP) persistState() {
+	if h.StateFile == "" {
+		return
+	}
+	if err := saveState(h.StateFile, h.lasts); err != nil {
+		h.logf("failed to save state (%s)", err)
+	}
+}
+
+func (h *HTTP) newRequest(method string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(h.context(), method, h.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h.Headers {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+//checkHeaders records the latest check headers
+//and returns whether they all match the previous
+func (h *HTTP) checkHeaders(header http.Header) bool {
 	matches, total := 0, 0
-	for _, header := range h.CheckHeaders {
-		if curr := resp.Header.Get(header); curr != "" {
-			if last, ok := h.lasts[header]; ok && last == curr {
+	for _, name := range h.CheckHeaders {
+		if curr := header.Get(name); curr != "" {
+			if last, ok := h.lasts[name]; ok && last == curr {
 				matches++
 			}
-			h.lasts[header] = curr
+			h.lasts[name] = curr
 			total++
 		}
 	}
-	if matches == total {
-		return nil, nil //skip, file match
+	return matches == total
+}
+
+//downgrade returns whether the changed binary described by header is
+//an older build (see BuildHeader) than the last, which is then skipped.
+//The check headers record the skipped binary, so it isn't reconsidered
+//until it changes, while the build remains that of the last binary.
+func (h *HTTP) downgrade(header http.Header, prev map[string]string) bool {
+	if h.BuildHeader == "" {
+		return false
 	}
-	//binary fetch using GET
-	resp, err = http.Get(h.URL)
+	value := strings.TrimSpace(header.Get(h.BuildHeader))
+	build, err := strconv.ParseUint(value, 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("GET request failed (%s)", err)
+		h.logf("%s has no valid %s (%q), skipping", h.URL, h.BuildHeader, value)
+	} else if last, lerr := strconv.ParseUint(prev[h.BuildHeader], 10, 64); lerr == nil && build < last {
+		h.logf("%s is a downgrade from build %d to %d, skipping", h.URL, last, build)
+	} else {
+		h.lasts[h.BuildHeader] = value
+		return false
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GET request failed (status code %d)", resp.StatusCode)
+	if last, ok := prev[h.BuildHeader]; ok {
+		h.lasts[h.BuildHeader] = last
+	} else {
+		delete(h.lasts, h.BuildHeader)
+	}
+	h.persistState()
+	return true
+}
+
+//newVersion calls OnNewVersion, restoring the check
+//headers of the previous version if it defers the download
+func (h *HTTP) newVersion(prev map[string]string) error {
+	if h.OnNewVersion == nil {
+		return nil
+	}
+	if err := h.OnNewVersion(h.version(prev), h.Version()); err != nil {
+		h.lasts = prev
+		return fmt.Errorf("download deferred (%s)", err)
+	}
+	return nil
+}
+
+//mismatchedHeader returns the first of the required
+//headers which header doesn't match, or "" if all match
+func mismatchedHeader(required map[string]string, header http.Header) string {
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.TrimSpace(header.Get(name)) != required[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+//mismatch returns a callback which restores the check headers of
+//the previous version, so a corrupted or failed download is retried
+func (h *HTTP) mismatch(prev map[string]string) func() {
+	return func() {
+		h.lasts = prev
+		h.persistState()
+	}
+}
+
+// Version returns the first check header of the last fetched binary,
+// followed by a "+" and the SHA-256 prefix of its config when ConfigURL
+// is set (e.g. "\"5d8c72a5edda8d6a\"+9f86d081884c7d65")
+func (h *HTTP) Version() string {
+	return h.version(h.lasts)
+}
+
+func (h *HTTP) version(lasts map[string]string) string {
+	version := ""
+	for _, header := range h.CheckHeaders {
+		if v := lasts[header]; v != "" {
+			version = v
+			break
+		}
 	}
-	//extract gz files
-	if strings.HasSuffix(h.URL, ".gz") && resp.Header.Get("Content-Encoding") != "gzip" {
-		return gzip.NewReader(resp.Body)
+	if config := lasts[configVersionKey]; config != "" && h.ConfigURL != "" {
+		version += "+" + config
 	}
-	//success!
-	return resp.Body, nil
+	return version
 }
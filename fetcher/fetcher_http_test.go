@@ -0,0 +1,236 @@
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//stallingServer serves binary with an ETag, the body of the
+//first GET stalls halfway until the client gives up
+func stallingServer(t *testing.T, binary string) (*httptest.Server, *int32) {
+	gets := new(int32)
+	stall := make(chan bool)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "HEAD" {
+			return
+		}
+		if atomic.AddInt32(gets, 1) == 1 {
+			w.Write([]byte(binary[:len(binary)/2]))
+			w.(http.Flusher).Flush()
+			select {
+			case <-stall:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		io.WriteString(w, binary)
+	}))
+	t.Cleanup(func() {
+		close(stall)
+		s.Close()
+	})
+	return s, gets
+}
+
+func TestHTTPRetriesStalledDownloads(t *testing.T) {
+	const binary = "0123456789abcdef"
+	for _, conditional := range []bool{false, true} {
+		s, gets := stallingServer(t, binary)
+		h := &HTTP{
+			URL:             s.URL,
+			Interval:        time.Millisecond,
+			Conditional:     conditional,
+			DownloadTimeout: 200 * time.Millisecond,
+		}
+		if err := h.Init(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := h.Fetch()
+		if err != nil || r == nil {
+			t.Fatalf("conditional %v: first fetch returned %v, %v", conditional, r, err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Fatalf("conditional %v: expected the stalled download to fail", conditional)
+		}
+		r.(io.Closer).Close()
+		r, err = h.Fetch()
+		if err != nil || r == nil {
+			t.Fatalf("conditional %v: retry returned %v, %v", conditional, r, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.(io.Closer).Close()
+		if err != nil || string(b) != binary {
+			t.Fatalf("conditional %v: retry read %q, %v", conditional, b, err)
+		}
+		if h.Version() != `"v1"` {
+			t.Fatalf("conditional %v: version %q", conditional, h.Version())
+		}
+		//now unchanged
+		if r, err := h.Fetch(); r != nil || err != nil {
+			t.Fatalf("conditional %v: expected no update, got %v, %v", conditional, r, err)
+		}
+		if n := atomic.LoadInt32(gets); n != 2 {
+			t.Fatalf("conditional %v: %d GETs of the binary, expected 2", conditional, n)
+		}
+	}
+}
+
+func TestHTTPSavesStateOnceDownloaded(t *testing.T) {
+	const binary = "0123456789abcdef"
+	s, _ := stallingServer(t, binary)
+	state := t.TempDir() + "/state"
+	newHTTP := func() *HTTP {
+		h := &HTTP{
+			URL:             s.URL,
+			Interval:        time.Millisecond,
+			DownloadTimeout: 200 * time.Millisecond,
+			StateFile:       state,
+		}
+		if err := h.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	r, err := newHTTP().Fetch()
+	if err != nil || r == nil {
+		t.Fatalf("first fetch returned %v, %v", r, err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("expected the stalled download to fail")
+	}
+	r.(io.Closer).Close()
+	//as if the master process restarted
+	h := newHTTP()
+	r, err = h.Fetch()
+	if err != nil || r == nil {
+		t.Fatalf("fetch after restart returned %v, %v", r, err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil || string(b) != binary {
+		t.Fatalf("fetch after restart read %q, %v", b, err)
+	}
+	if r, err := newHTTP().Fetch(); r != nil || err != nil {
+		t.Fatalf("expected the saved state to skip the binary, got %v, %v", r, err)
+	}
+}
+
+func TestHTTPDecompressesOnce(t *testing.T) {
+	const binary = "0123456789abcdef"
+	gz := &bytes.Buffer{}
+	w := gzip.NewWriter(gz)
+	io.WriteString(w, binary)
+	w.Close()
+	for _, tc := range []struct {
+		name    string
+		path    string
+		encoded bool
+	}{
+		{"plain", "/app", false},
+		{"gz suffix", "/app.gz", false},
+		{"gzip encoding", "/app", true},
+		//stored as app.gz with a Content-Encoding of gzip (e.g. on S3)
+		{"gz suffix and gzip encoding", "/app.gz", true},
+	} {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.encoded {
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+			if tc.encoded || strings.HasSuffix(r.URL.Path, ".gz") {
+				w.Write(gz.Bytes())
+			} else {
+				io.WriteString(w, binary)
+			}
+		}))
+		//the transport decompresses when it asked for gzip,
+		//not when Accept-Encoding is among the Headers
+		for _, headers := range []http.Header{nil, {"Accept-Encoding": {"gzip"}}} {
+			h := &HTTP{URL: s.URL + tc.path, Headers: headers}
+			if err := h.Init(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := h.Fetch()
+			if err != nil || r == nil {
+				t.Fatalf("%s (headers %v): fetch returned %v, %v", tc.name, headers, r, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			r.(io.Closer).Close()
+			if err != nil || string(b) != binary {
+				t.Fatalf("%s (headers %v): read %q, %v", tc.name, headers, b, err)
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestHTTPIgnoresClockSkew(t *testing.T) {
+	const binary = "0123456789abcdef"
+	//servers whose clocks are far behind or ahead of ours
+	for _, skew := range []time.Duration{-10 * 365 * 24 * time.Hour, 10 * 365 * 24 * time.Hour} {
+		for _, conditional := range []bool{false, true} {
+			var mut sync.Mutex
+			modified := time.Now().Add(skew)
+			gets := 0
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mut.Lock()
+				defer mut.Unlock()
+				lm := modified.UTC().Format(http.TimeFormat)
+				w.Header().Set("Last-Modified", lm)
+				if r.Header.Get("If-Modified-Since") == lm {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				if r.Method == "GET" {
+					gets++
+				}
+				io.WriteString(w, binary)
+			}))
+			h := &HTTP{URL: s.URL, Interval: time.Millisecond, Conditional: conditional}
+			if err := h.Init(); err != nil {
+				t.Fatal(err)
+			}
+			expect := func(update bool) {
+				t.Helper()
+				r, err := h.Fetch()
+				if err != nil {
+					t.Fatalf("skew %s, conditional %v: %s", skew, conditional, err)
+				}
+				if r != nil {
+					ioutil.ReadAll(r)
+					r.(io.Closer).Close()
+				}
+				if update != (r != nil) {
+					t.Fatalf("skew %s, conditional %v: update %v, expected %v", skew, conditional, r != nil, update)
+				}
+			}
+			expect(true)
+			expect(false)
+			//republished with an older, then a newer timestamp
+			for _, move := range []time.Duration{-time.Hour, 2 * time.Hour} {
+				mut.Lock()
+				modified = modified.Add(move)
+				mut.Unlock()
+				expect(true)
+				expect(false)
+			}
+			s.Close()
+			if gets != 3 {
+				t.Fatalf("skew %s, conditional %v: %d GETs of the binary, expected 3", skew, conditional, gets)
+			}
+		}
+	}
+}
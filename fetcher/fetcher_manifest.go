@@ -0,0 +1,389 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/kardianos/osext"
+)
+
+//Manifest uses another fetcher to poll a small JSON manifest
+//which describes the current binary, for example:
+//
+//	{"version": "1.2.0", "url": "https://example.com/app-1.2.0", "size": 1048576, "sha256": "9f86d0..."}
+//
+//When the manifest's version changes, the binary at its URL is
+//downloaded and only returned once its size and SHA-256 checksum
+//match the manifest. The binary is streamed to a temp file while
+//verifying.
+//
+//The manifest may also list bsdiff patches, keyed by the SHA-256
+//of the binary they apply to:
+//
+//	"patches": {"3a7bd3...": {"url": "https://example.com/app-1.1.0-1.2.0.bsdiff"}}
+//
+//When the current binary has a patch, only the patch is downloaded
+//and applied, then the result is verified as above. Binaries with
+//no patch, or whose patch fails, are downloaded in full.
+//
+//A version may be rolled out progressively by declaring the
+//percentage of nodes which should adopt it:
+//
+//	"rollout": 10
+//
+//Each node decides independently with its NodeID (see InRollout),
+//nodes outside the rollout keep their current binary and decide
+//again on each poll, so raising the rollout
+//(e.g. 10, 50, then 100) gradually upgrades the fleet.
+type Manifest struct {
+	//Source fetches the manifest (e.g. an HTTP or GCS fetcher)
+	Source Interface
+	//Headers are added to binary and patch requests (e.g. Authorization)
+	Headers http.Header
+	//BinPath is the current binary which patches are applied to,
+	//defaults to the running executable
+	BinPath string
+	//DownloadTimeout bounds the download of each binary, so a
+	//stalled download fails and is retried with the next manifest
+	//poll. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//NodeID is a stable identifier of this node, used to decide
+	//whether it is within a rollout. Defaults to the hostname.
+	NodeID string
+	//Rollout optionally decides whether this node adopts a binary
+	//now, given its manifest metadata. Defaults to InRollout.
+	Rollout func(meta Metadata, nodeID string) bool
+	//internal state
+	ctx     context.Context
+	logger  Logger
+	version string
+	latest  *manifestFile
+}
+
+//manifestFile is the format of the manifest
+type manifestFile struct {
+	Version string   `json:"version"`
+	URL     string   `json:"url"`
+	Size    int64    `json:"size"`
+	SHA256  string   `json:"sha256"`
+	Rollout *float64 `json:"rollout"`
+	Patches map[string]struct {
+		URL  string `json:"url"`
+		Size int64  `json:"size"`
+	} `json:"patches"`
+}
+
+// Init validates the provided config and initialises the Source
+func (m *Manifest) Init() error {
+	if m.Source == nil {
+		return errors.New("Source required")
+	}
+	if err := m.init(); err != nil {
+		return err
+	}
+	return m.Source.Init()
+}
+
+//init defaults the NodeID and Rollout
+func (m *Manifest) init() error {
+	if m.NodeID == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("NodeID required (%s)", err)
+		}
+		m.NodeID = h
+	}
+	if m.Rollout == nil {
+		m.Rollout = InRollout
+	}
+	return nil
+}
+
+// SetContext sets the context used to cancel fetches
+func (m *Manifest) SetContext(ctx context.Context) {
+	m.ctx = ctx
+	if c, ok := m.Source.(Cancellable); ok {
+		c.SetContext(ctx)
+	}
+}
+
+// SetLogger passes l through to the Source
+func (m *Manifest) SetLogger(l Logger) {
+	m.logger = l
+	if lg, ok := m.Source.(Loggable); ok {
+		lg.SetLogger(l)
+	}
+}
+
+// Trigger passes through to the Source
+func (m *Manifest) Trigger() {
+	if t, ok := m.Source.(Triggerable); ok {
+		t.Trigger()
+	}
+}
+
+// SetInterval passes through to the Source
+func (m *Manifest) SetInterval(d time.Duration) {
+	if a, ok := m.Source.(Adjustable); ok {
+		a.SetInterval(d)
+	}
+}
+
+// NextPoll passes through to the Source
+func (m *Manifest) NextPoll() time.Time {
+	return nextPoll(m.Source)
+}
+
+// Fetch the manifest and then the binary it references
+func (m *Manifest) Fetch() (io.Reader, error) {
+	r, _, err := m.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata fetches the binary along with its manifest version,
+// size and (unless it is decompressed) SHA-256 checksum
+func (m *Manifest) FetchMetadata() (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	r, err := m.Source.Fetch()
+	if r == nil && err == nil && m.latest != nil && m.latest.Version != m.version {
+		//the manifest is unchanged, though its binary
+		//wasn't fetched (e.g. its download failed)
+		return m.fetch(*m.latest)
+	}
+	if r == nil || err != nil {
+		return r, none, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	//manifests are small, cap them at 1MB
+	b, err := ioutil.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return nil, none, fmt.Errorf("failed to read manifest (%s)", err)
+	}
+	mf := manifestFile{}
+	if err := json.Unmarshal(b, &mf); err != nil {
+		return nil, none, fmt.Errorf("invalid manifest (%s)", err)
+	}
+	m.latest = &mf
+	return m.fetch(mf)
+}
+
+//fetch the binary described by mf, unless it is the current version
+func (m *Manifest) fetch(mf manifestFile) (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	if mf.URL == "" || mf.SHA256 == "" {
+		return nil, none, errors.New("invalid manifest (url and sha256 required)")
+	}
+	sum, err := hex.DecodeString(mf.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, none, fmt.Errorf("invalid manifest (bad sha256 %q)", mf.SHA256)
+	}
+	if mf.Version != "" && mf.Version == m.version {
+		return nil, none, nil //skip, version match
+	}
+	meta := Metadata{Version: mf.Version, Size: -1, SHA256: sum, Rollout: -1}
+	if mf.Size > 0 {
+		meta.Size = mf.Size
+	}
+	if mf.Rollout != nil {
+		if r := *mf.Rollout; r < 0 || r > 100 {
+			return nil, none, fmt.Errorf("invalid manifest (rollout %g not within 0 to 100)", r)
+		}
+		meta.Rollout = *mf.Rollout
+	}
+	if !m.Rollout(meta, m.NodeID) {
+		m.logf("version %s is rolled out to %g%% of nodes, not including %s", mf.Version, meta.Rollout, m.NodeID)
+		return nil, none, nil //skip, decide again next fetch
+	}
+	bin, err := m.patch(mf, sum)
+	if bin == nil {
+		if err != nil {
+			m.logf("patch failed, downloading full binary (%s)", err)
+		}
+		bin, err = m.download(mf, sum)
+	}
+	if err != nil {
+		return nil, none, err
+	}
+	//extract compressed files
+	path := mf.URL
+	if u, err := url.Parse(mf.URL); err == nil {
+		path = u.Path
+	}
+	dr, err := decompress(bin, path, false)
+	if err != nil {
+		return nil, none, err
+	}
+	m.version = mf.Version
+	meta.Size = sizeOf(dr)
+	if _, ok := dr.(*bufferedReadCloser); !ok {
+		meta.SHA256 = nil //decompressed
+	}
+	return dr, meta, nil
+}
+
+// InRollout reports whether nodeID is within the Rollout percentage
+// of meta. Each node is given a stable position for each Version,
+// so raising the percentage only adds nodes to the rollout.
+func InRollout(meta Metadata, nodeID string) bool {
+	if meta.Rollout < 0 || meta.Rollout >= 100 {
+		return true
+	}
+	h := sha256.Sum256([]byte(meta.Version + "\x00" + nodeID))
+	pos := float64(binary.BigEndian.Uint64(h[:8])) / (1 << 64) * 100
+	return pos < meta.Rollout
+}
+
+//download the binary to a temp file, verifying its size and checksum
+func (m *Manifest) download(mf manifestFile, sum []byte) (io.ReadCloser, error) {
+	tmp, err := m.get("binary", mf.URL, mf.Size)
+	if err != nil {
+		return nil, err
+	}
+	return m.verify(tmp, mf, sum)
+}
+
+//patch applies the manifest's patch for the current binary, if any,
+//returning a nil binary without a patch
+func (m *Manifest) patch(mf manifestFile, sum []byte) (io.ReadCloser, error) {
+	if len(mf.Patches) == 0 {
+		return nil, nil
+	}
+	binPath := m.BinPath
+	if binPath == "" {
+		p, err := osext.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find binary path (%s)", err)
+		}
+		binPath = p
+	}
+	old, err := os.Open(binPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open current binary (%s)", err)
+	}
+	defer old.Close()
+	hash := sha256.New()
+	oldSize, err := io.Copy(hash, old)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash current binary (%s)", err)
+	}
+	p, ok := mf.Patches[hex.EncodeToString(hash.Sum(nil))]
+	if !ok || p.URL == "" {
+		return nil, nil //no patch for this binary
+	}
+	patch, err := m.get("patch", p.URL, p.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer patch.Close()
+	info, err := patch.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat patch (%s)", err)
+	}
+	f, err := ioutil.TempFile("", "overseer-manifest-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file (%s)", err)
+	}
+	bin := &tempFile{f}
+	if err := bspatch(old, oldSize, patch, info.Size(), f); err != nil {
+		bin.Close()
+		return nil, fmt.Errorf("failed to apply patch (%s)", err)
+	}
+	m.logf("applied %d byte patch to %s", info.Size(), binPath)
+	return m.verify(bin, mf, sum)
+}
+
+//get downloads url to a temp file, limited to size bytes when set
+func (m *Manifest) get(what, u string, size int64) (*tempFile, error) {
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s request failed (%w)", what, err)
+	}
+	for k, v := range m.Headers {
+		req.Header[k] = v
+	}
+	resp, err := do(http.DefaultClient, req, m.DownloadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("%s request failed (%w)", what, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{what, resp.StatusCode}
+	}
+	f, err := ioutil.TempFile("", "overseer-manifest-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file (%s)", err)
+	}
+	tmp := &tempFile{f}
+	var body io.Reader = resp.Body
+	if size > 0 {
+		//read one byte past the size to detect oversized downloads
+		body = io.LimitReader(body, size+1)
+	}
+	n, err := io.Copy(f, body)
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to download %s (%w)", what, err)
+	}
+	if size > 0 && n != size {
+		tmp.Close()
+		return nil, fmt.Errorf("%s size mismatch (expected %d bytes, got %d)", what, size, n)
+	}
+	return tmp, nil
+}
+
+//verify the binary's size and checksum, rewinding it when they match
+func (m *Manifest) verify(tmp *tempFile, mf manifestFile, sum []byte) (io.ReadCloser, error) {
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to rewind temp file (%s)", err)
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, tmp)
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to read binary (%s)", err)
+	}
+	if mf.Size > 0 && n != mf.Size {
+		tmp.Close()
+		return nil, fmt.Errorf("binary size mismatch (expected %d bytes, got %d)", mf.Size, n)
+	}
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		tmp.Close()
+		return nil, fmt.Errorf("binary checksum mismatch (expected %s)", mf.SHA256)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to rewind temp file (%s)", err)
+	}
+	return tmp, nil
+}
+
+//logf reports a fetch event, it is a no-op without a logger
+func (m *Manifest) logf(f string, args ...interface{}) {
+	if m.logger != nil {
+		m.logger.Printf("[overseer fetcher] "+f, args...)
+	}
+}
+
+// Version returns the manifest version of the last fetched binary
+func (m *Manifest) Version() string {
+	return m.version
+}
@@ -0,0 +1,62 @@
+package fetcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManifestRetriesFailedDownloads(t *testing.T) {
+	const binary = "0123456789abcdef"
+	binGets := int32(0)
+	bins := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&binGets, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, binary)
+	}))
+	defer bins.Close()
+	sum := sha256.Sum256([]byte(binary))
+	manifest := fmt.Sprintf(`{"version": "1.0.0", "url": %q, "size": %d, "sha256": %q}`,
+		bins.URL+"/app", len(binary), hex.EncodeToString(sum[:]))
+	manifests := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"m1"`)
+		io.WriteString(w, manifest)
+	}))
+	defer manifests.Close()
+	m := &Manifest{Source: &HTTP{URL: manifests.URL, Interval: time.Millisecond}}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := m.Fetch(); err == nil {
+		t.Fatalf("expected the first download to fail, got %v", r)
+	}
+	r, err := m.Fetch()
+	if err != nil || r == nil {
+		t.Fatalf("retry returned %v, %v", r, err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil || string(b) != binary {
+		t.Fatalf("retry read %q, %v", b, err)
+	}
+	if v := m.Version(); v != "1.0.0" {
+		t.Fatalf("version %q, expected 1.0.0", v)
+	}
+	for i := 0; i < 3; i++ {
+		if r, err := m.Fetch(); r != nil || err != nil {
+			t.Fatalf("expected no update, got %v, %v", r, err)
+		}
+	}
+	if n := atomic.LoadInt32(&binGets); n != 2 {
+		t.Fatalf("%d binary GETs, expected 2", n)
+	}
+}
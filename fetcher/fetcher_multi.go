@@ -0,0 +1,135 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+//Multi wraps an ordered list of fetchers, for example a
+//primary source followed by its mirrors. Each Fetch polls
+//the fetchers in turn (each applying its own Interval) and
+//returns the first binary found.
+type Multi struct {
+	Fetchers []Interface
+	//internal state
+	active []Interface
+	last   Interface
+}
+
+// Init initialises all fetchers, failing only if every fetcher fails
+func (m *Multi) Init() error {
+	if len(m.Fetchers) == 0 {
+		return errors.New("Fetchers required")
+	}
+	m.active = nil
+	errs := []string{}
+	for i, f := range m.Fetchers {
+		if err := f.Init(); err != nil {
+			errs = append(errs, fmt.Sprintf("#%d: %s", i+1, err))
+			continue
+		}
+		m.active = append(m.active, f)
+	}
+	if len(m.active) == 0 {
+		return fmt.Errorf("all fetchers failed to init (%s)", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// SetContext passes ctx through to each fetcher
+func (m *Multi) SetContext(ctx context.Context) {
+	for _, f := range m.Fetchers {
+		if c, ok := f.(Cancellable); ok {
+			c.SetContext(ctx)
+		}
+	}
+}
+
+// SetLogger passes l through to each fetcher
+func (m *Multi) SetLogger(l Logger) {
+	for _, f := range m.Fetchers {
+		if lg, ok := f.(Loggable); ok {
+			lg.SetLogger(l)
+		}
+	}
+}
+
+// Pin passes through to each fetcher
+func (m *Multi) Pin(version string) {
+	for _, f := range m.Fetchers {
+		if p, ok := f.(Pinnable); ok {
+			p.Pin(version)
+		}
+	}
+}
+
+// Trigger passes through to each fetcher
+func (m *Multi) Trigger() {
+	for _, f := range m.Fetchers {
+		if t, ok := f.(Triggerable); ok {
+			t.Trigger()
+		}
+	}
+}
+
+// Accepted passes through to the fetcher
+// which returned the last binary
+func (m *Multi) Accepted() {
+	if a, ok := m.last.(Acceptable); ok {
+		a.Accepted()
+	}
+}
+
+// SetInterval passes through to each fetcher
+func (m *Multi) SetInterval(d time.Duration) {
+	for _, f := range m.Fetchers {
+		if a, ok := f.(Adjustable); ok {
+			a.SetInterval(d)
+		}
+	}
+}
+
+// NextPoll returns the earliest NextPoll of the fetchers
+func (m *Multi) NextPoll() time.Time {
+	return nextPoll(m.Fetchers...)
+}
+
+// Fetch returns the first binary found, failing only if every fetcher fails
+func (m *Multi) Fetch() (io.Reader, error) {
+	r, _, err := m.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata returns the first binary found along with its
+// Metadata, failing only if every fetcher fails
+func (m *Multi) FetchMetadata() (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	errs := []string{}
+	for i, f := range m.active {
+		r, meta, err := FetchMetadata(f)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("#%d: %s", i+1, err))
+			continue
+		}
+		if r != nil {
+			m.last = f
+			return r, meta, nil
+		}
+	}
+	if len(errs) == len(m.active) {
+		return nil, none, fmt.Errorf("all fetchers failed (%s)", strings.Join(errs, ", "))
+	}
+	return nil, none, nil //no updates
+}
+
+// Version returns the version reported by the last successful fetcher
+func (m *Multi) Version() string {
+	if ver, ok := m.last.(Versioned); ok {
+		return ver.Version()
+	}
+	return ""
+}
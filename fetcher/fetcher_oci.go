@@ -0,0 +1,470 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//manifest media types accepted from registries
+var ociAccept = strings.Join([]string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.artifact.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}, ", ")
+
+//OCI polls the manifest of an artifact in an OCI (container) registry,
+//for example one pushed with:
+//
+//	oras push registry.example.com/app:stable app
+//
+//When the digest of the manifest changes, the layer holding the binary
+//is downloaded and only returned once it matches its digest and size.
+//The layer is the binary itself, not a tar archive. For an index, the
+//manifest of the running platform is used. The registry is polled with
+//HEAD requests, which Docker Hub doesn't count towards its rate limit.
+type OCI struct {
+	//Reference of the artifact, "registry/repository:tag", the tag
+	//defaults to "latest". References without a registry are on
+	//Docker Hub.
+	Reference string
+	//Interval between checks
+	Interval time.Duration
+	//Jitter randomly offsets each Interval by up to +/- Jitter,
+	//spreading out the polls of a fleet sharing an Interval
+	Jitter time.Duration
+	//DelayFirstFetch waits an Interval before the first check too,
+	//rather than checking as soon as the fetcher starts
+	DelayFirstFetch bool
+	//Username and Password (or a token) to authenticate with the
+	//registry. Without them, the credentials of the registry (an
+	//"auth" of "docker login") are read from DockerConfig, which
+	//defaults to config.json in $DOCKER_CONFIG or ~/.docker.
+	//Credential helpers are not run. Anonymous pulls need neither.
+	Username, Password string
+	DockerConfig       string
+	//Layer is used to find the layer of the binary given its title
+	//(the file name pushed with oras) and media type. By default, the
+	//only layer matches, or the one whose title has both GOOS and
+	//GOARCH as parts (separated by e.g. "-", "_" or "."), such as
+	//app_linux_amd64.
+	Layer func(title, mediaType string) bool
+	//PlainHTTP talks to the registry over HTTP rather than HTTPS,
+	//e.g. a local registry on localhost:5000
+	PlainHTTP bool
+	//DownloadTimeout bounds each request, including the download of
+	//the layer, so a stalled download fails and is retried on the
+	//next poll. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//StateFile is an optional path where the digest of the last
+	//fetched manifest is saved, so restarting the master process
+	//won't re-download an unchanged binary
+	StateFile string
+	//internal state
+	baseURL    string
+	host       string
+	repository string
+	tag        string
+	auth       string
+	delay      bool
+	lastDigest string
+	manifest   Manifest
+	intervalPoller
+	pinner
+}
+
+//ociDescriptor describes a manifest or layer
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+}
+
+//ociManifest is an image manifest, an artifact manifest
+//(with blobs rather than layers) or an index
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+	Blobs     []ociDescriptor `json:"blobs"`
+}
+
+//ociState is persisted to the StateFile
+type ociState struct {
+	Digest string `json:"digest"`
+}
+
+// Init validates the provided config
+func (o *OCI) Init() error {
+	if o.Reference == "" {
+		return errors.New("Reference required")
+	}
+	o.delay = o.DelayFirstFetch
+	if err := o.parseReference(); err != nil {
+		return err
+	}
+	if o.Layer == nil {
+		o.Layer = o.defaultLayer
+	}
+	if o.Interval == 0 {
+		o.Interval = 5 * time.Minute
+	}
+	if o.Username == "" && o.Password == "" {
+		if err := o.loadCredentials(); err != nil {
+			return err
+		}
+	}
+	if o.StateFile != "" {
+		s := ociState{}
+		if loadState(o.StateFile, &s) {
+			o.lastDigest = s.Digest
+		}
+	}
+	o.manifest.DownloadTimeout = o.DownloadTimeout
+	return o.manifest.init()
+}
+
+//parseReference splits the Reference into its registry, repository and tag
+func (o *OCI) parseReference() error {
+	ref := o.Reference
+	if i := strings.Index(ref, "@"); i >= 0 {
+		return fmt.Errorf("invalid Reference %q (use a tag, digests are pinned with Pin)", ref)
+	}
+	o.tag = "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref, o.tag = ref[:i], ref[i+1:]
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		o.host, o.repository = parts[0], parts[1]
+	} else {
+		o.host, o.repository = "registry-1.docker.io", ref
+		if len(parts) == 1 {
+			o.repository = "library/" + ref
+		}
+	}
+	if o.repository == "" || o.tag == "" {
+		return fmt.Errorf("invalid Reference %q", o.Reference)
+	}
+	scheme := "https://"
+	if o.PlainHTTP {
+		scheme = "http://"
+	}
+	o.baseURL = scheme + o.host + "/v2/" + o.repository
+	return nil
+}
+
+//loadCredentials reads the credentials of the registry from the
+//Docker config, a missing config or registry leaves them empty
+func (o *OCI) loadCredentials() error {
+	path := o.DockerConfig
+	if path == "" {
+		if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+			path = filepath.Join(dir, "config.json")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".docker", "config.json")
+		} else {
+			return nil
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && o.DockerConfig == "" {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read docker config (%s)", err)
+	}
+	config := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("invalid docker config (%s)", err)
+	}
+	keys := []string{o.host, "https://" + o.host, "http://" + o.host}
+	if o.host == "registry-1.docker.io" {
+		keys = append(keys, "https://index.docker.io/v1/", "docker.io", "index.docker.io")
+	}
+	for _, k := range keys {
+		if a, ok := config.Auths[k]; ok && a.Auth != "" {
+			userPass, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return fmt.Errorf("invalid docker config auth of %s (%s)", k, err)
+			}
+			kv := strings.SplitN(string(userPass), ":", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid docker config auth of %s", k)
+			}
+			o.Username, o.Password = kv[0], kv[1]
+			return nil
+		}
+	}
+	return nil
+}
+
+// SetContext sets the context used to cancel fetches
+func (o *OCI) SetContext(ctx context.Context) {
+	o.poller.SetContext(ctx)
+	o.manifest.SetContext(ctx)
+}
+
+// SetLogger sets the logger used to report fetch events
+func (o *OCI) SetLogger(l Logger) {
+	o.poller.SetLogger(l)
+	o.manifest.logger = l
+}
+
+//defaultLayer matches GOOS and GOARCH as whole parts of the
+//title, so "app-linux-arm64" isn't the layer of linux/arm
+func (o *OCI) defaultLayer(title, mediaType string) bool {
+	goos, goarch := false, false
+	for _, part := range strings.FieldsFunc(title, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		goos = goos || part == runtime.GOOS
+		goarch = goarch || part == runtime.GOARCH
+	}
+	return goos && goarch
+}
+
+// Fetch the binary when the manifest has changed
+func (o *OCI) Fetch() (io.Reader, error) {
+	r, _, err := o.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata fetches the binary along with the digest of
+// its manifest (the version), its size and SHA-256 checksum
+func (o *OCI) FetchMetadata() (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	//delay fetches after first
+	if o.delay {
+		if err := o.waitInterval(o.Interval, o.Jitter); err != nil {
+			return nil, none, err
+		}
+	}
+	o.delay = true
+	ref := o.tag
+	if v := o.pinned(); v != "" {
+		ref = v
+	}
+	o.logf("checking %s/%s:%s", o.host, o.repository, ref)
+	//cheap status check of the digest
+	resp, err := o.get("HEAD", o.baseURL+"/manifests/"+url.PathEscape(ref), ociAccept)
+	if err != nil {
+		return nil, none, fmt.Errorf("HEAD request failed (%w)", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, none, &statusError{"HEAD", resp.StatusCode}
+	}
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d == o.lastDigest {
+		o.logf("%s digest %s unchanged, skipping", o.Reference, d)
+		return nil, none, nil //skip, digest match
+	}
+	digest, m, err := o.getManifest(ref)
+	if err != nil {
+		return nil, none, err
+	}
+	if digest == o.lastDigest {
+		return nil, none, nil //skip, digest match
+	}
+	//an index lists the manifests of each platform
+	if len(m.Manifests) > 0 {
+		platform := ""
+		for _, d := range m.Manifests {
+			if d.Platform != nil && d.Platform.OS == runtime.GOOS && d.Platform.Architecture == runtime.GOARCH {
+				platform = d.Digest
+				break
+			}
+		}
+		if platform == "" {
+			return nil, none, errorf(ErrNotFound, "%s has no manifest for %s/%s", o.Reference, runtime.GOOS, runtime.GOARCH)
+		}
+		if _, m, err = o.getManifest(platform); err != nil {
+			return nil, none, err
+		}
+	}
+	layer, err := o.findLayer(append(m.Layers, m.Blobs...))
+	if err != nil {
+		return nil, none, err
+	}
+	sum := strings.TrimPrefix(layer.Digest, "sha256:")
+	if sum == layer.Digest {
+		return nil, none, fmt.Errorf("unsupported layer digest %q (sha256 required)", layer.Digest)
+	}
+	//many registries redirect blob requests to storage, the
+	//Authorization isn't sent on to another domain
+	o.manifest.Headers = http.Header{}
+	if o.auth != "" {
+		o.manifest.Headers.Set("Authorization", o.auth)
+	}
+	o.logf("downloading %s layer %s (%d bytes)", o.Reference, layer.Digest, layer.Size)
+	r, meta, err := o.manifest.fetch(manifestFile{
+		Version: digest,
+		URL:     o.baseURL + "/blobs/" + layer.Digest,
+		Size:    layer.Size,
+		SHA256:  sum,
+	})
+	if r == nil || err != nil {
+		return r, meta, err
+	}
+	o.lastDigest = digest
+	if o.StateFile != "" {
+		if err := saveState(o.StateFile, ociState{o.lastDigest}); err != nil {
+			o.logf("failed to save state (%s)", err)
+		}
+	}
+	return r, meta, nil
+}
+
+//getManifest fetches and decodes the manifest at ref (a tag or
+//digest), returning its digest, which a digest ref must match
+func (o *OCI) getManifest(ref string) (string, ociManifest, error) {
+	m := ociManifest{}
+	resp, err := o.get("GET", o.baseURL+"/manifests/"+url.PathEscape(ref), ociAccept)
+	if err != nil {
+		return "", m, fmt.Errorf("manifest request failed (%w)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", m, &statusError{"manifest", resp.StatusCode}
+	}
+	//registries limit manifests to 4MB
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return "", m, fmt.Errorf("failed to read manifest (%s)", err)
+	}
+	h := sha256.Sum256(b)
+	digest := "sha256:" + hex.EncodeToString(h[:])
+	if strings.HasPrefix(ref, "sha256:") && ref != digest {
+		return "", m, fmt.Errorf("manifest digest mismatch (expected %s, got %s)", ref, digest)
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return "", m, fmt.Errorf("invalid manifest (%s)", err)
+	}
+	return digest, m, nil
+}
+
+//findLayer returns the layer of the binary
+func (o *OCI) findLayer(layers []ociDescriptor) (ociDescriptor, error) {
+	if len(layers) == 1 {
+		return layers[0], nil
+	}
+	for _, l := range layers {
+		if o.Layer(l.Annotations["org.opencontainers.image.title"], l.MediaType) {
+			return l, nil
+		}
+	}
+	return ociDescriptor{}, errorf(ErrNotFound, "%s has no matching layer (of %d)", o.Reference, len(layers))
+}
+
+//get requests u, authenticating when challenged by the registry
+func (o *OCI) get(method, u, accept string) (*http.Response, error) {
+	resp, err := o.request(method, u, accept)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if err := o.authenticate(challenge); err != nil {
+		return nil, err
+	}
+	return o.request(method, u, accept)
+}
+
+func (o *OCI) request(method, u, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(o.context(), method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if o.auth != "" {
+		req.Header.Set("Authorization", o.auth)
+	}
+	return do(http.DefaultClient, req, o.DownloadTimeout)
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+//authenticate answers the challenge of a registry, with the
+//credentials or, for a token challenge, a token they obtain
+func (o *OCI) authenticate(challenge string) error {
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte(o.Username+":"+o.Password))
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	switch {
+	case scheme == "basic" && o.Username != "":
+		o.auth = basic
+		return nil
+	case scheme != "bearer":
+		return &statusError{"manifest", http.StatusUnauthorized}
+	}
+	params := map[string]string{}
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("invalid challenge %q (no realm)", challenge)
+	}
+	q := url.Values{}
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	q.Set("scope", "repository:"+o.repository+":pull")
+	req, err := http.NewRequestWithContext(o.context(), "GET", params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("token request failed (%w)", err)
+	}
+	if o.Username != "" {
+		req.Header.Set("Authorization", basic)
+	}
+	resp, err := do(http.DefaultClient, req, o.DownloadTimeout)
+	if err != nil {
+		return fmt.Errorf("token request failed (%w)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{"token", resp.StatusCode}
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return fmt.Errorf("invalid token (%s)", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return errors.New("invalid token (empty)")
+	}
+	o.auth = "Bearer " + token.Token
+	return nil
+}
+
+// Version returns the manifest digest of the last fetched binary
+func (o *OCI) Version() string {
+	return o.lastDigest
+}
@@ -0,0 +1,24 @@
+package fetcher
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestOCIDefaultLayer(t *testing.T) {
+	goos, goarch := runtime.GOOS, runtime.GOARCH
+	o := &OCI{}
+	for title, match := range map[string]bool{
+		"app-" + goos + "-" + goarch:         true,
+		"app_" + goos + "_" + goarch + ".gz": true,
+		goarch + "." + goos:                  true,
+		"app-" + goos + "-" + goarch + "64":  false, //e.g. arm64 on arm
+		"app-" + goos + "-" + goarch + "le":  false,
+		"app-" + goos + "x-" + goarch:        false,
+		"app-" + goos:                        false,
+	} {
+		if got := o.defaultLayer(title, ""); got != match {
+			t.Errorf("%s: matched %v, expected %v", title, got, match)
+		}
+	}
+}
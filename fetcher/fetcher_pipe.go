@@ -0,0 +1,120 @@
+package fetcher
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Pipe reads binaries pushed into a named pipe (FIFO) by a
+// local agent. Each Fetch blocks until a writer has written a
+// complete binary and closed its end of the pipe, the pipe is
+// then reopened for the next writer. Paths ending in .gz, .bz2
+// or .zst will be decompressed.
+type Pipe struct {
+	// Path of the named pipe (e.g. created with mkfifo). When
+	// empty, a single binary is read from the master's stdin.
+	Path string
+	// AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	// by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	// stdinRead is set once stdin has been read to EOF
+	stdinRead bool
+	poller
+}
+
+// Init validates the Path
+func (p *Pipe) Init() error {
+	if p.Path == "" {
+		return nil
+	}
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return fmt.Errorf("Get pipe stat error: %s", err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("%s is not a named pipe", p.Path)
+	}
+	return nil
+}
+
+type pipeResult struct {
+	r   io.ReadCloser
+	err error
+}
+
+// Fetch blocks until a binary has been written to the pipe
+func (p *Pipe) Fetch() (io.Reader, error) {
+	ctx := p.context()
+	if p.Path == "" && p.stdinRead {
+		//stdin carries a single binary
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if p.Path == "" {
+		p.stdinRead = true
+	}
+	//opening and reading a pipe can't be interrupted, so read in
+	//the background and stop waiting when cancelled
+	ch := make(chan pipeResult, 1)
+	go func() {
+		r, err := p.read()
+		ch <- pipeResult{r, err}
+	}()
+	var res pipeResult
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.r != nil {
+				res.r.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	if res.r == nil {
+		p.logf("pipe closed without data, skipping")
+		return nil, nil //skip, empty write
+	}
+	return decompress(res.r, p.Path, p.AutoDecompress)
+}
+
+//read the pipe until the writer closes it, buffering to a temp
+//file so partially written binaries are never returned
+func (p *Pipe) read() (io.ReadCloser, error) {
+	src := os.Stdin
+	if p.Path != "" {
+		//blocks until a writer connects
+		f, err := os.Open(p.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Open pipe error: %s", err)
+		}
+		defer f.Close()
+		src = f
+	}
+	p.logf("reading binary from %s", src.Name())
+	f, err := ioutil.TempFile("", "overseer-pipe-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file (%s)", err)
+	}
+	tmp := &tempFile{f}
+	n, err := io.Copy(f, src)
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("Read pipe error: %s", err)
+	}
+	if n == 0 {
+		tmp.Close()
+		return nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to rewind temp file (%s)", err)
+	}
+	p.logf("read binary (%d bytes)", n)
+	return tmp, nil
+}
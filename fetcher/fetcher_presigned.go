@@ -0,0 +1,165 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+//Presigned polls short-lived pre-signed URLs (e.g. S3 or GCS
+//signed URLs) with conditional GET requests, so devices never
+//hold storage credentials. A fresh URL is requested before each
+//poll, and again if the URL expires mid-poll.
+type Presigned struct {
+	//URL returns a fresh pre-signed URL of the binary
+	URL func() (string, error)
+	//Interval between checks
+	Interval time.Duration
+	//Jitter randomly offsets each Interval by up to +/- Jitter,
+	//spreading out the polls of a fleet sharing an Interval
+	Jitter time.Duration
+	//DelayFirstFetch waits an Interval before the first check too,
+	//rather than checking as soon as the fetcher starts
+	DelayFirstFetch bool
+	//RequestJitter randomly delays each poll by up to RequestJitter,
+	//before its URL is requested (see HTTP.RequestJitter)
+	RequestJitter time.Duration
+	//Headers are added to every request
+	Headers http.Header
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	//AllowedContentTypes optionally restricts the Content-Type of
+	//downloaded binaries (e.g. "application/octet-stream"), so an
+	//error page served with a 200 is never mistaken for a binary
+	AllowedContentTypes []string
+	//SkipNotFound treats a missing binary (404) as no update, rather
+	//than an error, for sources where it is temporarily removed
+	SkipNotFound bool
+	//RequiredHeaders gate upgrades on the metadata of the binary
+	//(see HTTP.RequiredHeaders)
+	RequiredHeaders map[string]string
+	//BuildHeader optionally names a response header holding a monotonic
+	//build number, older builds are skipped (see HTTP.BuildHeader)
+	BuildHeader string
+	//DownloadTimeout bounds each request, including reading the
+	//binary, so a stalled download fails and is retried on the
+	//next poll. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//Transport optionally tunes the connection timeouts and
+	//keepalives (see HTTP.Transport)
+	Transport TransportOptions
+	//StateFile is an optional path where the version of the last
+	//fetched binary is saved, so restarting the master process
+	//won't re-download an unchanged binary
+	StateFile string
+	//VerifyMD5 checks each downloaded binary against the MD5 declared
+	//by its Content-MD5 header or ETag (see HTTP.VerifyMD5)
+	VerifyMD5 bool
+	//ResumeFile is an optional path where binaries are downloaded,
+	//so interrupted downloads are resumed (see HTTP.ResumeFile)
+	ResumeFile string
+	//internal state
+	http  HTTP
+	delay bool
+	intervalPoller
+}
+
+// Init validates the provided config and retrieves the first URL
+func (p *Presigned) Init() error {
+	if p.URL == nil {
+		return errors.New("URL required")
+	}
+	p.delay = p.DelayFirstFetch
+	u, err := p.URL()
+	if err != nil {
+		return fmt.Errorf("failed to get URL (%s)", err)
+	}
+	if p.Interval == 0 {
+		p.Interval = 5 * time.Minute
+	}
+	p.http.URL = u
+	p.http.Conditional = true
+	p.http.Headers = p.Headers
+	p.http.AutoDecompress = p.AutoDecompress
+	p.http.AllowedContentTypes = p.AllowedContentTypes
+	p.http.SkipNotFound = p.SkipNotFound
+	p.http.RequiredHeaders = p.RequiredHeaders
+	p.http.BuildHeader = p.BuildHeader
+	p.http.StateFile = p.StateFile
+	p.http.DownloadTimeout = p.DownloadTimeout
+	p.http.Transport = p.Transport
+	p.http.VerifyMD5 = p.VerifyMD5
+	p.http.ResumeFile = p.ResumeFile
+	//ETag and Last-Modified identify the binary, other
+	//headers may vary between pre-signed URLs
+	p.http.CheckHeaders = []string{"ETag", "Last-Modified"}
+	return p.http.Init()
+}
+
+// SetContext sets the context used to cancel fetches
+func (p *Presigned) SetContext(ctx context.Context) {
+	p.poller.SetContext(ctx)
+	p.http.SetContext(ctx)
+}
+
+// SetLogger sets the logger used to report fetch events
+func (p *Presigned) SetLogger(l Logger) {
+	p.poller.SetLogger(l)
+	p.http.SetLogger(l)
+}
+
+// Fetch the binary from a fresh pre-signed URL
+func (p *Presigned) Fetch() (io.Reader, error) {
+	//delay fetches after first
+	if p.delay {
+		if err := p.waitInterval(p.Interval, p.Jitter); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.waitRequest(p.RequestJitter); err != nil {
+		return nil, err
+	}
+	if p.delay || p.RequestJitter > 0 {
+		//a fresh URL, unless just retrieved by Init
+		u, err := p.URL()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get URL (%s)", err)
+		}
+		p.http.URL = u
+	}
+	p.delay = true
+	r, err := p.fetch()
+	if serr, ok := err.(*statusError); ok && expired(serr.code) {
+		//url expired, retry with a fresh one
+		p.logf("pre-signed URL rejected (status code %d), refreshing", serr.code)
+		u, err := p.URL()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get URL (%s)", err)
+		}
+		p.http.URL = u
+		return p.fetch()
+	}
+	return r, err
+}
+
+//fetch polls immediately with a conditional GET, since
+//pre-signed URLs are unlikely to permit HEAD requests
+func (p *Presigned) fetch() (io.Reader, error) {
+	p.http.delay = false
+	p.http.Conditional = true
+	return p.http.Fetch()
+}
+
+//expired pre-signed URLs are rejected with one of these codes
+func expired(code int) bool {
+	return code == http.StatusBadRequest || code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+// Version returns the ETag (or Last-Modified) of the last fetched binary
+func (p *Presigned) Version() string {
+	return p.http.Version()
+}
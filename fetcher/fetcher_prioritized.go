@@ -0,0 +1,355 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+//Prioritized polls several sources at once, each at the Interval of
+//its own fetcher, for example an internal mirror polled every 30s and
+//the canonical bucket every 10m. Unlike Multi, a slow source never
+//holds up a fast one. A binary is only downloaded when its version is
+//newer (see Compare) than the current binary, otherwise it is skipped
+//unread. When several sources offer the newest version, the binary is
+//fetched from the source with the highest Priority.
+//
+//Versions must identify binaries across sources (e.g. the release tags
+//of a Manifest or GitHub), unlike ETags, which differ between sources.
+type Prioritized struct {
+	Sources []Source
+	//Compare returns a positive number when version a is newer than b,
+	//zero when they are the same binary and a negative number when a
+	//is older. Defaults to comparing semantic versions (the "v" prefix
+	//is optional), other versions being newer whenever they differ.
+	Compare func(a, b string) int
+	//Current optionally sets the version of the running binary (e.g.
+	//built into it), so no source downloads it again after a restart
+	//of the master process. Later versions are tracked as fetched.
+	Current string
+	//Window is how long a binary offered by one source waits for the
+	//offers of the others, so the preferred of the sources polled
+	//together (e.g. on startup) wins. Defaults to one second, a
+	//negative Window only considers offers already waiting.
+	Window time.Duration
+	//internal state
+	ctx       context.Context
+	logger    Logger
+	offers    chan sourceOffer
+	startOnce sync.Once
+	ready     []bool
+	errs      []error
+	pinMux    sync.Mutex
+	pinned    string
+	current   string
+}
+
+//Source is a fetcher polled by Prioritized
+type Source struct {
+	Fetcher Interface
+	//Priority decides between sources offering the same
+	//version, the highest wins (then the first listed)
+	Priority int
+}
+
+//sourceOffer is the result of a poll of the source at index
+type sourceOffer struct {
+	index int
+	r     io.Reader
+	meta  Metadata
+	err   error
+}
+
+// Init initialises all sources, failing only if every source fails
+func (p *Prioritized) Init() error {
+	if len(p.Sources) == 0 {
+		return errors.New("Sources required")
+	}
+	if p.Compare == nil {
+		p.Compare = compareVersions
+	}
+	if p.Window == 0 {
+		p.Window = time.Second
+	}
+	if p.ctx == nil {
+		p.ctx = context.Background()
+	}
+	p.ready = make([]bool, len(p.Sources))
+	p.errs = make([]error, len(p.Sources))
+	p.current = p.Current
+	errs := []string{}
+	for i, s := range p.Sources {
+		if s.Fetcher == nil {
+			return fmt.Errorf("source #%d has no Fetcher", i+1)
+		}
+		if err := s.Fetcher.Init(); err != nil {
+			errs = append(errs, fmt.Sprintf("#%d: %s", i+1, err))
+			continue
+		}
+		p.ready[i] = true
+	}
+	if len(errs) == len(p.Sources) {
+		return fmt.Errorf("all sources failed to init (%s)", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// SetContext passes ctx through to each source, cancelling
+// ctx also stops polling them
+func (p *Prioritized) SetContext(ctx context.Context) {
+	p.ctx = ctx
+	for _, s := range p.Sources {
+		if c, ok := s.Fetcher.(Cancellable); ok {
+			c.SetContext(ctx)
+		}
+	}
+}
+
+// SetLogger passes l through to each source
+func (p *Prioritized) SetLogger(l Logger) {
+	p.logger = l
+	for _, s := range p.Sources {
+		if lg, ok := s.Fetcher.(Loggable); ok {
+			lg.SetLogger(l)
+		}
+	}
+}
+
+// Pin passes through to each source, the pinned version
+// is then adopted even if it is older than the current
+func (p *Prioritized) Pin(version string) {
+	p.pinMux.Lock()
+	p.pinned = version
+	p.pinMux.Unlock()
+	for _, s := range p.Sources {
+		if pf, ok := s.Fetcher.(Pinnable); ok {
+			pf.Pin(version)
+		}
+	}
+}
+
+// Trigger passes through to each source
+func (p *Prioritized) Trigger() {
+	for _, s := range p.Sources {
+		if t, ok := s.Fetcher.(Triggerable); ok {
+			t.Trigger()
+		}
+	}
+}
+
+// Accepted passes through to each source, only
+// the binary of the winning source was read
+func (p *Prioritized) Accepted() {
+	for _, s := range p.Sources {
+		if a, ok := s.Fetcher.(Acceptable); ok {
+			a.Accepted()
+		}
+	}
+}
+
+// SetInterval passes through to each source
+func (p *Prioritized) SetInterval(d time.Duration) {
+	for _, s := range p.Sources {
+		if a, ok := s.Fetcher.(Adjustable); ok {
+			a.SetInterval(d)
+		}
+	}
+}
+
+// NextPoll returns the earliest NextPoll of the sources
+func (p *Prioritized) NextPoll() time.Time {
+	fetchers := make([]Interface, len(p.Sources))
+	for i, s := range p.Sources {
+		fetchers[i] = s.Fetcher
+	}
+	return nextPoll(fetchers...)
+}
+
+// Fetch returns the binary of the winning source, if newer
+func (p *Prioritized) Fetch() (io.Reader, error) {
+	r, _, err := p.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata waits for the next poll of any source, returning
+// the newest binary offered meanwhile along with its Metadata. It
+// fails only if the last poll of every source failed.
+func (p *Prioritized) FetchMetadata() (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	p.startOnce.Do(p.start)
+	offers := []sourceOffer{}
+	select {
+	case o := <-p.offers:
+		offers = append(offers, o)
+	case <-p.ctx.Done():
+		return nil, none, p.ctx.Err()
+	}
+	//a binary waits for the offers of other sources
+	if offers[0].r != nil {
+		offers = append(offers, p.collect()...)
+	}
+	for _, o := range offers {
+		p.errs[o.index] = o.err
+		if o.err != nil {
+			p.logf("source #%d failed (%s)", o.index+1, o.err)
+		}
+	}
+	best := p.choose(offers)
+	for i, o := range offers {
+		if o.r != nil && i != best {
+			if c, ok := o.r.(io.Closer); ok {
+				c.Close()
+			}
+		}
+	}
+	if best >= 0 {
+		o := offers[best]
+		p.current = o.meta.Version
+		return o.r, o.meta, nil
+	}
+	errs := []string{}
+	for i, err := range p.errs {
+		if p.ready[i] && err != nil {
+			errs = append(errs, fmt.Sprintf("#%d: %s", i+1, err))
+		} else if p.ready[i] {
+			return nil, none, nil //no updates
+		}
+	}
+	return nil, none, fmt.Errorf("all sources failed (%s)", strings.Join(errs, ", "))
+}
+
+//collect returns the offers of other sources within the Window
+func (p *Prioritized) collect() []sourceOffer {
+	offers := []sourceOffer{}
+	if p.Window < 0 {
+		for {
+			select {
+			case o := <-p.offers:
+				offers = append(offers, o)
+			default:
+				return offers
+			}
+		}
+	}
+	timer := time.NewTimer(p.Window)
+	defer timer.Stop()
+	for {
+		select {
+		case o := <-p.offers:
+			offers = append(offers, o)
+		case <-timer.C:
+			return offers
+		case <-p.ctx.Done():
+			return offers
+		}
+	}
+}
+
+//choose returns the index of the winning binary in offers, the newest
+//version from the highest priority source, or -1 when none is newer
+//than the current binary (or the pinned version)
+func (p *Prioritized) choose(offers []sourceOffer) int {
+	p.pinMux.Lock()
+	pinned := p.pinned
+	p.pinMux.Unlock()
+	candidates := []int{}
+	for i, o := range offers {
+		if o.r == nil {
+			continue
+		}
+		v := o.meta.Version
+		if pinned != "" && v != pinned {
+			p.logf("source #%d offers %s, skipping (pinned to %s)", o.index+1, v, pinned)
+		} else if pinned != "" && v == p.current {
+			p.logf("source #%d offers the current version %s, skipping", o.index+1, v)
+		} else if pinned == "" && p.current != "" && p.Compare(v, p.current) <= 0 {
+			p.logf("source #%d offers %s, not newer than %s, skipping", o.index+1, v, p.current)
+		} else {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return -1
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := offers[candidates[i]], offers[candidates[j]]
+		if p.newer(a.meta.Version, b.meta.Version) {
+			return true
+		} else if p.newer(b.meta.Version, a.meta.Version) {
+			return false
+		}
+		if pa, pb := p.Sources[a.index].Priority, p.Sources[b.index].Priority; pa != pb {
+			return pa > pb
+		}
+		return a.index < b.index
+	})
+	return candidates[0]
+}
+
+//newer is true when version a is newer than b, unordered
+//versions (e.g. which differ, see Compare) are neither
+func (p *Prioritized) newer(a, b string) bool {
+	return p.Compare(a, b) > 0 && p.Compare(b, a) <= 0
+}
+
+//start polls each source in its own goroutine, a poll
+//waits until its result is taken by FetchMetadata
+func (p *Prioritized) start() {
+	p.offers = make(chan sourceOffer)
+	for i, ready := range p.ready {
+		if ready {
+			go p.poll(i)
+		}
+	}
+}
+
+func (p *Prioritized) poll(index int) {
+	f := p.Sources[index].Fetcher
+	for p.ctx.Err() == nil {
+		r, meta, err := FetchMetadata(f)
+		select {
+		case p.offers <- sourceOffer{index, r, meta, err}:
+		case <-p.ctx.Done():
+			if c, ok := r.(io.Closer); ok {
+				c.Close()
+			}
+		}
+	}
+}
+
+// Version returns the version of the last fetched binary
+func (p *Prioritized) Version() string {
+	return p.current
+}
+
+func (p *Prioritized) logf(f string, args ...interface{}) {
+	if p.logger != nil {
+		p.logger.Printf("[overseer fetcher] "+f, args...)
+	}
+}
+
+//compareVersions compares semantic versions (with an optional "v"
+//prefix), other versions are newer than b whenever they differ
+func compareVersions(a, b string) int {
+	ca, cb := a, b
+	if !strings.HasPrefix(ca, "v") {
+		ca = "v" + ca
+	}
+	if !strings.HasPrefix(cb, "v") {
+		cb = "v" + cb
+	}
+	if semver.IsValid(ca) && semver.IsValid(cb) {
+		return semver.Compare(ca, cb)
+	}
+	if a == b {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,244 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//SFTP polls the modify time and size of a file on an SSH
+//server. If either changes, the file is downloaded over SFTP
+//and its io.Reader stream is returned. Paths ending in .gz,
+//.bz2 or .zst will be decompressed.
+type SFTP struct {
+	//Addr of the SSH server, the port defaults to 22
+	Addr string
+	//User to log in as
+	User string
+	//Password and/or a PEM encoded private key (PrivateKey,
+	//or the path PrivateKeyFile) authenticate the User
+	Password       string
+	PrivateKey     []byte
+	PrivateKeyFile string
+	//KnownHostsFile verifies the server's host key, in the
+	//OpenSSH known_hosts format (e.g. ~/.ssh/known_hosts)
+	KnownHostsFile string
+	//InsecureIgnoreHostKey accepts any host key instead of using
+	//KnownHostsFile, exposing the binary to man-in-the-middle attacks
+	InsecureIgnoreHostKey bool
+	//Path of the binary on the server
+	Path string
+	//Interval between checks
+	Interval time.Duration
+	//Jitter randomly offsets each Interval by up to +/- Jitter,
+	//spreading out the polls of a fleet sharing an Interval
+	Jitter time.Duration
+	//DelayFirstFetch waits an Interval before the first check too,
+	//rather than checking as soon as the fetcher starts
+	DelayFirstFetch bool
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	//StateFile is an optional path where the version of the last
+	//fetched binary is saved, so restarting the master process
+	//won't re-download an unchanged binary
+	StateFile string
+	//internal state
+	config *ssh.ClientConfig
+	delay  bool
+	hash   string
+	intervalPoller
+}
+
+//sftpState is persisted to the StateFile
+type sftpState struct {
+	Hash string `json:"hash"`
+}
+
+// Init validates the provided config
+func (s *SFTP) Init() error {
+	if s.Addr == "" {
+		return errors.New("Addr required")
+	}
+	s.delay = s.DelayFirstFetch
+	if s.User == "" {
+		return errors.New("User required")
+	}
+	if s.Path == "" {
+		return errors.New("Path required")
+	}
+	if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+		s.Addr = net.JoinHostPort(s.Addr, "22")
+	}
+	if s.Interval == 0 {
+		s.Interval = 5 * time.Minute
+	}
+	auth := []ssh.AuthMethod{}
+	key := s.PrivateKey
+	if s.PrivateKeyFile != "" {
+		b, err := ioutil.ReadFile(s.PrivateKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read private key file (%s)", err)
+		}
+		key = b
+	}
+	if key != nil {
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("invalid private key (%s)", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if s.Password != "" {
+		auth = append(auth, ssh.Password(s.Password))
+	}
+	if len(auth) == 0 {
+		return errors.New("Password or PrivateKey required")
+	}
+	var hostKey ssh.HostKeyCallback
+	switch {
+	case s.KnownHostsFile != "":
+		cb, err := knownhosts.New(s.KnownHostsFile)
+		if err != nil {
+			return fmt.Errorf("invalid known hosts file (%s)", err)
+		}
+		hostKey = cb
+	case s.InsecureIgnoreHostKey:
+		hostKey = ssh.InsecureIgnoreHostKey()
+	default:
+		return errors.New("KnownHostsFile required")
+	}
+	s.config = &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         30 * time.Second,
+	}
+	if s.StateFile != "" {
+		st := sftpState{}
+		if loadState(s.StateFile, &st) {
+			s.hash = st.Hash
+		}
+	}
+	return nil
+}
+
+// Fetch the binary from the SSH server
+func (s *SFTP) Fetch() (io.Reader, error) {
+	//delay fetches after first
+	if s.delay {
+		if err := s.waitInterval(s.Interval, s.Jitter); err != nil {
+			return nil, err
+		}
+	}
+	s.delay = true
+	s.logf("checking sftp://%s%s", s.Addr, s.Path)
+	conn, client, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer client.Close()
+	//interrupt the transfer when cancelled
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.context().Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	info, err := client.Stat(s.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errorf(ErrNotFound, "stat %s failed (%s)", s.Path, err)
+		}
+		return nil, fmt.Errorf("stat %s failed (%w)", s.Path, transient(err))
+	}
+	hash := fmt.Sprintf("%d|%d", info.ModTime().UnixNano(), info.Size())
+	if hash == s.hash {
+		s.logf("sftp://%s%s unchanged, skipping", s.Addr, s.Path)
+		return nil, nil //skip, file match
+	}
+	s.logf("downloading sftp://%s%s (%d bytes)", s.Addr, s.Path, info.Size())
+	tmp, err := s.download(client, info.Size())
+	if err != nil {
+		if cerr := s.context().Err(); cerr != nil {
+			return nil, cerr
+		}
+		return nil, err
+	}
+	s.hash = hash
+	if s.StateFile != "" {
+		if err := saveState(s.StateFile, sftpState{Hash: hash}); err != nil {
+			s.logf("failed to save state (%s)", err)
+		}
+	}
+	//extract compressed files
+	return decompress(tmp, s.Path, s.AutoDecompress)
+}
+
+//dial connects to the SSH server and starts an SFTP session
+func (s *SFTP) dial() (*ssh.Client, *sftp.Client, error) {
+	d := net.Dialer{Timeout: s.config.Timeout}
+	conn, err := d.DialContext(s.context(), "tcp", s.Addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect failed (%w)", transient(err))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.Addr, s.config)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("ssh handshake failed (%s)", err)
+	}
+	sc := ssh.NewClient(c, chans, reqs)
+	client, err := sftp.NewClient(sc)
+	if err != nil {
+		sc.Close()
+		return nil, nil, fmt.Errorf("sftp session failed (%s)", err)
+	}
+	return sc, client, nil
+}
+
+//download the binary to a temp file, so the connection isn't
+//held open while overseer checks it
+func (s *SFTP) download(client *sftp.Client, size int64) (*tempFile, error) {
+	src, err := client.Open(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed (%s)", s.Path, err)
+	}
+	defer src.Close()
+	f, err := ioutil.TempFile("", "overseer-sftp-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file (%s)", err)
+	}
+	tmp := &tempFile{f}
+	n, err := io.Copy(f, src)
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to download binary (%w)", transient(err))
+	}
+	if n != size {
+		//still being written, retry with the next poll
+		tmp.Close()
+		return nil, errorf(ErrTransient, "binary size changed during download (expected %d bytes, got %d)", size, n)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to rewind temp file (%s)", err)
+	}
+	return tmp, nil
+}
+
+// Version returns the modify time and size of the last fetched binary
+func (s *SFTP) Version() string {
+	return s.hash
+}
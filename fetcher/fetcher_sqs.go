@@ -0,0 +1,440 @@
+package fetcher
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//SQS long-polls an Amazon SQS queue for messages announcing new
+//binaries. A message's body is the location of the binary (e.g. a
+//URL), or a JSON object with a "location" field. The binary is
+//downloaded from its location and the message is only deleted once
+//the binary has been completely read, so each announcement is
+//delivered at least once: a failed download is retried when its
+//message becomes visible again.
+//
+//Malformed messages are moved to the DeadLetterQueueURL, or are
+//otherwise left for the queue's redrive policy.
+type SQS struct {
+	//QueueURL of the queue, for example
+	//https://sqs.us-east-1.amazonaws.com/123456789012/releases
+	QueueURL string
+	//Region of the queue, defaults to the region in the QueueURL,
+	//or the AWS_REGION environment
+	Region string
+	//AccessKeyID, SecretAccessKey and the optional SessionToken sign
+	//requests, they default to the AWS_ACCESS_KEY_ID,
+	//AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment, and
+	//then to the EC2 instance profile (unless AWS_EC2_METADATA_DISABLED)
+	AccessKeyID, SecretAccessKey, SessionToken string
+	//Wait is the longest each receive waits for a message, up
+	//to 20 seconds. Defaults to 20 seconds.
+	Wait time.Duration
+	//VisibilityTimeout hides a received message from the queue
+	//while its binary is downloaded. Defaults to the queue's
+	//visibility timeout.
+	VisibilityTimeout time.Duration
+	//DeadLetterQueueURL optionally receives malformed messages,
+	//which are then deleted from the queue
+	DeadLetterQueueURL string
+	//Fetcher optionally returns the fetcher which downloads the
+	//binary at each new location, it is initialised and fetched
+	//once. Defaults to an HTTP GET of the location.
+	Fetcher func(location string) (Interface, error)
+	//Headers are added to the default binary requests
+	Headers http.Header
+	//DownloadTimeout bounds the default binary requests,
+	//including reading the binary. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	//StateFile is an optional path where the location of the last
+	//fetched binary is saved, so restarting the master process
+	//won't re-download an unchanged binary
+	StateFile string
+	//internal state
+	profile  *instanceProfile
+	endpoint string
+	delay    bool
+	location string
+	poller
+}
+
+//sqsState is persisted to the StateFile
+type sqsState struct {
+	Location string `json:"location"`
+}
+
+//sqsMessage is a received message
+type sqsMessage struct {
+	MessageID     string `json:"MessageId"`
+	ReceiptHandle string `json:"ReceiptHandle"`
+	Body          string `json:"Body"`
+}
+
+// Init validates the provided config
+func (s *SQS) Init() error {
+	if s.QueueURL == "" {
+		return errors.New("QueueURL required")
+	}
+	u, err := url.Parse(s.QueueURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid QueueURL %q", s.QueueURL)
+	}
+	s.endpoint = u.Scheme + "://" + u.Host + "/"
+	if s.Region == "" {
+		//sqs.<region>.amazonaws.com or <region>.queue.amazonaws.com
+		if parts := strings.Split(u.Hostname(), "."); len(parts) == 4 && parts[2] == "amazonaws" {
+			if parts[0] == "sqs" {
+				s.Region = parts[1]
+			} else if parts[1] == "queue" {
+				s.Region = parts[0]
+			}
+		}
+	}
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_REGION")
+	}
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.Region == "" {
+		return errors.New("Region required")
+	}
+	if s.AccessKeyID == "" && s.SecretAccessKey == "" {
+		s.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if s.SessionToken == "" {
+			s.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+	}
+	if s.AccessKeyID == "" && s.SecretAccessKey == "" && !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		s.profile = newInstanceProfile()
+		if _, err := s.profile.credentials(s.context()); err != nil {
+			return fmt.Errorf("AccessKeyID and SecretAccessKey required, or an EC2 instance profile (%w)", err)
+		}
+	} else if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return errors.New("AccessKeyID and SecretAccessKey required")
+	}
+	if s.Wait <= 0 {
+		s.Wait = 20 * time.Second
+	} else if s.Wait > 20*time.Second {
+		return errors.New("Wait cannot exceed 20 seconds")
+	}
+	if s.StateFile != "" {
+		st := sqsState{}
+		if loadState(s.StateFile, &st) {
+			s.location = st.Location
+		}
+	}
+	return nil
+}
+
+// Fetch blocks until a message announces a binary, then fetches
+// the binary from its location
+func (s *SQS) Fetch() (io.Reader, error) {
+	msg, err := s.receive()
+	if msg == nil || err != nil {
+		return nil, err
+	}
+	location, err := sqsLocation(msg.Body)
+	var f Interface
+	if err == nil {
+		f, err = s.newFetcher(location)
+	}
+	if err != nil {
+		s.deadLetter(msg, err)
+		return nil, nil //skip, malformed message
+	}
+	if location == s.location {
+		s.logf("message %s announced %s again, deleting it", msg.MessageID, location)
+		s.delete(msg)
+		return nil, nil //skip, location unchanged
+	}
+	s.logf("message %s announced %s", msg.MessageID, location)
+	r, err := s.fetchOnce(f)
+	if err != nil {
+		//the message is redelivered after its visibility timeout
+		return nil, err
+	}
+	if r == nil {
+		s.delete(msg)
+		return nil, nil
+	}
+	return &sqsReader{Reader: r, s: s, msg: msg, location: location}, nil
+}
+
+//receive waits for the next message, the first receive
+//returns immediately so it doesn't hold up startup
+func (s *SQS) receive() (*sqsMessage, error) {
+	in := map[string]interface{}{
+		"QueueUrl":            s.QueueURL,
+		"MaxNumberOfMessages": 1,
+	}
+	if s.delay {
+		in["WaitTimeSeconds"] = int(s.Wait / time.Second)
+	}
+	s.delay = true
+	if s.VisibilityTimeout > 0 {
+		in["VisibilityTimeout"] = int(s.VisibilityTimeout / time.Second)
+	}
+	out := struct {
+		Messages []sqsMessage `json:"Messages"`
+	}{}
+	if err := s.call("ReceiveMessage", in, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Messages) == 0 {
+		return nil, nil
+	}
+	return &out.Messages[0], nil
+}
+
+//sqsLocation returns the binary location announced by a message body
+func sqsLocation(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if strings.HasPrefix(body, "{") {
+		m := struct {
+			Location string `json:"location"`
+		}{}
+		if err := json.Unmarshal([]byte(body), &m); err != nil {
+			return "", fmt.Errorf("invalid JSON (%s)", err)
+		}
+		body = strings.TrimSpace(m.Location)
+	}
+	if body == "" {
+		return "", errors.New("no location")
+	}
+	return body, nil
+}
+
+//newFetcher returns the fetcher of the binary at location
+func (s *SQS) newFetcher(location string) (Interface, error) {
+	if s.Fetcher != nil {
+		f, err := s.Fetcher(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid location %s (%s)", location, err)
+		}
+		return f, nil
+	}
+	if u, err := url.Parse(location); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid location %s (http or https URL required)", location)
+	}
+	return &HTTP{
+		URL:             location,
+		Headers:         s.Headers,
+		DownloadTimeout: s.DownloadTimeout,
+		AutoDecompress:  s.AutoDecompress,
+	}, nil
+}
+
+//fetched deletes the message of a completely read binary
+func (s *SQS) fetched(msg *sqsMessage, location string) {
+	s.delete(msg)
+	s.location = location
+	if s.StateFile != "" {
+		if err := saveState(s.StateFile, sqsState{Location: location}); err != nil {
+			s.logf("failed to save state (%s)", err)
+		}
+	}
+}
+
+//delete acknowledges a message, it is redelivered
+//(and skipped) when this fails
+func (s *SQS) delete(msg *sqsMessage) {
+	in := map[string]interface{}{
+		"QueueUrl":      s.QueueURL,
+		"ReceiptHandle": msg.ReceiptHandle,
+	}
+	if err := s.call("DeleteMessage", in, nil); err != nil {
+		s.logf("failed to delete message %s (%s)", msg.MessageID, err)
+	}
+}
+
+//deadLetter moves a malformed message to the DeadLetterQueueURL
+func (s *SQS) deadLetter(msg *sqsMessage, reason error) {
+	if s.DeadLetterQueueURL == "" {
+		s.logf("malformed message %s (%s), leaving it for the redrive policy", msg.MessageID, reason)
+		return
+	}
+	in := map[string]interface{}{
+		"QueueUrl":    s.DeadLetterQueueURL,
+		"MessageBody": msg.Body,
+	}
+	if err := s.call("SendMessage", in, nil); err != nil {
+		s.logf("failed to dead-letter malformed message %s (%s)", msg.MessageID, err)
+		return
+	}
+	s.logf("moved malformed message %s to the dead-letter queue (%s)", msg.MessageID, reason)
+	s.delete(msg)
+}
+
+//call sends an SQS API request, in the JSON protocol,
+//and decodes its response into out
+func (s *SQS) call(action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("invalid %s request (%s)", action, err)
+	}
+	req, err := http.NewRequestWithContext(s.context(), "POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%s request failed (%w)", action, err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	creds := awsCredentials{accessKeyID: s.AccessKeyID, secretAccessKey: s.SecretAccessKey, sessionToken: s.SessionToken}
+	if s.profile != nil {
+		if creds, err = s.profile.credentials(s.context()); err != nil {
+			return fmt.Errorf("%s request failed (%w)", action, err)
+		}
+	}
+	s.sign(req, body, creds)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed (%w)", action, transient(err))
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read %s response (%w)", action, transient(err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return sqsError(action, resp.StatusCode, b)
+	}
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			return fmt.Errorf("invalid %s response (%s)", action, err)
+		}
+	}
+	return nil
+}
+
+//sqsError describes a failed request, matching its error kind
+func sqsError(action string, code int, body []byte) error {
+	e := struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}{}
+	if json.Unmarshal(body, &e) != nil || e.Type == "" {
+		return &statusError{action, code}
+	}
+	//e.g. com.amazonaws.sqs#QueueDoesNotExist
+	typ := e.Type[strings.LastIndex(e.Type, "#")+1:]
+	var kind error
+	switch typ {
+	case "QueueDoesNotExist", "AWS.SimpleQueueService.NonExistentQueue":
+		kind = ErrNotFound
+	case "AccessDenied", "AccessDeniedException", "InvalidClientTokenId", "SignatureDoesNotMatch",
+		"ExpiredToken", "UnrecognizedClientException", "MissingAuthenticationToken":
+		kind = ErrAuth
+	case "RequestThrottled", "ThrottlingException", "ServiceUnavailable", "InternalFailure":
+		kind = ErrTransient
+	default:
+		if code >= 500 {
+			kind = ErrTransient
+		}
+	}
+	if kind == nil {
+		return fmt.Errorf("%s request failed (status code %d, %s: %s)", action, code, typ, e.Message)
+	}
+	return errorf(kind, "%s request failed (status code %d, %s: %s)", action, code, typ, e.Message)
+}
+
+//sign adds an AWS Signature Version 4 to req
+func (s *SQS) sign(req *http.Request, body []byte, c awsCredentials) {
+	date := clk.Now().UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	names := []string{"host"}
+	for k := range req.Header {
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	headers := strings.Builder{}
+	for _, k := range names {
+		v := req.URL.Host
+		if k != "host" {
+			v = strings.TrimSpace(req.Header.Get(k))
+		}
+		headers.WriteString(k + ":" + v + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payload := sha256.Sum256(body)
+	canonical := sha256.Sum256([]byte(strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		headers.String(),
+		signed,
+		hex.EncodeToString(payload[:]),
+	}, "\n")))
+	scope := date[:8] + "/" + s.Region + "/sqs/aws4_request"
+	key := []byte("AWS4" + c.secretAccessKey)
+	for _, k := range []string{date[:8], s.Region, "sqs", "aws4_request"} {
+		key = hmacSHA256(key, k)
+	}
+	sig := hmacSHA256(key, "AWS4-HMAC-SHA256\n"+date+"\n"+scope+"\n"+hex.EncodeToString(canonical[:]))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		c.accessKeyID, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// Version returns the location of the last fetched binary
+func (s *SQS) Version() string {
+	return s.location
+}
+
+//sqsReader deletes its message once the binary is completely read
+type sqsReader struct {
+	io.Reader
+	s        *SQS
+	msg      *sqsMessage
+	location string
+	done     bool
+}
+
+func (r *sqsReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF && !r.done {
+		r.done = true
+		r.s.fetched(r.msg, r.location)
+	}
+	return n, err
+}
+
+// Size passes through the size of the binary
+func (r *sqsReader) Size() int64 {
+	return sizeOf(r.Reader)
+}
+
+func (r *sqsReader) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
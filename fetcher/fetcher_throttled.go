@@ -0,0 +1,210 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+//Throttled wraps another fetcher and passes on at most one binary
+//per Cooldown, so a source updated in quick succession (e.g. by a
+//churning CI pipeline) can't restart the program each time. Binaries
+//fetched during the Cooldown are held back, the latest replacing any
+//previously held, and the latest is passed on once the Cooldown has
+//passed. Each binary passed on starts a new Cooldown.
+type Throttled struct {
+	//Fetcher retrieves the binary itself
+	Fetcher Interface
+	//Cooldown is the minimum time between binaries
+	Cooldown time.Duration
+	//internal state
+	ctx      context.Context
+	logger   Logger
+	last     time.Time
+	held     *tempFile
+	heldMeta Metadata
+	pending  chan throttledResult
+	version  string
+}
+
+type throttledResult struct {
+	r    io.Reader
+	meta Metadata
+	err  error
+}
+
+// Init validates the provided config and initialises the wrapped fetcher
+func (t *Throttled) Init() error {
+	if t.Fetcher == nil {
+		return errors.New("Fetcher required")
+	}
+	if t.Cooldown <= 0 {
+		return errors.New("Cooldown required")
+	}
+	return t.Fetcher.Init()
+}
+
+// SetContext passes ctx through to the wrapped fetcher
+func (t *Throttled) SetContext(ctx context.Context) {
+	t.ctx = ctx
+	if c, ok := t.Fetcher.(Cancellable); ok {
+		c.SetContext(ctx)
+	}
+}
+
+// SetLogger passes l through to the wrapped fetcher
+func (t *Throttled) SetLogger(l Logger) {
+	t.logger = l
+	if lg, ok := t.Fetcher.(Loggable); ok {
+		lg.SetLogger(l)
+	}
+}
+
+// Pin passes through to the wrapped fetcher
+func (t *Throttled) Pin(version string) {
+	if p, ok := t.Fetcher.(Pinnable); ok {
+		p.Pin(version)
+	}
+}
+
+// Trigger passes through to the wrapped fetcher, the
+// Cooldown of a held binary is not cut short
+func (t *Throttled) Trigger() {
+	if tr, ok := t.Fetcher.(Triggerable); ok {
+		tr.Trigger()
+	}
+}
+
+// Accepted passes through to the wrapped fetcher
+func (t *Throttled) Accepted() {
+	if a, ok := t.Fetcher.(Acceptable); ok {
+		a.Accepted()
+	}
+}
+
+// SetInterval passes through to the wrapped fetcher
+func (t *Throttled) SetInterval(d time.Duration) {
+	if a, ok := t.Fetcher.(Adjustable); ok {
+		a.SetInterval(d)
+	}
+}
+
+// NextPoll passes through to the wrapped fetcher
+func (t *Throttled) NextPoll() time.Time {
+	return nextPoll(t.Fetcher)
+}
+
+// Fetch the binary from the wrapped fetcher, holding it back
+// until the Cooldown since the last binary has passed
+func (t *Throttled) Fetch() (io.Reader, error) {
+	r, _, err := t.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata fetches the binary and its Metadata from the
+// wrapped fetcher, holding them back during the Cooldown
+func (t *Throttled) FetchMetadata() (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	//the wrapped fetcher keeps polling during the cooldown
+	if t.pending == nil {
+		pending := make(chan throttledResult, 1)
+		go func() {
+			r, meta, err := FetchMetadata(t.Fetcher)
+			pending <- throttledResult{r, meta, err}
+		}()
+		t.pending = pending
+	}
+	var cooledDown <-chan time.Time
+	if t.held != nil {
+		var stop func()
+		cooledDown, stop = newTimer(t.Cooldown - clk.Now().Sub(t.last))
+		defer stop()
+	}
+	ctx := t.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case res := <-t.pending:
+		t.pending = nil
+		if res.r == nil || res.err != nil {
+			return nil, none, res.err
+		}
+		if wait := t.Cooldown - clk.Now().Sub(t.last); wait > 0 {
+			if err := t.hold(res.r, res.meta); err != nil {
+				return nil, none, err
+			}
+			t.logf("binary held back for %s (Cooldown of %s)", wait.Round(time.Second), t.Cooldown)
+			return nil, none, nil
+		}
+		if t.held != nil {
+			//held, then replaced by this binary
+			t.held.Close()
+			t.held = nil
+		}
+		t.last = clk.Now()
+		t.version = res.meta.Version
+		return res.r, res.meta, nil
+	case <-cooledDown:
+		r, meta := t.held, t.heldMeta
+		t.held = nil
+		t.last = clk.Now()
+		t.version = meta.Version
+		t.logf("cooldown passed, passing on the held binary")
+		return r, meta, nil
+	case <-ctx.Done():
+		return nil, none, ctx.Err()
+	}
+}
+
+//hold spools r to a temp file, replacing the held binary
+func (t *Throttled) hold(r io.Reader, meta Metadata) error {
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	f, err := ioutil.TempFile("", "overseer-throttled-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file (%s)", err)
+	}
+	tmp := &tempFile{f}
+	if _, err := io.Copy(f, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to read binary (%w)", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to rewind temp file (%s)", err)
+	}
+	if t.held != nil {
+		t.held.Close()
+	}
+	if meta.Size < 0 {
+		if info, err := f.Stat(); err == nil {
+			meta.Size = info.Size()
+		}
+	}
+	t.held, t.heldMeta = tmp, meta
+	return nil
+}
+
+//logf reports a throttling event, it is a no-op without a logger
+func (t *Throttled) logf(f string, args ...interface{}) {
+	if t.logger != nil {
+		t.logger.Printf("[overseer fetcher] "+f, args...)
+	}
+}
+
+// Version returns the version of the last binary passed on, or
+// before any, the version reported by the wrapped fetcher
+func (t *Throttled) Version() string {
+	if t.version != "" {
+		return t.version
+	}
+	if ver, ok := t.Fetcher.(Versioned); ok {
+		return ver.Version()
+	}
+	return ""
+}
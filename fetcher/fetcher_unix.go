@@ -0,0 +1,119 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+//Unix fetches binaries from a local update daemon, serving HTTP over
+//the unix domain socket at Path, so update traffic never leaves the
+//device. The daemon is polled with HEAD requests for the binary at
+//Request, and it is downloaded with a GET request when its version
+//header changes. A daemon which isn't running (its socket is missing
+//or refuses connections) is skipped as no update.
+type Unix struct {
+	//Path of the daemon's socket
+	Path string
+	//Request is the path requested from the daemon, defaults to "/"
+	Request string
+	//VersionHeader identifies the binary served by the daemon, a
+	//new value is a new binary. Defaults to "ETag".
+	VersionHeader string
+	//Interval between checks
+	Interval time.Duration
+	//Jitter randomly offsets each Interval by up to +/- Jitter,
+	//spreading out the polls of a fleet sharing an Interval
+	Jitter time.Duration
+	//DelayFirstFetch waits an Interval before the first check too,
+	//rather than checking as soon as the fetcher starts
+	DelayFirstFetch bool
+	//Headers are added to every request
+	Headers http.Header
+	//AutoDecompress detects gzip, bzip2 and zstd compressed binaries
+	//by their magic bytes instead of relying on a .gz/.bz2/.zst suffix
+	AutoDecompress bool
+	//DownloadTimeout bounds each request, including reading the
+	//binary. Defaults to no timeout.
+	DownloadTimeout time.Duration
+	//internal state
+	http  HTTP
+	delay bool
+	intervalPoller
+}
+
+// Init validates the provided config
+func (u *Unix) Init() error {
+	if u.Path == "" {
+		return errors.New("Path required")
+	}
+	u.delay = u.DelayFirstFetch
+	if u.Request == "" {
+		u.Request = "/"
+	}
+	if u.VersionHeader == "" {
+		u.VersionHeader = "ETag"
+	}
+	if u.Interval == 0 {
+		u.Interval = 5 * time.Minute
+	}
+	//the host is ignored, every request dials the socket
+	u.http.URL = "http://unix" + u.Request
+	u.http.socket = u.Path
+	u.http.Headers = u.Headers
+	u.http.AutoDecompress = u.AutoDecompress
+	u.http.DownloadTimeout = u.DownloadTimeout
+	u.http.CheckHeaders = []string{u.VersionHeader}
+	return u.http.Init()
+}
+
+// SetContext sets the context used to cancel fetches
+func (u *Unix) SetContext(ctx context.Context) {
+	u.poller.SetContext(ctx)
+	u.http.SetContext(ctx)
+}
+
+// SetLogger sets the logger used to report fetch events
+func (u *Unix) SetLogger(l Logger) {
+	u.poller.SetLogger(l)
+	u.http.SetLogger(l)
+}
+
+// Fetch the binary from the daemon, when its version has changed
+func (u *Unix) Fetch() (io.Reader, error) {
+	//delay fetches after first
+	if u.delay {
+		if err := u.waitInterval(u.Interval, u.Jitter); err != nil {
+			return nil, err
+		}
+	}
+	u.delay = true
+	u.http.delay = false
+	r, err := u.http.Fetch()
+	if err != nil && daemonDown(err) {
+		u.logf("update daemon at %s is down (%s), skipping", u.Path, err)
+		return nil, nil //skip, try again later
+	}
+	return r, err
+}
+
+//daemonDown returns whether err is the result of the daemon's
+//socket being closed, a failed dial covers refused connections on
+//all platforms (there's no ECONNREFUSED on plan9)
+func daemonDown(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOENT)
+}
+
+// Version returns the version header of the last fetched binary
+func (u *Unix) Version() string {
+	return u.http.Version()
+}
@@ -0,0 +1,187 @@
+package fetcher
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+//Verified wraps another fetcher and rejects any binary
+//whose detached signature does not validate against
+//PublicKey. Signatures cover the binary's digest, so
+//each new binary is streamed to a temp file while it is
+//hashed, then returned once verified.
+type Verified struct {
+	//Fetcher retrieves the binary itself
+	Fetcher Interface
+	//PublicKey must be an ed25519.PublicKey or an *rsa.PublicKey.
+	//Ed25519 signatures are expected to be Ed25519ph, over the
+	//SHA-512 of the binary (i.e. ed25519.PrivateKey.Sign with
+	//crypto.SHA512 as its opts). RSA signatures are expected to
+	//be PKCS #1 v1.5 over SHA-256.
+	PublicKey crypto.PublicKey
+	//Signature is called after each new binary is fetched and
+	//should return its detached signature (e.g. by fetching
+	//the binary's URL with a ".sig" suffix).
+	Signature func() ([]byte, error)
+}
+
+// Init validates the provided config and initialises the wrapped fetcher
+func (v *Verified) Init() error {
+	if v.Fetcher == nil {
+		return errors.New("Fetcher required")
+	}
+	if v.Signature == nil {
+		return errors.New("Signature required")
+	}
+	switch v.PublicKey.(type) {
+	case ed25519.PublicKey, *rsa.PublicKey:
+	case nil:
+		return errors.New("PublicKey required")
+	default:
+		return fmt.Errorf("unsupported PublicKey type %T", v.PublicKey)
+	}
+	return v.Fetcher.Init()
+}
+
+// SetContext passes ctx through to the wrapped fetcher
+func (v *Verified) SetContext(ctx context.Context) {
+	if c, ok := v.Fetcher.(Cancellable); ok {
+		c.SetContext(ctx)
+	}
+}
+
+// SetLogger passes l through to the wrapped fetcher
+func (v *Verified) SetLogger(l Logger) {
+	if lg, ok := v.Fetcher.(Loggable); ok {
+		lg.SetLogger(l)
+	}
+}
+
+// Pin passes through to the wrapped fetcher
+func (v *Verified) Pin(version string) {
+	if p, ok := v.Fetcher.(Pinnable); ok {
+		p.Pin(version)
+	}
+}
+
+// Trigger passes through to the wrapped fetcher
+func (v *Verified) Trigger() {
+	if t, ok := v.Fetcher.(Triggerable); ok {
+		t.Trigger()
+	}
+}
+
+// Accepted passes through to the wrapped fetcher
+func (v *Verified) Accepted() {
+	if a, ok := v.Fetcher.(Acceptable); ok {
+		a.Accepted()
+	}
+}
+
+// SetInterval passes through to the wrapped fetcher
+func (v *Verified) SetInterval(d time.Duration) {
+	if a, ok := v.Fetcher.(Adjustable); ok {
+		a.SetInterval(d)
+	}
+}
+
+// NextPoll passes through to the wrapped fetcher
+func (v *Verified) NextPoll() time.Time {
+	return nextPoll(v.Fetcher)
+}
+
+// Fetch the binary from the wrapped fetcher and verify its signature
+func (v *Verified) Fetch() (io.Reader, error) {
+	r, _, err := v.FetchMetadata()
+	return r, err
+}
+
+// FetchMetadata fetches the binary and its Metadata from the
+// wrapped fetcher and verifies its signature, the binary is
+// unchanged so its Metadata is passed through
+func (v *Verified) FetchMetadata() (io.Reader, Metadata, error) {
+	none := Metadata{Size: -1, Rollout: -1}
+	r, meta, err := FetchMetadata(v.Fetcher)
+	if r == nil || err != nil {
+		return r, none, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	r, err = v.verify(r)
+	if err != nil {
+		return nil, none, err
+	}
+	return r, meta, nil
+}
+
+//verify spools the binary to a temp file while hashing it,
+//then checks the signature of its digest
+func (v *Verified) verify(r io.Reader) (io.Reader, error) {
+	var h hash.Hash
+	switch v.PublicKey.(type) {
+	case ed25519.PublicKey:
+		h = sha512.New()
+	default:
+		h = sha256.New()
+	}
+	f, err := ioutil.TempFile("", "overseer-verified-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file (%s)", err)
+	}
+	tmp := &tempFile{f}
+	if _, err := io.Copy(f, io.TeeReader(r, h)); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to read binary (%w)", err)
+	}
+	sig, err := v.Signature()
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to get signature (%w)", err)
+	}
+	switch key := v.PublicKey.(type) {
+	case ed25519.PublicKey:
+		err = ed25519.VerifyWithOptions(key, h.Sum(nil), sig, &ed25519.Options{Hash: crypto.SHA512})
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, h.Sum(nil), sig)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("signature verification failed (%s)", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to rewind temp file (%s)", err)
+	}
+	return tmp, nil
+}
+
+//tempFile removes itself once closed
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	err := t.File.Close()
+	os.Remove(t.Name())
+	return err
+}
+
+// Version returns the version reported by the wrapped fetcher
+func (v *Verified) Version() string {
+	if ver, ok := v.Fetcher.(Versioned); ok {
+		return ver.Version()
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+package fetcher
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"io"
+	"runtime"
+	"testing"
+)
+
+//largeBinary is a fake binary of size bytes, generated as it is read
+type largeBinary struct {
+	size, read int64
+}
+
+func (b *largeBinary) Read(p []byte) (int, error) {
+	if b.read >= b.size {
+		return 0, io.EOF
+	}
+	if rest := b.size - b.read; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	for i := range p {
+		p[i] = byte((b.read + int64(i)) * 31)
+	}
+	b.read += int64(len(p))
+	return len(p), nil
+}
+
+//largeFetcher returns a new largeBinary on each Fetch
+type largeFetcher struct {
+	size int64
+}
+
+func (f *largeFetcher) Init() error { return nil }
+
+func (f *largeFetcher) Fetch() (io.Reader, error) {
+	return &largeBinary{size: f.size}, nil
+}
+
+//digest hashes a largeBinary of size bytes
+func digest(h hash.Hash, size int64) []byte {
+	io.Copy(h, &largeBinary{size: size})
+	return h.Sum(nil)
+}
+
+func TestVerifiedStreamsLargeBinaries(t *testing.T) {
+	const size = 256 << 20
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSig, err := edPriv.Sign(nil, digest(sha512.New(), size), crypto.SHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaPriv, crypto.SHA256, digest(sha256.New(), size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		key  crypto.PublicKey
+		sig  []byte
+	}{
+		{"ed25519", edPub, edSig},
+		{"rsa", &rsaPriv.PublicKey, rsaSig},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := &Verified{
+				Fetcher:   &largeFetcher{size: size},
+				PublicKey: tc.key,
+				Signature: func() ([]byte, error) { return tc.sig, nil },
+			}
+			if err := v.Init(); err != nil {
+				t.Fatal(err)
+			}
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			r, err := v.Fetch()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.(io.Closer).Close()
+			runtime.ReadMemStats(&after)
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/4 {
+				t.Fatalf("allocated %d bytes verifying a %d byte binary", alloc, size)
+			}
+			n, err := io.Copy(io.Discard, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != size {
+				t.Fatalf("read %d bytes, expected %d", n, size)
+			}
+		})
+	}
+}
+
+func TestVerifiedRejectsBadSignatures(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 1 << 20
+	sig, err := other.Sign(nil, digest(sha512.New(), size), crypto.SHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verified{
+		Fetcher:   &largeFetcher{size: size},
+		PublicKey: pub,
+		Signature: func() ([]byte, error) { return sig, nil },
+	}
+	if err := v.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := v.Fetch(); err == nil {
+		r.(io.Closer).Close()
+		t.Fatal("expected signature verification to fail")
+	}
+}
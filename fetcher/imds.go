@@ -0,0 +1,143 @@
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//awsCredentials sign AWS requests
+type awsCredentials struct {
+	accessKeyID, secretAccessKey, sessionToken string
+	//expires is zero for static credentials
+	expires time.Time
+}
+
+//instanceProfile provides the credentials of an EC2 instance's
+//role from the instance metadata service. It uses IMDSv2 session
+//tokens, falling back to IMDSv1 where tokens are unavailable.
+type instanceProfile struct {
+	endpoint string
+	client   *http.Client
+	mux      sync.Mutex
+	creds    awsCredentials
+}
+
+func newInstanceProfile() *instanceProfile {
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	return &instanceProfile{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		//the service is link-local, never proxied
+		client: &http.Client{
+			Transport: &http.Transport{},
+			Timeout:   5 * time.Second,
+		},
+	}
+}
+
+//credentials returns the role's credentials, they are
+//refreshed 5 minutes before they expire
+func (p *instanceProfile) credentials(ctx context.Context) (awsCredentials, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.creds.accessKeyID != "" && time.Until(p.creds.expires) > 5*time.Minute {
+		return p.creds, nil
+	}
+	token, err := p.token(ctx)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role, err := p.get(ctx, token, "/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance profile not found (%w)", err)
+	}
+	//the first listed role
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	b, err := p.get(ctx, token, "/latest/meta-data/iam/security-credentials/"+role)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance profile credentials failed (%w)", err)
+	}
+	c := struct {
+		Code            string    `json:"Code"`
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}{}
+	if err := json.Unmarshal([]byte(b), &c); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid instance profile credentials (%s)", err)
+	}
+	if c.Code != "Success" || c.AccessKeyID == "" {
+		return awsCredentials{}, errorf(ErrAuth, "instance profile credentials unavailable (%s)", c.Code)
+	}
+	p.creds = awsCredentials{
+		accessKeyID:     c.AccessKeyID,
+		secretAccessKey: c.SecretAccessKey,
+		sessionToken:    c.Token,
+		expires:         c.Expiration,
+	}
+	return p.creds, nil
+}
+
+//token starts an IMDSv2 session, it is empty when the
+//service only supports IMDSv1
+func (p *instanceProfile) token(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", p.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("instance metadata service unavailable (%w)", transient(err))
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("failed to read IMDS token (%w)", transient(err))
+		}
+		return string(b), nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return "", nil //IMDSv1
+	}
+	return "", &statusError{"IMDS token", resp.StatusCode}
+}
+
+//get reads a metadata path
+func (p *instanceProfile) get(ctx context.Context, token, path string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.endpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", transient(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &statusError{"IMDS", resp.StatusCode}
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", transient(err)
+	}
+	if len(b) == 0 {
+		return "", errors.New("empty response")
+	}
+	return string(b), nil
+}
@@ -0,0 +1,82 @@
+package fetcher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+//contentMD5 returns the MD5 declared by the Content-MD5 header or,
+//as with S3 compatible storage, by an ETag holding a plain MD5. Weak
+//and multipart ETags (with a "-<parts>" suffix) aren't an MD5 of the
+//body, so nil is returned when neither is available.
+func contentMD5(header http.Header) []byte {
+	if v := header.Get("Content-MD5"); v != "" {
+		if sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v)); err == nil && len(sum) == md5.Size {
+			return sum
+		}
+	}
+	etag := strings.TrimSpace(header.Get("ETag"))
+	if strings.HasPrefix(etag, "W/") || strings.Contains(etag, "-") {
+		return nil
+	}
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 2*md5.Size {
+		return nil
+	}
+	sum, err := hex.DecodeString(etag)
+	if err != nil {
+		return nil
+	}
+	return sum
+}
+
+//md5ReadCloser hashes the body as it is read and
+//fails the final read if it doesn't match expected
+type md5ReadCloser struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+	size     int64
+	//mismatch is called once the body fails the check
+	mismatch func()
+}
+
+//verifyMD5 wraps rc with an MD5 check, when header declares one
+func verifyMD5(rc io.ReadCloser, header http.Header, mismatch func()) io.ReadCloser {
+	expected := contentMD5(header)
+	if expected == nil {
+		return rc
+	}
+	return &md5ReadCloser{
+		ReadCloser: rc,
+		hash:       md5.New(),
+		expected:   expected,
+		size:       sizeOf(rc),
+		mismatch:   mismatch,
+	}
+}
+
+func (m *md5ReadCloser) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	m.hash.Write(p[:n])
+	if err == io.EOF {
+		if sum := m.hash.Sum(nil); !bytes.Equal(sum, m.expected) {
+			if m.mismatch != nil {
+				m.mismatch()
+				m.mismatch = nil
+			}
+			return n, errorf(ErrTransient, "MD5 mismatch (expected %x, got %x)", m.expected, sum)
+		}
+	}
+	return n, err
+}
+
+func (m *md5ReadCloser) Size() int64 {
+	return m.size
+}
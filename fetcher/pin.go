@@ -0,0 +1,24 @@
+package fetcher
+
+import "sync"
+
+//pinner can be embedded into fetchers
+//to implement the Pinnable interface
+type pinner struct {
+	mu      sync.Mutex
+	version string
+}
+
+// Pin makes the fetcher fetch exactly version, an empty
+// version resumes fetching the latest version
+func (p *pinner) Pin(version string) {
+	p.mu.Lock()
+	p.version = version
+	p.mu.Unlock()
+}
+
+func (p *pinner) pinned() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version
+}
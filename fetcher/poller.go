@@ -0,0 +1,189 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//poller can be embedded into fetchers to implement
+//the Cancellable, Loggable and Triggerable interfaces
+type poller struct {
+	ctx      context.Context
+	logger   Logger
+	wakeOnce sync.Once
+	wakeCh   chan bool
+}
+
+//intervalPoller is the poller of fetchers which poll
+//at an Interval, it also implements Adjustable
+type intervalPoller struct {
+	poller
+	interval   int64 //set by SetInterval
+	next       int64 //see NextPoll
+	adjustOnce sync.Once
+	adjustCh   chan bool
+}
+
+// SetContext sets the context used to cancel fetches
+func (p *poller) SetContext(ctx context.Context) {
+	p.ctx = ctx
+}
+
+// SetLogger sets the logger used to report fetch events
+func (p *poller) SetLogger(l Logger) {
+	p.logger = l
+}
+
+//logf reports a fetch event, it is a no-op without a logger
+func (p *poller) logf(f string, args ...interface{}) {
+	if p.logger != nil {
+		p.logger.Printf("[overseer fetcher] "+f, args...)
+	}
+}
+
+// Trigger wakes a fetcher waiting for its next interval
+func (p *poller) Trigger() {
+	select {
+	case p.wake() <- true:
+	default: //not waiting
+	}
+}
+
+// SetInterval overrides the fetcher's Interval, see Adjustable
+func (p *intervalPoller) SetInterval(d time.Duration) {
+	atomic.StoreInt64(&p.interval, int64(d))
+	select {
+	case p.adjusted() <- true:
+	default: //not waiting
+	}
+}
+
+// NextPoll returns when the fetcher next polls, see Scheduled
+func (p *intervalPoller) NextPoll() time.Time {
+	if n := atomic.LoadInt64(&p.next); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+//setNextPoll records the time of the next poll, see NextPoll
+func (p *intervalPoller) setNextPoll(t time.Time) {
+	n := int64(0)
+	if !t.IsZero() {
+		n = t.UnixNano()
+	}
+	atomic.StoreInt64(&p.next, n)
+}
+
+//every returns the interval set by SetInterval, or d
+func (p *intervalPoller) every(d time.Duration) time.Duration {
+	if i := atomic.LoadInt64(&p.interval); i != 0 {
+		return time.Duration(i)
+	}
+	return d
+}
+
+//fetchOnce initialises f, sharing the context and logger,
+//then fetches a single binary with it
+func (p *poller) fetchOnce(f Interface) (io.Reader, error) {
+	if c, ok := f.(Cancellable); ok {
+		c.SetContext(p.context())
+	}
+	if l, ok := f.(Loggable); ok && p.logger != nil {
+		l.SetLogger(p.logger)
+	}
+	if err := f.Init(); err != nil {
+		return nil, fmt.Errorf("fetcher init failed (%w)", err)
+	}
+	return f.Fetch()
+}
+
+func (p *poller) context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+func (p *intervalPoller) adjusted() chan bool {
+	p.adjustOnce.Do(func() {
+		p.adjustCh = make(chan bool, 1)
+	})
+	return p.adjustCh
+}
+
+func (p *poller) wake() chan bool {
+	p.wakeOnce.Do(func() {
+		p.wakeCh = make(chan bool)
+	})
+	return p.wakeCh
+}
+
+//wait blocks for the interval d, returning early
+//when triggered or with an error when cancelled.
+//A negative d (see Manual) only returns when triggered.
+func (p *poller) wait(d time.Duration) error {
+	_, err := p.pause(d, nil)
+	return err
+}
+
+//waitRequest delays a request by a random duration of up to j,
+//unlike the Jitter of an Interval, this spreads out requests
+//which are made at the same moment (e.g. triggered fetches)
+func (p *poller) waitRequest(j time.Duration) error {
+	if j <= 0 {
+		return nil
+	}
+	return sleep(p.context(), time.Duration(rand.Int63n(int64(j))))
+}
+
+//waitInterval waits for the next poll, interval is the configured
+//Interval (unless overridden by SetInterval) offset by up to +/- j.
+//The wait is recalculated when the interval is changed.
+func (p *intervalPoller) waitInterval(interval, j time.Duration) error {
+	start := clk.Now()
+	for {
+		d := jitter(p.every(interval), j)
+		if d >= 0 {
+			if d -= clk.Now().Sub(start); d < 0 {
+				d = 0
+			}
+			p.setNextPoll(clk.Now().Add(d))
+		} else {
+			p.setNextPoll(time.Time{}) //only when triggered
+		}
+		adjusted, err := p.pause(d, p.adjusted())
+		if !adjusted {
+			if err == nil {
+				p.setNextPoll(clk.Now()) //polling
+			}
+			return err
+		}
+	}
+}
+
+//pause is wait, it also returns early (and true)
+//when adjusted is signalled
+func (p *poller) pause(d time.Duration, adjusted chan bool) (bool, error) {
+	ctx := p.context()
+	var slept <-chan time.Time
+	if d >= 0 {
+		var stop func()
+		slept, stop = newTimer(d)
+		defer stop()
+	}
+	select {
+	case <-slept:
+	case <-p.wake():
+	case <-adjusted:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	return false, nil
+}
@@ -0,0 +1,96 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+//downloadRanges downloads the size bytes of the binary into a
+//temp file, using h.Concurrency parallel ranged GET requests of
+//h.PartSize bytes. When etag is set, parts are only accepted from
+//that version of the binary.
+func (h *HTTP) downloadRanges(size int64, etag string) (io.ReadCloser, error) {
+	f, err := ioutil.TempFile("", "overseer-ranged-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file (%s)", err)
+	}
+	tmp := &tempFile{f}
+	ctx, cancel := context.WithCancel(h.context())
+	defer cancel()
+	starts := make(chan int64)
+	go func() {
+		defer close(starts)
+		for start := int64(0); start < size; start += h.PartSize {
+			select {
+			case starts <- start:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < h.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range starts {
+				end := start + h.PartSize - 1
+				if end >= size {
+					end = size - 1
+				}
+				if err := h.downloadRange(ctx, f, start, end, etag); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		tmp.Close()
+		return nil, firstErr
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to rewind temp file (%s)", err)
+	}
+	return tmp, nil
+}
+
+//downloadRange writes the bytes start-end (inclusive) to w
+func (h *HTTP) downloadRange(ctx context.Context, w io.WriterAt, start, end int64, etag string) error {
+	req, err := h.newRequest("GET")
+	if err != nil {
+		return fmt.Errorf("GET request failed (%w)", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	resp, err := do(h.client, req, h.DownloadTimeout)
+	if err != nil {
+		return fmt.Errorf("GET request failed (%w)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return &statusError{"ranged GET", resp.StatusCode}
+	}
+	n, err := io.Copy(io.NewOffsetWriter(w, start), resp.Body)
+	if err != nil {
+		return fmt.Errorf("ranged GET failed (%w)", err)
+	}
+	if n != end-start+1 {
+		return fmt.Errorf("ranged GET failed (got %d of %d bytes)", n, end-start+1)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package fetcher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//resumeState is saved next to the ResumeFile, identifying
+//the binary which is partially downloaded
+type resumeState struct {
+	Validator string `json:"validator"`
+	Size      int64  `json:"size"`
+}
+
+//resumable returns the validator (a strong ETag or the Last-Modified
+//time) of the binary described by header, or "" when its download
+//can't be resumed
+func resumable(header http.Header, size int64) string {
+	if size <= 0 || header.Get("Accept-Ranges") != "bytes" {
+		return ""
+	}
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+//resume downloads the binary described by header into the ResumeFile,
+//continuing from its last byte when it holds part of the same binary.
+//body is an already requested response of the entire binary, or nil.
+//An interrupted download is kept for the next poll, which resumes it.
+func (h *HTTP) resume(header http.Header, size int64, body io.ReadCloser, prev map[string]string) (io.ReadCloser, error) {
+	validator := resumable(header, size)
+	statePath := h.ResumeFile + ".state"
+	f, err := os.OpenFile(h.ResumeFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return nil, fmt.Errorf("failed to open resume file (%s)", err)
+	}
+	partial := &resumeFile{File: f, state: statePath}
+	offset := int64(0)
+	st := resumeState{}
+	if loadState(statePath, &st) && st == (resumeState{validator, size}) {
+		if info, err := f.Stat(); err == nil && info.Size() <= size {
+			offset = info.Size()
+		}
+	}
+	if offset > 0 && body != nil {
+		body.Close()
+		body = nil
+	}
+	if offset == 0 {
+		if err := saveState(statePath, resumeState{validator, size}); err != nil {
+			h.logf("failed to save resume state (%s)", err)
+		}
+	}
+	if offset < size {
+		if body == nil {
+			if offset > 0 {
+				h.logf("resuming %s at %d of %d bytes", h.URL, offset, size)
+			}
+			if body, offset, err = h.requestFrom(offset, validator); err != nil {
+				f.Close()
+				h.mismatch(prev)()
+				return nil, err
+			}
+		}
+		if err := f.Truncate(offset); err != nil {
+			body.Close()
+			partial.Close()
+			return nil, fmt.Errorf("failed to truncate resume file (%s)", err)
+		}
+		_, err := f.Seek(offset, io.SeekStart)
+		if err == nil {
+			var n int64
+			n, err = io.Copy(f, body)
+			if err == nil && offset+n != size {
+				err = fmt.Errorf("got %d of %d bytes", offset+n, size)
+			}
+		}
+		body.Close()
+		f.Sync()
+		if err != nil {
+			f.Close()
+			h.mismatch(prev)()
+			return nil, transient(fmt.Errorf("download interrupted, resuming on the next poll (%w)", err))
+		}
+	}
+	//verify the assembled binary before it is used
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		partial.Close()
+		return nil, fmt.Errorf("failed to rewind resume file (%s)", err)
+	}
+	if expected := contentMD5(header); expected != nil {
+		hash := md5.New()
+		if _, err := io.Copy(hash, f); err != nil {
+			f.Close()
+			h.mismatch(prev)()
+			return nil, fmt.Errorf("failed to read resume file (%s)", err)
+		}
+		if sum := hash.Sum(nil); !bytes.Equal(sum, expected) {
+			partial.Close()
+			h.mismatch(prev)()
+			return nil, errorf(ErrTransient, "MD5 mismatch (expected %x, got %x)", expected, sum)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			partial.Close()
+			return nil, fmt.Errorf("failed to rewind resume file (%s)", err)
+		}
+	}
+	return partial, nil
+}
+
+//requestFrom requests the binary from offset, returning the offset
+//of the response body, which is 0 if the server sent the entire binary
+func (h *HTTP) requestFrom(offset int64, validator string) (io.ReadCloser, int64, error) {
+	req, err := h.newRequest("GET")
+	if err != nil {
+		return nil, 0, fmt.Errorf("GET request failed (%w)", err)
+	}
+	//a ranged request, even from 0, so the transport
+	//never transparently decompresses the binary
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", validator)
+	resp, err := do(h.client, req, h.DownloadTimeout)
+	if err != nil {
+		return nil, 0, transient(fmt.Errorf("GET request failed (%w)", err))
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, offset, nil
+	case http.StatusOK:
+		return resp.Body, 0, nil
+	}
+	resp.Body.Close()
+	return nil, 0, &statusError{"ranged GET", resp.StatusCode}
+}
+
+//resumeFile is a completed download, closing it
+//removes the ResumeFile and its state
+type resumeFile struct {
+	*os.File
+	state string
+}
+
+func (r *resumeFile) Close() error {
+	err := r.File.Close()
+	os.Remove(r.Name())
+	os.Remove(r.state)
+	return err
+}
@@ -0,0 +1,158 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TransportOptions tune the connections of a fetcher, e.g. for flaky
+// mobile or edge links where a stalled connection should fail fast.
+// Zero values use the defaults of http.DefaultTransport.
+type TransportOptions struct {
+	//DialTimeout bounds establishing each connection, defaults to 30s
+	DialTimeout time.Duration
+	//KeepAlive is the interval of TCP keepalive probes, which detect
+	//dead connections, defaults to 30s. -1 disables the probes.
+	KeepAlive time.Duration
+	//TLSHandshakeTimeout bounds each TLS handshake, defaults to 10s
+	TLSHandshakeTimeout time.Duration
+	//ResponseHeaderTimeout bounds the wait for the response headers
+	//once a request is sent, defaults to no timeout
+	ResponseHeaderTimeout time.Duration
+	//IdleConnTimeout closes connections left idle between requests,
+	//defaults to 90s. -1 disables reusing connections, so each
+	//request dials a new connection.
+	IdleConnTimeout time.Duration
+}
+
+//newClient returns an http.Client which routes requests through
+//proxy, or when empty, the HTTP_PROXY/HTTPS_PROXY environment.
+//When cert is set, it is presented to servers requesting a client
+//certificate. When roots is set, it replaces the system roots.
+func newClient(proxy string, cert *tls.Certificate, roots *x509.CertPool, opts TransportOptions) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.DialTimeout > 0 || opts.KeepAlive != 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		if opts.DialTimeout > 0 {
+			dialer.Timeout = opts.DialTimeout
+		}
+		if opts.KeepAlive != 0 {
+			dialer.KeepAlive = opts.KeepAlive
+		}
+		t.DialContext = dialer.DialContext
+	}
+	if opts.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	}
+	if opts.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	}
+	if opts.IdleConnTimeout < 0 {
+		t.DisableKeepAlives = true
+	} else if opts.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Proxy (%s)", err)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if cert != nil || roots != nil {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+	}
+	if cert != nil {
+		t.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	if roots != nil {
+		t.TLSClientConfig.RootCAs = roots
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+//clientCertificate loads a PEM encoded certificate and key pair,
+//from files or raw bytes. It returns nil when neither are set.
+func clientCertificate(certFile, keyFile string, certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case certFile != "" || keyFile != "":
+		if certPEM != nil || keyPEM != nil {
+			return nil, errors.New("client certificate files and PEM bytes cannot both be set")
+		}
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	case certPEM != nil || keyPEM != nil:
+		cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate (%s)", err)
+	}
+	return &cert, nil
+}
+
+//rootPool parses a bundle of PEM encoded root certificates,
+//it returns nil (the system roots) when the bundle is empty
+func rootPool(bundle []byte) (*x509.CertPool, error) {
+	if len(bundle) == 0 {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("invalid RootCAs (no PEM certificates found)")
+	}
+	return pool, nil
+}
+
+//do sends req with client, when timeout is set it bounds both
+//the request and reading its response body. Closing the body
+//releases the timer. Failed requests match ErrTransient.
+func do(client *http.Client, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		resp, err := client.Do(req)
+		return resp, transient(err)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errorf(ErrTransient, "timed out after %s", timeout)
+		}
+		return nil, transient(err)
+	}
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, timeout: timeout}
+	return resp, nil
+}
+
+type timeoutBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+func (t *timeoutBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && t.ctx.Err() == context.DeadlineExceeded {
+		err = errorf(ErrTransient, "download timed out after %s", t.timeout)
+	}
+	return n, err
+}
+
+func (t *timeoutBody) Close() error {
+	defer t.cancel()
+	return t.ReadCloser.Close()
+}
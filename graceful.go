@@ -23,10 +23,15 @@ type overseerListener struct {
 	net.Listener
 	closeError   error
 	closeByForce chan bool
+	releaseOnce  sync.Once
+	acceptMux    sync.RWMutex
 	wg           sync.WaitGroup
 }
 
 func (l *overseerListener) Accept() (net.Conn, error) {
+	//held until the connection is tracked, see release
+	l.acceptMux.RLock()
+	defer l.acceptMux.RUnlock()
 	conn, err := l.Listener.(*net.TCPListener).AcceptTCP()
 	if err != nil {
 		return nil, err
@@ -36,8 +41,9 @@ func (l *overseerListener) Accept() (net.Conn, error) {
 	uconn := overseerConn{
 		Conn:   conn,
 		wg:     &l.wg,
-		closed: make(chan bool),
+		closed: make(chan bool, 1),
 	}
+	l.wg.Add(1)
 	go func() {
 		//connection watcher
 		select {
@@ -47,28 +53,36 @@ func (l *overseerListener) Accept() (net.Conn, error) {
 			//closed manually
 		}
 	}()
-	l.wg.Add(1)
 	return uconn, nil
 }
 
-//non-blocking trigger close
+//non-blocking trigger close, only the first call has any effect
 func (l *overseerListener) release(timeout time.Duration) {
-	//stop accepting connections - release fd
-	l.closeError = l.Listener.Close()
-	//start timer, close by force if deadline not met
-	waited := make(chan bool)
-	go func() {
-		l.wg.Wait()
-		waited <- true
-	}()
-	go func() {
-		select {
-		case <-time.After(timeout):
-			close(l.closeByForce)
-		case <-waited:
-			//no need to force close
+	l.releaseOnce.Do(func() {
+		//stop accepting connections - release fd
+		l.closeError = l.Listener.Close()
+		//connections accepted as it closed are
+		//tracked before waiting on them
+		l.acceptMux.Lock()
+		l.acceptMux.Unlock()
+		if timeout < 0 {
+			return //never close by force
 		}
-	}()
+		//start timer, close by force if deadline not met
+		waited := make(chan bool)
+		go func() {
+			l.wg.Wait()
+			waited <- true
+		}()
+		go func() {
+			select {
+			case <-time.After(timeout):
+				close(l.closeByForce)
+			case <-waited:
+				//no need to force close
+			}
+		}()
+	})
 }
 
 //blocking wait for close
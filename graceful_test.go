@@ -0,0 +1,262 @@
+// +build linux darwin
+
+package overseer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//envRestartTest runs the test binary as an overseer
+//program listening on its address (see TestMain),
+//optionally restarted by the envRestartSignal number
+const (
+	envRestartTest   = "OVERSEER_TEST_RESTART_ADDR"
+	envRestartSignal = "OVERSEER_TEST_RESTART_SIGNAL"
+)
+
+func TestMain(m *testing.M) {
+	if addr := os.Getenv(envRestartTest); addr != "" {
+		c := Config{
+			Program:      restartTestProgram,
+			Address:      addr,
+			DrainTimeout: 10 * time.Second,
+			NoWarn:       true,
+		}
+		if n, err := strconv.Atoi(os.Getenv(envRestartSignal)); err == nil {
+			c.RestartSignal = syscall.Signal(n)
+		}
+		Run(c)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+//restartTestProgram serves slow requests, answering
+//with the pid of the process serving them
+func restartTestProgram(state State) {
+	http.Serve(state.Listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintf(w, "%d", os.Getpid())
+	}))
+}
+
+//freeAddr returns a free address on 127.0.0.1
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+//startOverseer runs the test binary bin as an overseer master process
+//with env (see TestMain), which is terminated once t has finished
+func startOverseer(t *testing.T, bin string, env ...string) *exec.Cmd {
+	out := &bytes.Buffer{}
+	master := exec.Command(bin)
+	master.Env = append(os.Environ(), env...)
+	master.Stdout = out
+	master.Stderr = out
+	if err := master.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		master.Process.Signal(syscall.SIGTERM)
+		master.Wait()
+		if t.Failed() {
+			t.Logf("overseer output:\n%s", out)
+		}
+	})
+	return master
+}
+
+//a new connection for each request, so each restart
+//has connections arriving, accepted and in-flight
+var testClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true},
+	Timeout:   30 * time.Second,
+}
+
+//getPid requests the pid of the program serving on addr
+func getPid(addr string) (string, error) {
+	resp, err := testClient.Get("http://" + addr)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return string(b), err
+}
+
+//awaitPid waits for the program to serve on addr
+func awaitPid(t *testing.T, addr string) string {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if pid, err := getPid(addr); err == nil {
+			return pid
+		}
+	}
+	t.Fatal("program never served")
+	return ""
+}
+
+//awaitRestart requests pids from addr until a process
+//other than pid serves, failing t if any request fails
+func awaitRestart(t *testing.T, addr, pid string) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		next, err := getPid(addr)
+		if err != nil {
+			t.Fatalf("request failed during the restart: %s", err)
+		}
+		if next != pid {
+			return
+		}
+	}
+	t.Fatalf("program %s wasn't restarted", pid)
+}
+
+func TestNoConnectionDroppedAcrossRestarts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts overseer processes")
+	}
+	addr := freeAddr(t)
+	master := startOverseer(t, os.Args[0], envRestartTest+"="+addr)
+	awaitPid(t, addr)
+	var mut sync.Mutex
+	served := 0
+	pids := map[string]bool{}
+	errs := []string{}
+	stop := make(chan bool)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				pid, err := getPid(addr)
+				mut.Lock()
+				if err != nil {
+					errs = append(errs, err.Error())
+				} else {
+					served++
+					pids[pid] = true
+				}
+				mut.Unlock()
+			}
+		}()
+	}
+	const restarts = 3
+	for i := 0; i < restarts; i++ {
+		time.Sleep(time.Second)
+		if err := master.Process.Signal(syscall.SIGUSR2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+	if len(errs) > 0 {
+		t.Fatalf("%d of %d requests failed across %d restarts: %s", len(errs), served+len(errs), restarts, strings.Join(errs, ", "))
+	}
+	if len(pids) != restarts+1 {
+		t.Fatalf("requests were served by %d processes, expected %d", len(pids), restarts+1)
+	}
+	t.Logf("%d requests served by %d processes", served, len(pids))
+}
+
+func TestRestartSignalRestarts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts overseer processes")
+	}
+	addr := freeAddr(t)
+	master := startOverseer(t, os.Args[0],
+		envRestartTest+"="+addr,
+		envRestartSignal+"="+strconv.Itoa(int(syscall.SIGHUP)))
+	pid := awaitPid(t, addr)
+	if err := master.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	//the program keeps serving while it is replaced
+	awaitRestart(t, addr, pid)
+}
+
+func TestIPv6ListenerInherited(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts overseer processes")
+	}
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	master := startOverseer(t, os.Args[0], envRestartTest+"=tcp6://"+addr)
+	pid := awaitPid(t, addr)
+	if err := master.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	//the restarted program serves the inherited socket on ::1
+	awaitRestart(t, addr, pid)
+}
+
+//copyTestBinary writes a copy of the test binary to path,
+//leaving it open for writing
+func copyTestBinary(t *testing.T, path string) *os.File {
+	src, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := io.Copy(f, src); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRunningBinaryReplaced(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts overseer processes")
+	}
+	bin := t.TempDir() + "/app"
+	copyTestBinary(t, bin).Close()
+	addr := freeAddr(t)
+	master := startOverseer(t, bin, envRestartTest+"="+addr)
+	pid := awaitPid(t, addr)
+	//rename a new binary over the running one, like an upgrade, though
+	//it's still open for writing, so starting it fails with ETXTBSY on
+	//linux and a copy of it is started instead
+	copyTestBinary(t, bin+".new")
+	if err := os.Rename(bin+".new", bin); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	awaitRestart(t, addr, pid)
+}
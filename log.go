@@ -0,0 +1,128 @@
+package overseer
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+//kinds of lifecycle events, the "event" of records (see Config.LogHandler)
+const (
+	eventFetch    = "fetch"
+	eventSkip     = "skip"
+	eventDownload = "download"
+	eventValidate = "validate"
+	eventUpgrade  = "upgrade"
+	eventRestart  = "restart"
+	eventRollback = "rollback"
+	eventError    = "error"
+)
+
+//logRecord passes a record of msg from component to h, the
+//version (when set) correlates the records of a binary
+func logRecord(h slog.Handler, level slog.Level, component, version, msg string, attrs ...slog.Attr) {
+	ctx := context.Background()
+	if !h.Enabled(ctx, level) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	r.AddAttrs(slog.String("component", component))
+	if version != "" {
+		r.AddAttrs(slog.String("version", version))
+	}
+	r.AddAttrs(attrs...)
+	h.Handle(ctx, r)
+}
+
+//handlerLogger passes the logs of the fetcher to a LogHandler
+type handlerLogger struct {
+	h slog.Handler
+}
+
+func (l handlerLogger) Printf(f string, args ...interface{}) {
+	msg := strings.TrimPrefix(fmt.Sprintf(f, args...), "[overseer fetcher] ")
+	logRecord(l.h, slog.LevelDebug, "fetcher", "", msg)
+}
+
+//event logs a lifecycle event, as the text f when there's no
+//LogHandler (given the Debug and NoWarn of the level)
+func (mp *master) event(level slog.Level, event string, attrs []slog.Attr, f string, args ...interface{}) {
+	if h := mp.Config.LogHandler; h != nil {
+		version := mp.logVersion()
+		eventAttrs := []slog.Attr{slog.String("event", event)}
+		for _, a := range attrs {
+			if a.Key == "version" {
+				if v := a.Value.String(); v != "" {
+					version = v //set by the event
+				}
+				continue
+			}
+			eventAttrs = append(eventAttrs, a)
+		}
+		logRecord(h, level, "master", version, fmt.Sprintf(f, args...), eventAttrs...)
+		return
+	}
+	if level >= slog.LevelWarn {
+		mp.warnf(f, args...)
+	} else {
+		mp.debugf(f, args...)
+	}
+}
+
+//record logs a lifecycle event only to the LogHandler
+func (mp *master) record(level slog.Level, event string, attrs []slog.Attr, msg string) {
+	if mp.Config.LogHandler != nil {
+		mp.event(level, event, attrs, "%s", msg)
+	}
+}
+
+//fetchRecord logs the outcome of a fetch, failures
+//are logged by the caller instead (e.g. throttled)
+func (mp *master) fetchRecord(stats FetchStats) {
+	if stats.Err != nil {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.Int64("bytes", stats.Bytes),
+		slog.Duration("duration", stats.Duration),
+		slog.String("version", stats.Metadata.Version),
+	}
+	if stats.Skipped {
+		mp.record(slog.LevelDebug, eventSkip, attrs, "no update")
+	} else {
+		mp.record(slog.LevelInfo, eventFetch, attrs, "fetched binary")
+	}
+}
+
+//fetchErrAttrs describes a fetch which failed after the fetcher
+//returned the binary
+func fetchErrAttrs(stats FetchStats) []slog.Attr {
+	return []slog.Attr{
+		slog.String("version", stats.Metadata.Version),
+		slog.String("error", stats.Err.Error()),
+	}
+}
+
+//setLogVersion sets the version of the binary which
+//records are about, see logVersion
+func (mp *master) setLogVersion(version string) {
+	mp.logVersionMux.Lock()
+	mp.loggedVersion = version
+	mp.logVersionMux.Unlock()
+}
+
+//logVersion returns the version of the binary being
+//upgraded, otherwise of the current binary
+func (mp *master) logVersion() string {
+	mp.logVersionMux.Lock()
+	defer mp.logVersionMux.Unlock()
+	return mp.loggedVersion
+}
+
+//idAttr is the ID (see State.ID) of a binary
+func idAttr(key string, hash []byte) slog.Attr {
+	return slog.String(key, hex.EncodeToString(hash))
+}
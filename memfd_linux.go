@@ -0,0 +1,55 @@
+// +build linux
+
+package overseer
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+//sysMemfdCreate is the memfd_create syscall number by GOARCH,
+//the syscall package lacks it on several architectures
+var sysMemfdCreate = map[string]uintptr{
+	"386":      356,
+	"amd64":    319,
+	"arm":      385,
+	"arm64":    279,
+	"loong64":  279,
+	"mips":     4354,
+	"mipsle":   4354,
+	"mips64":   5314,
+	"mips64le": 5314,
+	"ppc64":    360,
+	"ppc64le":  360,
+	"riscv64":  279,
+	"s390x":    350,
+}
+
+const mfdCloexec = 0x1
+
+//memoryFile creates an anonymous file held in memory (see
+//Config.MemoryExec), which isn't inherited by child processes
+func memoryFile(name string) (*os.File, error) {
+	trap, ok := sysMemfdCreate[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("memfd_create not supported on %s", runtime.GOARCH)
+	}
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(p)), mfdCloexec, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("memfd_create failed (%s)", errno)
+	}
+	return os.NewFile(fd, name), nil
+}
+
+//memoryPath is the path of a memory file,
+//which other processes can also execute
+func memoryPath(f *os.File) string {
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
+}
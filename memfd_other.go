@@ -0,0 +1,16 @@
+// +build !linux
+
+package overseer
+
+import (
+	"errors"
+	"os"
+)
+
+func memoryFile(name string) (*os.File, error) {
+	return nil, errors.New("memory files are only supported on linux")
+}
+
+func memoryPath(f *os.File) string {
+	return ""
+}
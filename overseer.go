@@ -5,9 +5,13 @@ package overseer
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/willas/overseer/fetcher"
@@ -15,12 +19,23 @@ import (
 
 const (
 	envSlaveID        = "OVERSEER_SLAVE_ID"
+	envMasterStarted  = "OVERSEER_MASTER_STARTED_AT"
 	envIsSlave        = "OVERSEER_IS_SLAVE"
 	envNumFDs         = "OVERSEER_NUM_FDS"
+	envListenerNames  = "OVERSEER_LISTENER_NAMES"
+	envFiles          = "OVERSEER_FILES"
+	envControlFD      = "OVERSEER_CONTROL_FD"
+	envStatusFD       = "OVERSEER_STATUS_FD"
 	envBinID          = "OVERSEER_BIN_ID"
+	envPrevBinID      = "OVERSEER_PREV_BIN_ID"
 	envBinPath        = "OVERSEER_BIN_PATH"
+	envBinVersion     = "OVERSEER_BIN_VERSION"
+	envConfigFile     = "OVERSEER_CONFIG_FILE"
 	envBinCheck       = "OVERSEER_BIN_CHECK"
 	envBinCheckLegacy = "GO_UPGRADE_BIN_CHECK"
+	envBinCheckAddrs  = "OVERSEER_BIN_CHECK_ADDRS"
+	envSandbox        = "OVERSEER_SANDBOX"
+	envShadow         = "OVERSEER_SHADOW"
 )
 
 // Config defines overseer's run-time configuration
@@ -32,33 +47,374 @@ type Config struct {
 	Program func(state State)
 	//Program's zero-downtime socket listening address (set this or Addresses)
 	Address string
-	//Program's zero-downtime socket listening addresses (set this or Address)
+	//Program's zero-downtime socket listening addresses (set this or Address).
+	//Addresses listen on IPv4 and IPv6 where possible, prefix an address
+	//with tcp4:// or tcp6:// (e.g. "tcp6://[::]:3000") to listen on one.
 	Addresses []string
-	//RestartSignal will manually trigger a graceful restart. Defaults to SIGUSR2.
+	//NamedAddresses are listening addresses by name (e.g. "grpc"), which
+	//follow Addresses in the order of their names. Retrieve each with
+	//State.NamedListener, rather than by its position in Listeners. The
+	//master process passes each name with its socket, so a restart hands
+	//a name its own socket even when an upgrade reorders the addresses.
+	NamedAddresses map[string]string
+	//AdditionalFiles is called once in the master process to open files
+	//which must outlive each program, such as a memfd or a connection
+	//to a sidecar. They are passed to every program in the same order,
+	//following the Listeners, as State.Files.
+	AdditionalFiles func() ([]*os.File, error)
+	//User runs each program (and each binary's sanity check) as this
+	//user name or uid, with its primary and supplementary groups. This
+	//lets a master started as root bind privileged ports (e.g. 443),
+	//while the program only inherits the listeners. Linux and macOS only.
+	User string
+	//RestartSignal will manually trigger a graceful restart. It is sent by
+	//the master process to the program for every restart and can differ
+	//per platform (e.g. chosen by runtime.GOOS), though it cannot be
+	//SIGUSR1. Defaults to SIGUSR2.
 	RestartSignal os.Signal
+	//FetchSignal will manually trigger an immediate update check when sent
+	//to the master process. Disabled by default. It cannot be RestartSignal
+	//or SIGUSR1, which overseer uses internally during restarts.
+	FetchSignal os.Signal
 	//TerminateTimeout controls how long overseer should
 	//wait for the program to terminate itself. After this
-	//timeout, overseer will issue a SIGKILL.
+	//timeout, overseer will issue a SIGKILL. Defaults to 30
+	//seconds, a negative timeout waits indefinitely.
 	TerminateTimeout time.Duration
+	//DrainTimeout controls how long the program's listeners wait
+	//for active connections to finish, once they have stopped
+	//accepting during a graceful restart (or State.Drain), before
+	//the remaining connections are closed. Defaults to
+	//TerminateTimeout, a negative timeout waits indefinitely.
+	DrainTimeout time.Duration
+	//CanRestart is called in the program before each graceful restart.
+	//While it returns false the restart is deferred, retrying each second
+	//for at most MaxRestartDefer.
+	CanRestart func() bool
+	//MaxRestartDefer defines how long CanRestart can defer a restart
+	//before the program is restarted anyway. Defaults to 5 minutes.
+	MaxRestartDefer time.Duration
+	//Reload is called in the program to reload it in-process (e.g. to
+	//re-read its config). When set, restarts into the same binary (by
+	//the RestartSignal, Restart or State.Restart) call Reload instead of
+	//starting a new program, while upgrades to a new binary still
+	//restart. A Reload which fails, or is still running after
+	//TerminateTimeout, falls back to a restart.
+	Reload func() error
+	//FetchErrorBackoff delays the next fetch after a failed fetch,
+	//doubling with each consecutive failure up to 32 times. When set,
+	//a fetcher which fails to Init is retried rather than disabled.
+	//Defaults to no backoff.
+	FetchErrorBackoff time.Duration
+	//StartupJitter delays the first fetch by a random duration of up
+	//to StartupJitter, so a fleet starting together doesn't fetch all
+	//at once. Later fetches are unaffected. Defaults to no delay.
+	StartupJitter time.Duration
+	//PinVersion makes the fetcher fetch exactly this version (as reported
+	//by State.Version), ignoring newer versions until cleared with
+	//overseer.Pin(""). The fetcher must implement fetcher.Pinnable.
+	PinVersion string
 	//MinFetchInterval defines the smallest duration between Fetch()s.
 	//This helps to prevent unwieldy fetch.Interfaces from hogging
 	//too many resources. Defaults to 1 second.
 	MinFetchInterval time.Duration
+	//ConcurrentUpgrades separates fetching from upgrading: each fetched
+	//binary is spooled to disk and the fetcher polls again while it is
+	//checked, validated and swapped in. A binary fetched meanwhile
+	//supersedes a pending one, and, until PreUpgrade, the one being
+	//validated. Upgrades still run one at a time and the newest wins,
+	//so slow Checks, Validate or Sandbox tests don't delay detecting
+	//the next version. The initial fetch is still upgraded in place.
+	ConcurrentUpgrades bool
+	//MinUptimeBeforeUpgrade defers swapping in a fetched binary until
+	//the running program has been up this long, so a program which just
+	//started isn't restarted straight away when versions change rapidly
+	//(e.g. during a rollout). With ConcurrentUpgrades, a binary fetched
+	//meanwhile replaces the deferred one. SwapTo and Promote are not
+	//deferred. Defaults to no minimum.
+	MinUptimeBeforeUpgrade time.Duration
+	//Validate runs against each freshly downloaded binary (e.g. to
+	//check its file header or run a smoke test). Returning an error
+	//rejects the binary and the current binary keeps running.
+	Validate func(tempBinaryPath string) error
+	//Transforms pass each fetched binary through a chain of readers
+	//(e.g. to decrypt or convert it), in order, each wrapping or
+	//replacing the reader of the previous. They are applied to the
+	//fetcher's output, so after its decompression (see fetcher.HTTP's
+	//AutoDecompress), and before Checks. An error aborts the fetch.
+	//Returned readers which are also io.Closers are closed once the
+	//binary has been read. The declared size and SHA-256 of the fetched
+	//bytes (see fetcher.Metadata) are verified as they are read, instead
+	//of by ChecksumCheck.
+	Transforms []func(io.Reader) (io.Reader, error)
+	//Checks verify each fetched binary in order, before Validate.
+	//Defaults to ChecksumCheck then PlatformCheck. Add a Check to
+	//run another step (e.g. a malware scan, SignatureCheck for OS
+	//code signatures or CosignCheck for Sigstore signatures), and
+	//include or omit the builtin checks to place them. The first
+	//failure rejects the binary and its temp file is removed.
+	Checks []Check
+	//VersionOf optionally reads the version embedded in a binary
+	//(e.g. by running it with --version). Before Validate, binaries
+	//with an older semantic version than the current binary are
+	//rejected. Versions which aren't semver (a "v" prefix is optional)
+	//are not compared.
+	VersionOf func(path string) (string, error)
+	//AllowDowngrade accepts binaries with an older VersionOf
+	AllowDowngrade bool
+	//Sandbox optionally restricts the checks which run each fetched
+	//binary, with a timeout, resource limits, a separate user and
+	//environment, so an untrusted binary can't compromise the master
+	//process. It can also add a smoke test of the binary.
+	Sandbox *Sandbox
+	//ShadowStart optionally starts each fetched binary as a shadow
+	//program, alongside the live program and serving no traffic, once
+	//it has passed the checks. The binary is rejected unless the shadow
+	//comes up healthy, see Shadow. Linux and macOS only.
+	ShadowStart *Shadow
+	//RollbackOnFailure keeps a copy of the previous binary during each
+	//upgrade. If the upgraded program exits with a non-zero code within
+	//StartupGracePeriod, the previous binary is restored and restarted.
+	RollbackOnFailure bool
+	//StartupGracePeriod defines how long an upgraded program must run
+	//before it is considered good. Defaults to 10 seconds.
+	StartupGracePeriod time.Duration
+	//HealthCheck is run by the master process after an upgraded program
+	//has started (e.g. requesting a local health endpoint). It is retried
+	//each second until it returns nil. If it has not passed within
+	//StartupGracePeriod, the upgrade is considered failed and the previous
+	//binary is restored and restarted. Setting HealthCheck implies
+	//RollbackOnFailure.
+	HealthCheck func() error
 	//PreUpgrade runs after a binary has been retrieved, user defined checks
 	//can be run here and returning an error will cancel the upgrade.
+	//It runs in the master process after Validate and before the current
+	//binary is replaced and the RestartSignal is sent to the program.
 	PreUpgrade func(tempBinaryPath string) error
+	//PostDownloadCommand is an optional command (e.g. a database
+	//migration or asset extraction) run in the master process once a
+	//binary has passed every check, just before it replaces the current
+	//binary. The temp binary's path is appended to its arguments and its
+	//output is logged. A non-zero exit cancels the upgrade, as does
+	//running longer than PostDownloadTimeout (defaults to 5 minutes).
+	PostDownloadCommand []string
+	PostDownloadTimeout time.Duration
+	//WaitForBarrier optionally coordinates upgrades across a cluster. It
+	//is called in the master process with the version (or hex SHA-256)
+	//of a binary which has passed every check, and should block until
+	//every node is ready to upgrade to it, so they restart together.
+	//Returning an error, or not returning within BarrierTimeout
+	//(defaults to 10 minutes, a negative timeout waits indefinitely),
+	//cancels the upgrade and keeps the current binary.
+	WaitForBarrier func(version string) error
+	BarrierTimeout time.Duration
+	//PostUpgrade runs in the new program's process after an upgrade, once
+	//the listeners have been inherited and before Program is started.
+	//It receives the ID of the binary which was replaced.
+	PostUpgrade func(previousID string)
+	//TempDir is where fetched binaries are written before they replace the
+	//current binary, it must allow execution. Defaults to os.TempDir().
+	TempDir string
+	//TempFileName optionally names the temp file of each fetched
+	//binary, given its metadata. Relative names are placed in TempDir.
+	//Defaults to a random overseer-* name, only these are removed by
+	//the cleanup of leftover temp binaries (see TempMaxAge).
+	TempFileName func(meta fetcher.Metadata) string
+	//TempMaxAge is the age at which leftover temp binaries (e.g. from
+	//interrupted upgrades) are removed from the TempDir when the master
+	//process starts. Backup, dry run and staged binaries are never
+	//removed, as the TempDir may be shared with other master processes.
+	//Defaults to 24 hours, set it to -1 to keep them.
+	TempMaxAge time.Duration
+	//TempKeep excludes the TempKeep most recent leftover temp binaries
+	//from removal, e.g. to keep previous binaries for a manual rollback.
+	TempKeep int
+	//VerifyWrites re-reads each written binary from disk, once synced,
+	//checking its size and hash against the downloaded bytes, so a
+	//truncated or corrupted write (e.g. a full disk or failing flash
+	//storage) aborts the upgrade. Both the temp binary and the staged
+	//copy replacing the current binary are verified.
+	VerifyWrites bool
+	//MemoryExec keeps fetched binaries in memory on Linux, written to
+	//a memfd and executed from it, so upgrades work on read-only or
+	//noexec filesystems. The binary on disk is never replaced, so a
+	//restarted master process starts it again and re-fetches. Kept
+	//binaries (see DryRun, Staging, RollbackOnFailure and the spooling
+	//of ConcurrentUpgrades) are still written to TempDir, which may be
+	//a tmpfs. Falls back to replacing the binary on disk without memfd.
+	MemoryExec bool
+	//IntegrityCheckInterval re-hashes the binary on disk at this
+	//interval, comparing it with the binary which was started or
+	//installed, to detect corruption or tampering between upgrades.
+	//A mismatch is logged and reported to OnIntegrityFailure once
+	//per modified binary. Disabled by default.
+	IntegrityCheckInterval time.Duration
+	//OnIntegrityFailure is called in the master process with the
+	//path of a modified binary, along with its expected and actual
+	//SHA-1 hashes (see State.ID)
+	OnIntegrityFailure func(path, expected, actual string)
+	//RefetchOnIntegrityFailure triggers a fetch when the binary was
+	//modified, replacing it with the fetched binary even if that is
+	//the expected binary. Fetchers which only return changed binaries
+	//(e.g. HTTP with ETags) can't restore an unchanged binary.
+	RefetchOnIntegrityFailure bool
+	//MaxSize limits the size in bytes of fetched binaries. Larger
+	//binaries are aborted mid-download and discarded. Defaults
+	//to unlimited.
+	MaxSize int64
+	//FreeSpaceHeadroom is the disk space in bytes which must remain free
+	//once a fetched binary is written. When the fetcher declares its size
+	//(e.g. the Content-Length of HTTP), the download is skipped with a
+	//warning unless TempDir, and the directory of the binary when it is
+	//on another filesystem, have room for the binary, the copies kept
+	//meanwhile (see ConcurrentUpgrades and RollbackOnFailure) and the
+	//headroom. Defaults to 0, set it to -1 to disable the check.
+	FreeSpaceHeadroom int64
+	//BinPerms sets the file mode of upgraded binaries. Defaults to the
+	//file mode of the current binary.
+	BinPerms os.FileMode
+	//RestartOnCrash restarts the program when it exits unexpectedly with
+	//a non-zero code, instead of exiting the master process. A program
+	//crashing within CrashLoopWindow of starting is restarted after an
+	//exponential backoff, until it crashes CrashLoopLimit times in a row.
+	RestartOnCrash bool
+	//CrashLoopWindow defaults to 10 seconds.
+	CrashLoopWindow time.Duration
+	//CrashLoopLimit defaults to 5.
+	CrashLoopLimit int
+	//OnChildExit is called in the master process each time a program
+	//exits, including after graceful restarts. err is the result of
+	//waiting for the process (e.g. an *exec.ExitError, its ProcessState
+	//records whether it was signalled) and exitCode is -1 when the
+	//program was killed by a signal.
+	OnChildExit func(exitCode int, err error)
+	//OnBeforeExec is called in the master process immediately before
+	//each program process is started, with the binary and arguments
+	//it is started with, e.g. for an audit log of every binary run.
+	//Returning an error vetoes the start, an upgraded binary is then
+	//rolled back and the previous binary started instead, otherwise
+	//the program isn't started at all (see Required).
+	OnBeforeExec func(path string, args []string) error
+	//Args optionally replaces the arguments (after the program name)
+	//which each program process is started with, by default those of
+	//the master process.
+	Args []string
+	//ArgsOf optionally computes the arguments for the binary at path,
+	//e.g. when the flags of the program change between versions, it
+	//is called for the sanity check of each fetched binary and before
+	//each program start. It takes precedence over Args, unless it
+	//returns nil.
+	ArgsOf func(path string) []string
 	//Debug enables all [overseer] logs.
 	Debug bool
 	//NoWarn disables warning [overseer] logs.
 	NoWarn bool
+	//Logger receives [overseer] logs instead of the standard logger.
+	//It is also passed to the Fetcher (if it is a fetcher.Loggable),
+	//which is otherwise silent, to report each fetch.
+	Logger fetcher.Logger
+	//LogHandler receives structured records of the [overseer] logs
+	//instead of the Logger, e.g. slog.NewJSONHandler(os.Stderr, nil).
+	//Records carry the "component" which logged them (master, slave or
+	//fetcher) and the "version" of the binary they are about, when
+	//known. Lifecycle events also carry an "event": fetch, skip,
+	//download, validate, upgrade, restart, rollback or error, along
+	//with attributes such as "id", "bytes", "duration" and "error".
+	//The handler's level applies instead of Debug and NoWarn, the
+	//fetcher's logs are passed to it as Debug records.
+	LogHandler slog.Handler
 	//NoRestart disables all restarts, this option essentially converts
 	//the RestartSignal into a "ShutdownSignal".
 	NoRestart bool
+	//DryRun fetches and validates binaries as usual, though instead of
+	//upgrading, the binary is kept at a temporary path for inspection.
+	//PreUpgrade is not called and the program is never restarted.
+	DryRun bool
+	//Staging fetches and checks binaries as usual, though instead of
+	//upgrading, each binary is staged at StagePath until Promote is
+	//called, e.g. to cut a fleet over to a release at the same instant.
+	//A newer fetched binary replaces the staged one. Promoting runs
+	//PreUpgrade and the checks again, then upgrades and restarts.
+	Staging bool
+	//StagePath is where the binary awaiting Promote is kept. Defaults
+	//to a temporary path in TempDir.
+	StagePath string
+	//ConfigFile is where the config file fetched along with each binary
+	//(see fetcher.Metadata.Config, e.g. from fetcher.HTTP's ConfigURL)
+	//is written, just before the binary is swapped in, so the program
+	//starts with both. The program finds it at State.ConfigFile. A
+	//changed config alone is an upgrade too, the program is restarted
+	//(or reloaded, see Reload) to read it. Defaults to the binary path
+	//with a ".config" suffix.
+	ConfigFile string
 	//NoRestartAfterFetch disables automatic restarts after each upgrade.
 	//Though manual restarts using the RestartSignal can still be performed.
 	NoRestartAfterFetch bool
 	//Fetcher will be used to fetch binaries.
 	Fetcher fetcher.Interface
+	//OnFetch is called in the master process after each
+	//fetch attempt, useful for collecting metrics. This includes
+	//polls which found no update (stats.Skipped), so a healthy
+	//but quiet fetcher can be told apart from a stalled one.
+	OnFetch func(stats FetchStats)
+	//OnProgress is called in the master process while a binary is
+	//downloaded, at most once per second and once it completes.
+	//total is -1 when the fetcher does not report the binary's
+	//size (see fetcher.Sized).
+	OnProgress func(read, total int64)
+}
+
+// FetchStats describes a single fetch attempt
+type FetchStats struct {
+	//StartedAt records the start time of the fetch
+	StartedAt time.Time
+	//Duration of the fetch, including the binary download
+	Duration time.Duration
+	//Bytes of binary downloaded
+	Bytes int64
+	//Skipped is true when there was no update, either the
+	//fetcher returned no binary or its hash matched.
+	Skipped bool
+	//Metadata describes the fetched binary, as reported by the
+	//fetcher (see fetcher.FetchMetadata)
+	Metadata fetcher.Metadata
+	//Err is the error which caused the fetch to fail, the
+	//fetcher's errors can be matched with errors.Is against
+	//fetcher.ErrNotFound, fetcher.ErrAuth and fetcher.ErrTransient,
+	//and binaries rejected by a signature check against ErrUnverified
+	Err error
+}
+
+//Status describes the master process's fetcher, see State.Status
+type Status struct {
+	//Upgrading is true while a fetched binary is being
+	//downloaded, checked and swapped in
+	Upgrading bool
+	//LastFetch records when the last fetch attempt completed
+	LastFetch time.Time
+	//LastSuccess records when the last fetch attempt completed
+	//without error, whether or not it found an update
+	LastSuccess time.Time
+	//LastError of the last fetch attempt, empty when it succeeded
+	LastError string
+	//LastUpgrade records when the binary was last replaced
+	LastUpgrade time.Time
+	//Fetches counts the fetch attempts of the master process,
+	//FailedFetches those which failed, and Upgrades the times
+	//the binary was replaced. They outlive program restarts.
+	Fetches, FailedFetches, Upgrades int
+	//Staged is the path of the binary awaiting Promote (see
+	//Config.Staging), empty when none is staged
+	Staged string
+	//StagedVersion is the fetcher's version of the staged binary
+	StagedVersion string
+	//Paused is true while upgrades are paused (see Pause),
+	//FetchesPaused when fetches are paused too
+	Paused, FetchesPaused bool
+	//NextPoll is when the fetcher next polls its source (see
+	//fetcher.Scheduled), in the past while it polls. It is zero when
+	//unknown, e.g. while fetches are paused or only triggered.
+	NextPoll time.Time
 }
 
 func validate(c *Config) error {
@@ -71,18 +427,83 @@ func validate(c *Config) error {
 			return errors.New("overseer.Config.Address and Addresses cant both be set")
 		}
 		c.Addresses = []string{c.Address}
-	} else if len(c.Addresses) > 0 {
+	}
+	//appends never write to the caller's Addresses
+	c.Addresses = c.Addresses[:len(c.Addresses):len(c.Addresses)]
+	for _, name := range addressNames(c.NamedAddresses) {
+		if strings.ContainsAny(name, "=,") || name == "" {
+			return fmt.Errorf("overseer.Config.NamedAddresses: invalid name %q", name)
+		}
+		c.Addresses = append(c.Addresses, c.NamedAddresses[name])
+	}
+	if c.Address == "" && len(c.Addresses) > 0 {
 		c.Address = c.Addresses[0]
 	}
+	for _, addr := range c.Addresses {
+		if network, _ := listenNetwork(addr); network != "tcp" && network != "tcp4" && network != "tcp6" {
+			return fmt.Errorf("overseer.Config.Addresses: unsupported network %s (%s)", network, addr)
+		}
+	}
+	if c.Staging && c.DryRun {
+		return errors.New("overseer.Config.Staging and DryRun cant both be set")
+	}
 	if c.RestartSignal == nil {
 		c.RestartSignal = SIGUSR2
+	} else if processSignals && c.RestartSignal == SIGUSR1 {
+		return errors.New("overseer.Config.RestartSignal cant be SIGUSR1, it is reserved by overseer")
 	}
-	if c.TerminateTimeout <= 0 {
+	if c.FetchSignal != nil {
+		if c.FetchSignal == c.RestartSignal {
+			return errors.New("overseer.Config.FetchSignal and RestartSignal cant be the same signal")
+		}
+		if c.FetchSignal == SIGUSR1 {
+			return errors.New("overseer.Config.FetchSignal cant be SIGUSR1, it is reserved by overseer")
+		}
+	}
+	if c.User != "" && !userSwitching {
+		return fmt.Errorf("overseer.Config.User is not supported on %s", runtime.GOOS)
+	}
+	if sb := c.Sandbox; sb != nil {
+		if sb.User != "" && !userSwitching {
+			return fmt.Errorf("overseer.Config.Sandbox.User is not supported on %s", runtime.GOOS)
+		}
+		if (sb.MaxMemory > 0 || sb.MaxCPU > 0) && !resourceLimits {
+			return fmt.Errorf("overseer.Config.Sandbox limits are not supported on %s", runtime.GOOS)
+		}
+	}
+	if c.TerminateTimeout == 0 {
 		c.TerminateTimeout = 30 * time.Second
 	}
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = c.TerminateTimeout
+	}
+	if len(c.PostDownloadCommand) > 0 && c.PostDownloadTimeout <= 0 {
+		c.PostDownloadTimeout = 5 * time.Minute
+	}
+	if c.WaitForBarrier != nil && c.BarrierTimeout == 0 {
+		c.BarrierTimeout = 10 * time.Minute
+	}
+	if c.CrashLoopWindow <= 0 {
+		c.CrashLoopWindow = 10 * time.Second
+	}
+	if c.CrashLoopLimit <= 0 {
+		c.CrashLoopLimit = 5
+	}
+	if c.MaxRestartDefer <= 0 {
+		c.MaxRestartDefer = 5 * time.Minute
+	}
 	if c.MinFetchInterval <= 0 {
 		c.MinFetchInterval = 1 * time.Second
 	}
+	if c.StartupGracePeriod <= 0 {
+		c.StartupGracePeriod = 10 * time.Second
+	}
+	if c.Checks == nil {
+		c.Checks = []Check{ChecksumCheck, PlatformCheck}
+	}
+	if c.TempMaxAge == 0 {
+		c.TempMaxAge = 24 * time.Hour
+	}
 	return nil
 }
 
@@ -100,8 +521,14 @@ func Run(c Config) {
 	if err != nil {
 		if c.Required {
 			log.Fatalf("[overseer] %s", err)
+		} else if c.LogHandler != nil {
+			logRecord(c.LogHandler, slog.LevelWarn, "master", "", fmt.Sprintf("disabled. run failed: %s", err))
 		} else if c.Debug || !c.NoWarn {
-			log.Printf("[overseer] disabled. run failed: %s", err)
+			if c.Logger != nil {
+				c.Logger.Printf("[overseer] disabled. run failed: %s", err)
+			} else {
+				log.Printf("[overseer] disabled. run failed: %s", err)
+			}
 		}
 		c.Program(DisabledState)
 		return
@@ -109,11 +536,50 @@ func Run(c Config) {
 	os.Exit(0)
 }
 
-//sanityCheck returns true if a check was performed
-func sanityCheck() bool {
+//listenNetwork splits the optional network prefix from
+//addr (see Config.Addresses), which defaults to "tcp"
+func listenNetwork(addr string) (network, address string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "tcp", addr
+}
+
+//addressNames returns the names of named in order
+func addressNames(named map[string]string) []string {
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//listenerNames returns the names of the NamedAddresses
+//by their index in the validated Addresses
+func listenerNames(c *Config) map[string]int {
+	names := addressNames(c.NamedAddresses)
+	index := map[string]int{}
+	for i, name := range names {
+		index[name] = len(c.Addresses) - len(names) + i
+	}
+	return index
+}
+
+//sanityCheck returns true if a check was performed,
+//addrs are reported to masters which ask for them
+func sanityCheck(addrs []string) bool {
+	//limit a check before running it (see Sandbox)
+	if spec := os.Getenv(envSandbox); spec != "" {
+		sandboxExec(spec)
+	}
 	//sanity check
 	if token := os.Getenv(envBinCheck); token != "" {
 		fmt.Fprint(os.Stdout, token)
+		//one address per line after the token
+		if len(addrs) > 0 && os.Getenv(envBinCheckAddrs) == "1" {
+			fmt.Fprint(os.Stdout, "\n"+strings.Join(addrs, "\n"))
+		}
 		return true
 	}
 	//legacy sanity check using old env var
@@ -131,7 +597,7 @@ func sanityCheck() bool {
 //on overseer.Run() though it can be manually run prior whenever
 //necessary.
 func SanityCheck() {
-	if sanityCheck() {
+	if sanityCheck(nil) {
 		os.Exit(0)
 	}
 }
@@ -139,6 +605,14 @@ func SanityCheck() {
 //abstraction over master/slave
 var currentProcess interface {
 	triggerRestart()
+	triggerFetch()
+	pinVersion(version string)
+	setFetchInterval(d time.Duration)
+	pause(fetches bool)
+	resume()
+	swapTo(path string) error
+	promote() error
+	stop(timeout time.Duration) error
 	run() error
 }
 
@@ -150,7 +624,7 @@ func runErr(c *Config) error {
 	if err := validate(c); err != nil {
 		return err
 	}
-	if sanityCheck() {
+	if sanityCheck(c.Addresses) {
 		return nil
 	}
 	//run either in master or slave mode
@@ -170,6 +644,165 @@ func Restart() {
 	}
 }
 
+//Fetch programmatically triggers an immediate update check,
+//rather than waiting for the fetcher's next interval. This is
+//a no-op while a fetch is already in progress.
+func Fetch() {
+	if currentProcess != nil {
+		currentProcess.triggerFetch()
+	}
+}
+
+//Pin makes the fetcher fetch exactly version (as reported
+//by State.Version), ignoring newer versions. An empty version
+//clears the pin, resuming upgrades to the latest version. The
+//fetcher must implement fetcher.Pinnable.
+func Pin(version string) {
+	if currentProcess != nil {
+		currentProcess.pinVersion(version)
+	}
+}
+
+//SetFetchInterval changes the fetcher's Interval at runtime, e.g.
+//to poll faster for a hotfix during an incident. A zero d restores
+//the configured Interval. It applies to the pending wait and lasts
+//until the master process exits. The fetcher must implement
+//fetcher.Adjustable.
+func SetFetchInterval(d time.Duration) {
+	if currentProcess != nil {
+		currentProcess.setFetchInterval(d)
+	}
+}
+
+//Pause freezes the binary, e.g. during a maintenance window, while
+//the program keeps running: fetched binaries are checked but not
+//swapped in until Resume. The binary fetched while paused is held
+//and applied by Resume, with ConcurrentUpgrades the latest one, or
+//else the fetcher waits on the held binary. With fetches, fetching
+//is paused too. SwapTo and Promote are unaffected. The pause is
+//reported by Status.Paused and lasts until the master process exits.
+func Pause(fetches bool) {
+	if currentProcess != nil {
+		currentProcess.pause(fetches)
+	}
+}
+
+//Resume ends a Pause, applying any held binary
+func Resume() {
+	if currentProcess != nil {
+		currentProcess.resume()
+	}
+}
+
+//SwapTo upgrades to the binary at path, bypassing the fetcher.
+//It goes through the same checks as a fetched binary (Validate,
+//PreUpgrade and the sanity check) before replacing the current
+//binary and gracefully restarting, even with NoRestartAfterFetch.
+//The upgrade is performed asynchronously by the master process and
+//its failures are logged. An error is returned when overseer is not
+//running or path is not a regular file. The fetcher is unaffected, so
+//later upgrades still replace the swapped binary.
+func SwapTo(path string) error {
+	if currentProcess == nil {
+		return errors.New("overseer not running")
+	}
+	return currentProcess.swapTo(path)
+}
+
+//Promote upgrades to the binary staged by the last fetch (see
+//Config.Staging). Like SwapTo, it goes through the checks before
+//replacing the current binary and gracefully restarting, and it is
+//performed asynchronously by the master process, which logs its
+//failures. An error is returned when overseer is not running or,
+//outside of the program, when no binary is staged.
+func Promote() error {
+	if currentProcess == nil {
+		return errors.New("overseer not running")
+	}
+	return currentProcess.promote()
+}
+
+//Stop shuts overseer down from code: fetching stops, the program
+//is sent a SIGTERM and once it has exited, RunErr returns nil (and
+//Run exits with code 0). If the program is still running after
+//timeout it is killed and an error is returned. A zero timeout
+//uses Config.TerminateTimeout. Called from the program, Stop asks
+//the master process to stop and returns without waiting.
+func Stop(timeout time.Duration) error {
+	if currentProcess == nil {
+		return errors.New("overseer not running")
+	}
+	return currentProcess.stop(timeout)
+}
+
+//Controls receive the programmatic controls (Restart, Fetch, Pin,
+//SetFetchInterval, Pause, Resume, SwapTo, Promote, Stop and State.Restart)
+//in place of the master and slave processes, see SetControls
+type Controls interface {
+	Restart()
+	Fetch()
+	Pin(version string)
+	SetFetchInterval(d time.Duration)
+	Pause(fetches bool)
+	Resume()
+	SwapTo(path string) error
+	Promote() error
+	Stop(timeout time.Duration) error
+}
+
+//SetControls routes the programmatic controls to c, so a program
+//can be run in-process by a test harness (see package overseertest).
+//A nil c disconnects them again. It must not be used with Run.
+func SetControls(c Controls) {
+	if c == nil {
+		currentProcess = nil
+		return
+	}
+	currentProcess = controlled{c}
+}
+
+//controlled adapts Controls to the master/slave abstraction
+type controlled struct {
+	Controls
+}
+
+func (c controlled) triggerRestart()                  { c.Restart() }
+func (c controlled) triggerFetch()                    { c.Fetch() }
+func (c controlled) pinVersion(version string)        { c.Pin(version) }
+func (c controlled) setFetchInterval(d time.Duration) { c.SetFetchInterval(d) }
+func (c controlled) pause(fetches bool)               { c.Pause(fetches) }
+func (c controlled) resume()                          { c.Resume() }
+func (c controlled) swapTo(path string) error         { return c.SwapTo(path) }
+func (c controlled) promote() error                   { return c.Promote() }
+func (c controlled) stop(timeout time.Duration) error { return c.Stop(timeout) }
+func (c controlled) run() error                       { return errors.New("overseer controlled by SetControls") }
+
+//IsChild returns whether this is the program's process, as started
+//by the master process, e.g. to skip work only the master process
+//should do when code runs in both. The master process marks its
+//children with the OVERSEER_IS_SLAVE=1 environment variable, which
+//subprocesses started by the program also inherit. In the program,
+//State.Enabled is the equivalent.
+func IsChild() bool {
+	return os.Getenv(envIsSlave) == "1"
+}
+
+//IsMaster returns whether this process runs, or once Run is called
+//will run, as the master process: overseer is supported on this OS
+//and this is neither the program's process (see IsChild) nor the
+//master process checking a fetched binary (see SanityCheck).
+func IsMaster() bool {
+	if !supported || IsChild() {
+		return false
+	}
+	for _, env := range []string{envBinCheck, envBinCheckLegacy, envSandbox} {
+		if os.Getenv(env) != "" {
+			return false
+		}
+	}
+	return true
+}
+
 //IsSupported returns whether overseer is supported on the current OS.
 func IsSupported() bool {
 	return supported
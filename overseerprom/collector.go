@@ -0,0 +1,117 @@
+//Package overseerprom exports the overseer metrics of a program
+//to Prometheus, so the core overseer package doesn't depend on it.
+//
+//	func prog(state overseer.State) {
+//		overseerprom.MustRegister(prometheus.DefaultRegisterer, state)
+//		http.Handle("/metrics", promhttp.Handler())
+//		http.Serve(state.Listener, nil)
+//	}
+//
+//The metrics are read from the State (see State.Status) on each
+//scrape, the counters are kept by the master process, so they
+//outlive restarts of the program.
+package overseerprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/willas/overseer"
+)
+
+var (
+	fetchesDesc = prometheus.NewDesc("overseer_fetches_total",
+		"Fetch attempts of the master process.", nil, nil)
+	failedFetchesDesc = prometheus.NewDesc("overseer_failed_fetches_total",
+		"Failed fetch attempts of the master process.", nil, nil)
+	lastFetchDesc = prometheus.NewDesc("overseer_last_fetch_timestamp",
+		"Unix time of the last fetch attempt.", nil, nil)
+	lastSuccessDesc = prometheus.NewDesc("overseer_last_successful_fetch_timestamp",
+		"Unix time of the last fetch attempt which didn't fail.", nil, nil)
+	upgradesDesc = prometheus.NewDesc("overseer_upgrades_total",
+		"Times the binary was replaced.", nil, nil)
+	lastUpgradeDesc = prometheus.NewDesc("overseer_last_upgrade_timestamp",
+		"Unix time of the last binary replacement.", nil, nil)
+	restartsDesc = prometheus.NewDesc("overseer_restarts_total",
+		"Restarts of the program by the master process.", nil, nil)
+	startedDesc = prometheus.NewDesc("overseer_program_start_timestamp",
+		"Unix time the program was started.", nil, nil)
+	masterStartedDesc = prometheus.NewDesc("overseer_master_start_timestamp",
+		"Unix time the master process was started.", nil, nil)
+	nextPollDesc = prometheus.NewDesc("overseer_next_poll_timestamp",
+		"Unix time the fetcher next polls its source, 0 when unknown.", nil, nil)
+	upgradingDesc = prometheus.NewDesc("overseer_upgrading",
+		"1 while a fetched binary is downloaded, checked and swapped in.", nil, nil)
+	infoDesc = prometheus.NewDesc("overseer_info",
+		"The binary being run, always 1.", []string{"id", "version", "enabled"}, nil)
+)
+
+//Collector is a prometheus.Collector of the overseer metrics of a State
+type Collector struct {
+	state overseer.State
+}
+
+//NewCollector returns a Collector of the metrics of state
+func NewCollector(state overseer.State) *Collector {
+	return &Collector{state: state}
+}
+
+//Register registers a Collector of the metrics of state with reg
+func Register(reg prometheus.Registerer, state overseer.State) error {
+	return reg.Register(NewCollector(state))
+}
+
+//MustRegister is Register, it panics on failure
+func MustRegister(reg prometheus.Registerer, state overseer.State) {
+	reg.MustRegister(NewCollector(state))
+}
+
+//Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		fetchesDesc, failedFetchesDesc, lastFetchDesc, lastSuccessDesc,
+		upgradesDesc, lastUpgradeDesc, restartsDesc, startedDesc,
+		masterStartedDesc, nextPollDesc, upgradingDesc, infoDesc,
+	} {
+		ch <- d
+	}
+}
+
+//Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.state.Status()
+	counter := func(d *prometheus.Desc, v int) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v))
+	}
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	counter(fetchesDesc, s.Fetches)
+	counter(failedFetchesDesc, s.FailedFetches)
+	gauge(lastFetchDesc, timestamp(s.LastFetch))
+	gauge(lastSuccessDesc, timestamp(s.LastSuccess))
+	counter(upgradesDesc, s.Upgrades)
+	gauge(lastUpgradeDesc, timestamp(s.LastUpgrade))
+	counter(restartsDesc, c.state.RestartCount)
+	gauge(startedDesc, timestamp(c.state.StartedAt))
+	gauge(masterStartedDesc, timestamp(c.state.MasterStartedAt))
+	gauge(nextPollDesc, timestamp(s.NextPoll))
+	upgrading := 0.0
+	if s.Upgrading {
+		upgrading = 1
+	}
+	gauge(upgradingDesc, upgrading)
+	enabled := "false"
+	if c.state.Enabled {
+		enabled = "true"
+	}
+	gauge(infoDesc, 1, c.state.ID, c.state.Version, enabled)
+}
+
+//timestamp returns t in Unix seconds, 0 when unset
+func timestamp(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
@@ -0,0 +1,103 @@
+package overseertest
+
+import (
+	"sync"
+	"time"
+)
+
+//Clock is a fake fetcher.TimerClock, time only moves when it is
+//advanced. Install it with fetcher.SetClock(clock) so the
+//Intervals of the fetchers are under the test's control.
+type Clock struct {
+	mut      sync.Mutex
+	now      time.Time
+	sleepers []*sleeper
+}
+
+type sleeper struct {
+	until time.Time
+	c     chan time.Time
+}
+
+//NewClock returns a Clock set to now
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+//Now returns the clock's time
+func (c *Clock) Now() time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.now
+}
+
+//Sleep blocks until the clock has been advanced by d
+func (c *Clock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t, _ := c.NewTimer(d)
+	<-t
+}
+
+//NewTimer returns a channel which receives the clock's time once
+//it has been advanced by d, stop removes the timer
+func (c *Clock) NewTimer(d time.Duration) (<-chan time.Time, func()) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	s := &sleeper{until: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		s.c <- c.now
+		return s.c, func() {}
+	}
+	c.sleepers = append(c.sleepers, s)
+	return s.c, func() {
+		c.mut.Lock()
+		defer c.mut.Unlock()
+		for i, p := range c.sleepers {
+			if p == s {
+				c.sleepers = append(c.sleepers[:i], c.sleepers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+//Advance moves the clock forward by d, waking the
+//sleepers which are due
+func (c *Clock) Advance(d time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.sleepers[:0]
+	for _, s := range c.sleepers {
+		if c.now.Before(s.until) {
+			pending = append(pending, s)
+		} else {
+			s.c <- c.now
+		}
+	}
+	c.sleepers = pending
+}
+
+//Sleepers returns the number of blocked Sleep calls and
+//pending timers, a cancelled fetcher stops its timer.
+func (c *Clock) Sleepers() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return len(c.sleepers)
+}
+
+//WaitForSleepers blocks until there are at least n blocked Sleep
+//calls or pending timers, so the test can advance the clock past a fetcher's wait.
+//It returns false if there are fewer after timeout (in real time).
+func (c *Clock) WaitForSleepers(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for c.Sleepers() < n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
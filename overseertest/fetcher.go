@@ -0,0 +1,164 @@
+package overseertest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/willas/overseer/fetcher"
+)
+
+//Fetcher is a controllable fetcher.Interface. Each Fetch returns
+//the next queued result, blocking until one is queued or until
+//the fetcher is cancelled. The zero value is ready to use.
+type Fetcher struct {
+	//InitErr is returned by Init
+	InitErr error
+	//internal state
+	mut     sync.Mutex
+	queue   []result
+	queued  chan bool
+	ctx     context.Context
+	fetches int
+	version string
+	pinned  string
+}
+
+type result struct {
+	reader io.Reader
+	meta   fetcher.Metadata
+	err    error
+}
+
+//Init returns InitErr
+func (f *Fetcher) Init() error {
+	return f.InitErr
+}
+
+//SetContext sets the context which cancels a blocked Fetch
+func (f *Fetcher) SetContext(ctx context.Context) {
+	f.mut.Lock()
+	f.ctx = ctx
+	f.mut.Unlock()
+}
+
+//Fetch returns the next queued binary, update-less
+//result or error
+func (f *Fetcher) Fetch() (io.Reader, error) {
+	r, _, err := f.FetchMetadata()
+	return r, err
+}
+
+//FetchMetadata is Fetch, along with the Metadata
+//described by PushMetadata
+func (f *Fetcher) FetchMetadata() (io.Reader, fetcher.Metadata, error) {
+	for {
+		f.mut.Lock()
+		if len(f.queue) > 0 {
+			r := f.queue[0]
+			f.queue = f.queue[1:]
+			f.fetches++
+			if r.reader != nil {
+				f.version = r.meta.Version
+			}
+			f.mut.Unlock()
+			return r.reader, r.meta, r.err
+		}
+		ctx := f.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		queued := f.wake()
+		f.mut.Unlock()
+		select {
+		case <-queued:
+		case <-ctx.Done():
+			return nil, fetcher.Metadata{Size: -1, Rollout: -1}, ctx.Err()
+		}
+	}
+}
+
+//Push queues a binary, identified by version
+func (f *Fetcher) Push(binary []byte, version string) {
+	f.PushMetadata(bytes.NewReader(binary), fetcher.Metadata{
+		Version: version,
+		Size:    int64(len(binary)),
+		Rollout: -1,
+	})
+}
+
+//PushReader queues a binary stream, identified by version
+func (f *Fetcher) PushReader(r io.Reader, version string) {
+	f.PushMetadata(r, fetcher.Metadata{Version: version, Size: -1, Rollout: -1})
+}
+
+//PushMetadata queues a binary stream described by meta,
+//e.g. with a SHA256 for overseer.ChecksumCheck to verify
+func (f *Fetcher) PushMetadata(r io.Reader, meta fetcher.Metadata) {
+	f.push(result{reader: r, meta: meta})
+}
+
+//PushNone queues a fetch which finds no update
+func (f *Fetcher) PushNone() {
+	f.push(result{meta: fetcher.Metadata{Size: -1, Rollout: -1}})
+}
+
+//PushError queues a failed fetch
+func (f *Fetcher) PushError(err error) {
+	f.push(result{meta: fetcher.Metadata{Size: -1, Rollout: -1}, err: err})
+}
+
+func (f *Fetcher) push(r result) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.queue = append(f.queue, r)
+	select {
+	case f.wake() <- true:
+	default: //not waiting
+	}
+}
+
+//wake must be called with mut held
+func (f *Fetcher) wake() chan bool {
+	if f.queued == nil {
+		f.queued = make(chan bool, 1)
+	}
+	return f.queued
+}
+
+//Pending returns the number of queued results
+func (f *Fetcher) Pending() int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return len(f.queue)
+}
+
+//Fetches returns the number of results returned by Fetch
+func (f *Fetcher) Fetches() int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.fetches
+}
+
+//Version returns the version of the last fetched binary
+func (f *Fetcher) Version() string {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.version
+}
+
+//Pin records the pinned version (see Pinned), the queue is
+//unaffected
+func (f *Fetcher) Pin(version string) {
+	f.mut.Lock()
+	f.pinned = version
+	f.mut.Unlock()
+}
+
+//Pinned returns the version passed to the last Pin
+func (f *Fetcher) Pinned() string {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.pinned
+}
@@ -0,0 +1,685 @@
+// Package overseertest provides test doubles for programs run
+// with overseer: a controllable Fetcher, a fake Clock and a
+// Harness, which runs a Program in-process and simulates the
+// master process's upgrades and restarts, without S3 buckets
+// or the building and executing of binaries.
+package overseertest
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willas/overseer"
+	"github.com/willas/overseer/fetcher"
+)
+
+//Upgrade describes a binary accepted by the Harness
+type Upgrade struct {
+	//ID is the SHA-1 hash of the binary, see overseer.State
+	ID string
+	//Version as reported by the fetcher
+	Version string
+	//Path of the binary, which the Harness removes on Close
+	Path string
+}
+
+//Harness runs a Config's Program in this process. Binaries from
+//its Fetcher go through Transforms, Validate, Checks, MaxSize,
+//PreUpgrade and WaitForBarrier, then accepted binaries restart the
+//Program with an updated State (calling PostUpgrade) instead of
+//replacing the binary. Restarts are graceful: GracefulShutdown is filled and the
+//Program must return within TerminateTimeout. overseer.Restart,
+//Fetch, Pin, Pause, Resume, SwapTo, Stop and State.Restart, as called
+//by the Program, control the Harness, Fetch, Pin and SetFetchInterval
+//are passed to the Fetcher. With Staging, fetched binaries are staged
+//until Promote.
+//
+//Unlike overseer, nil Checks run no checks, as test binaries are
+//rarely executables. The sanity check, Sandbox, downgrade checks
+//(VersionOf), signals, crash restarts, rollbacks, restart deferral
+//(CanRestart), config files (ConfigFile), shadow starts (ShadowStart)
+//and the BarrierTimeout are not simulated.
+type Harness struct {
+	config     overseer.Config
+	ctx        context.Context
+	cancel     context.CancelFunc
+	listeners  []net.Listener
+	startedAt  time.Time
+	restartMux sync.Mutex
+	mut        sync.Mutex
+	state      overseer.State
+	exited     chan bool
+	running    bool
+	restarts   int
+	reloads    int
+	restarted  chan bool
+	upgrades   []Upgrade
+	staged     *Upgrade
+	resumed    chan bool
+	noFetch    bool
+	err        error
+	tempFiles  []string
+}
+
+//Start runs c.Program, and c.Fetcher when set, in a Harness.
+//Addresses such as "127.0.0.1:0" or "tcp6://[::1]:0" pick a free
+//port, see State.
+func Start(c overseer.Config) (*Harness, error) {
+	if c.Program == nil {
+		return nil, errors.New("overseer.Config.Program required")
+	}
+	if c.Address != "" {
+		if len(c.Addresses) > 0 {
+			return nil, errors.New("overseer.Config.Address and Addresses cant both be set")
+		}
+		c.Addresses = []string{c.Address}
+	}
+	if c.TerminateTimeout <= 0 {
+		c.TerminateTimeout = 30 * time.Second
+	}
+	h := &Harness{
+		config:    c,
+		startedAt: time.Now(),
+		restarted: make(chan bool),
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	for _, addr := range c.Addresses {
+		network, address := "tcp", addr
+		if i := strings.Index(addr, "://"); i >= 0 {
+			network, address = addr[:i], addr[i+3:]
+		}
+		l, err := net.Listen(network, address)
+		if err != nil {
+			h.Close()
+			return nil, fmt.Errorf("failed to listen on %s (%s)", addr, err)
+		}
+		h.listeners = append(h.listeners, l)
+	}
+	if f := c.Fetcher; f != nil {
+		if cf, ok := f.(fetcher.Cancellable); ok {
+			cf.SetContext(h.ctx)
+		}
+		if lf, ok := f.(fetcher.Loggable); ok && c.Logger != nil {
+			lf.SetLogger(c.Logger)
+		}
+		if err := f.Init(); err != nil {
+			h.Close()
+			return nil, fmt.Errorf("fetcher init failed (%s)", err)
+		}
+	}
+	//identify the initial program by this binary, as the master would
+	initial := overseer.State{}
+	if path, err := os.Executable(); err == nil {
+		initial.BinPath = path
+		initial.ID = hashFile(path)
+	}
+	overseer.SetControls(controls{h})
+	if err := h.start(initial, ""); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if c.Fetcher != nil {
+		go h.fetchLoop()
+	}
+	return h, nil
+}
+
+//start runs the Program with the sockets of the previous state
+func (h *Harness) start(prev overseer.State, prevID string) error {
+	state := prev
+	state.Enabled = true
+	state.StartedAt = time.Now()
+	state.MasterStartedAt = h.startedAt
+	state.Address = h.config.Address
+	state.Addresses = h.config.Addresses
+	state.GracefulShutdown = make(chan bool, 1)
+	//each program gets its own copy of the sockets, as a
+	//slave process would, so closing them doesn't affect
+	//the next program
+	state.Listeners = make([]net.Listener, len(h.listeners))
+	for i, l := range h.listeners {
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			return fmt.Errorf("failed to copy listener %s (%s)", l.Addr(), err)
+		}
+		state.Listeners[i], err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy listener %s (%s)", l.Addr(), err)
+		}
+	}
+	state.Listener = nil
+	if len(state.Listeners) > 0 {
+		state.Listener = state.Listeners[0]
+	}
+	exited := make(chan bool)
+	h.mut.Lock()
+	h.state = state
+	h.exited = exited
+	h.running = true
+	h.mut.Unlock()
+	go func() {
+		if prevID != "" && h.config.PostUpgrade != nil {
+			h.config.PostUpgrade(prevID)
+		}
+		h.config.Program(state)
+		for _, l := range state.Listeners {
+			l.Close()
+		}
+		close(exited)
+	}()
+	return nil
+}
+
+//shutdown gracefully stops the Program
+func (h *Harness) shutdown(timeout time.Duration) error {
+	h.mut.Lock()
+	state, exited, running := h.state, h.exited, h.running
+	h.running = false
+	h.mut.Unlock()
+	if !running {
+		return nil
+	}
+	select {
+	case state.GracefulShutdown <- true:
+	default:
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("program still running after %s", timeout)
+	}
+}
+
+//restart replaces the Program, u is nil when
+//restarting into the same binary
+func (h *Harness) restart(u *Upgrade) {
+	h.restartMux.Lock()
+	defer h.restartMux.Unlock()
+	if h.ctx.Err() != nil {
+		return //closed
+	}
+	if err := h.shutdown(h.config.TerminateTimeout); err != nil {
+		h.fail(err)
+	}
+	if h.config.NoRestart {
+		h.cancel()
+		return
+	}
+	h.mut.Lock()
+	state := h.state
+	h.mut.Unlock()
+	state.RestartCount++
+	prevID := ""
+	if u != nil {
+		prevID = state.ID
+		state.ID = u.ID
+		state.Version = u.Version
+		state.BinPath = u.Path
+	}
+	if err := h.start(state, prevID); err != nil {
+		h.fail(err)
+		return
+	}
+	h.mut.Lock()
+	h.restarts++
+	close(h.restarted)
+	h.restarted = make(chan bool)
+	h.mut.Unlock()
+}
+
+func (h *Harness) fetchLoop() {
+	for h.ctx.Err() == nil {
+		h.mut.Lock()
+		resumed := h.resumed
+		if !h.noFetch {
+			resumed = nil
+		}
+		h.mut.Unlock()
+		if resumed != nil {
+			select {
+			case <-resumed:
+			case <-h.ctx.Done():
+				return
+			}
+		}
+		r, meta, err := fetcher.FetchMetadata(h.config.Fetcher)
+		if h.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			h.fail(fmt.Errorf("failed to get latest version: %s", err))
+			if d := h.config.FetchErrorBackoff; d > 0 {
+				time.Sleep(d)
+			}
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		if err := h.upgrade(r, meta, h.config.Staging, true); err != nil {
+			h.fail(err)
+		}
+	}
+}
+
+//upgrade checks the binary from r and restarts into it,
+//or with stage, keeps it until Promote. Fetched binaries
+//are held while paused.
+func (h *Harness) upgrade(r io.Reader, meta fetcher.Metadata, stage, fetched bool) error {
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	for i, t := range h.config.Transforms {
+		if !fetched {
+			break
+		}
+		next, err := t(r)
+		if err == nil && next == nil {
+			err = errors.New("no reader")
+		}
+		if err != nil {
+			return fmt.Errorf("binary rejected by transform #%d: %s", i+1, err)
+		}
+		if c, ok := next.(io.Closer); ok {
+			defer c.Close()
+		}
+		r = next
+	}
+	f, err := ioutil.TempFile(h.config.TempDir, "overseertest-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp binary: %s", err)
+	}
+	path := f.Name()
+	h.mut.Lock()
+	h.tempFiles = append(h.tempFiles, path)
+	h.mut.Unlock()
+	hash := sha1.New()
+	n, err := io.Copy(f, io.TeeReader(r, hash))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write temp binary: %s", err)
+	}
+	if max := h.config.MaxSize; max > 0 && n > max {
+		return fmt.Errorf("binary too large (%d bytes, limit %d)", n, max)
+	}
+	id := hex.EncodeToString(hash.Sum(nil))
+	h.mut.Lock()
+	current, staged := h.state.ID, h.staged
+	if stage && id == current {
+		h.staged = nil //withdrawn
+	}
+	h.mut.Unlock()
+	if id == current || (stage && staged != nil && id == staged.ID) {
+		h.accepted(fetched)
+		return nil //no change
+	}
+	if h.config.Validate != nil {
+		if err := h.config.Validate(path); err != nil {
+			return fmt.Errorf("binary rejected by validate: %s", err)
+		}
+	}
+	for _, c := range h.config.Checks {
+		if c.Run == nil {
+			continue
+		}
+		if err := c.Run(path, meta); err != nil {
+			return fmt.Errorf("binary rejected by %s check: %s", c.Name, err)
+		}
+	}
+	u := Upgrade{ID: id, Version: meta.Version, Path: path}
+	if stage {
+		h.mut.Lock()
+		h.staged = &u
+		h.mut.Unlock()
+		h.accepted(fetched)
+		return nil
+	}
+	if fetched {
+		h.awaitResume()
+	}
+	if h.config.PreUpgrade != nil {
+		if err := h.config.PreUpgrade(path); err != nil {
+			return fmt.Errorf("user cancelled upgrade: %s", err)
+		}
+	}
+	if err := h.barrier(&u); err != nil {
+		return err
+	}
+	h.mut.Lock()
+	h.upgrades = append(h.upgrades, u)
+	h.mut.Unlock()
+	h.accepted(fetched)
+	if !h.config.NoRestartAfterFetch {
+		h.restart(&u)
+	}
+	return nil
+}
+
+//accepted tells the Fetcher its binary was accepted, as the
+//master would (see fetcher.Acceptable)
+func (h *Harness) accepted(fetched bool) {
+	if a, ok := h.config.Fetcher.(fetcher.Acceptable); ok && fetched {
+		a.Accepted()
+	}
+}
+
+//Pause holds fetched binaries, and with fetches the
+//Fetcher, until Resume (see overseer.Pause)
+func (h *Harness) Pause(fetches bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.resumed == nil {
+		h.resumed = make(chan bool)
+	}
+	h.noFetch = fetches
+}
+
+//Resume ends a Pause, applying any held binary
+func (h *Harness) Resume() {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.resumed != nil {
+		close(h.resumed)
+		h.resumed = nil
+	}
+	h.noFetch = false
+}
+
+//awaitResume blocks while paused
+func (h *Harness) awaitResume() {
+	h.mut.Lock()
+	resumed := h.resumed
+	h.mut.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-h.ctx.Done():
+	}
+}
+
+//Promote upgrades to the staged binary, calling PreUpgrade
+//and restarting asynchronously (see overseer.Promote)
+func (h *Harness) Promote() error {
+	h.mut.Lock()
+	u := h.staged
+	h.staged = nil
+	h.mut.Unlock()
+	if u == nil {
+		return errors.New("no binary staged")
+	}
+	go func() {
+		if h.config.PreUpgrade != nil {
+			if err := h.config.PreUpgrade(u.Path); err != nil {
+				h.fail(fmt.Errorf("user cancelled upgrade: %s", err))
+				return
+			}
+		}
+		if err := h.barrier(u); err != nil {
+			h.fail(err)
+			return
+		}
+		h.mut.Lock()
+		h.upgrades = append(h.upgrades, *u)
+		h.mut.Unlock()
+		h.restart(u)
+	}()
+	return nil
+}
+
+//barrier calls WaitForBarrier with the version of u (or its ID)
+func (h *Harness) barrier(u *Upgrade) error {
+	if h.config.WaitForBarrier == nil {
+		return nil
+	}
+	version := u.Version
+	if version == "" {
+		version = u.ID
+	}
+	if err := h.config.WaitForBarrier(version); err != nil {
+		return fmt.Errorf("upgrade cancelled by barrier: %s", err)
+	}
+	return nil
+}
+
+//Staged returns the binary awaiting Promote, or nil
+func (h *Harness) Staged() *Upgrade {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.staged == nil {
+		return nil
+	}
+	u := *h.staged
+	return &u
+}
+
+//hashFile returns the SHA-1 hash of the file at path,
+//or an empty string if it can't be read
+func hashFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	hash := sha1.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (h *Harness) fail(err error) {
+	h.mut.Lock()
+	h.err = err
+	h.mut.Unlock()
+	if h.config.Logger != nil {
+		h.config.Logger.Printf("[overseertest] %s", err)
+	}
+}
+
+//Restart gracefully restarts the Program into the same
+//binary, asynchronously (see overseer.Restart). With
+//Config.Reload, the Program is reloaded instead, unless
+//Reload fails.
+func (h *Harness) Restart() {
+	go func() {
+		if h.config.Reload != nil {
+			err := h.config.Reload()
+			if err == nil {
+				h.mut.Lock()
+				h.reloads++
+				h.mut.Unlock()
+				return
+			}
+			h.fail(fmt.Errorf("reload failed, restarting: %s", err))
+		}
+		h.restart(nil)
+	}()
+}
+
+//controls receive the programmatic controls, as
+//sent by the Program to the master process
+type controls struct {
+	h *Harness
+}
+
+func (c controls) Restart() {
+	c.h.Restart()
+}
+
+func (c controls) Fetch() {
+	if t, ok := c.h.config.Fetcher.(fetcher.Triggerable); ok {
+		t.Trigger()
+	}
+}
+
+func (c controls) Pin(version string) {
+	if p, ok := c.h.config.Fetcher.(fetcher.Pinnable); ok {
+		p.Pin(version)
+	}
+}
+
+func (c controls) SetFetchInterval(d time.Duration) {
+	if a, ok := c.h.config.Fetcher.(fetcher.Adjustable); ok {
+		a.SetInterval(d)
+	}
+}
+
+func (c controls) Pause(fetches bool) {
+	c.h.Pause(fetches)
+}
+
+func (c controls) Resume() {
+	c.h.Resume()
+}
+
+func (c controls) SwapTo(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	go func() {
+		f, err := os.Open(path)
+		if err != nil {
+			c.h.fail(fmt.Errorf("swap failed: %s", err))
+			return
+		}
+		meta := fetcher.Metadata{Size: info.Size(), Rollout: -1}
+		if err := c.h.upgrade(f, meta, false, false); err != nil {
+			c.h.fail(fmt.Errorf("swap failed: %s", err))
+		}
+	}()
+	return nil
+}
+
+func (c controls) Promote() error {
+	return c.h.Promote()
+}
+
+//Stop doesn't wait, the Program is the caller
+func (c controls) Stop(timeout time.Duration) error {
+	go func() {
+		if err := c.h.Stop(timeout); err != nil {
+			c.h.fail(err)
+		}
+	}()
+	return nil
+}
+
+//Stop gracefully stops the Program and the Fetcher, a
+//zero timeout uses TerminateTimeout (see overseer.Stop)
+func (h *Harness) Stop(timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = h.config.TerminateTimeout
+	}
+	h.cancel()
+	return h.shutdown(timeout)
+}
+
+//Close stops the Harness, like Stop, then closes its
+//sockets and removes the binaries it fetched
+func (h *Harness) Close() error {
+	err := h.Stop(0)
+	h.restartMux.Lock()
+	defer h.restartMux.Unlock()
+	overseer.SetControls(nil)
+	for _, l := range h.listeners {
+		l.Close()
+	}
+	h.mut.Lock()
+	for _, path := range h.tempFiles {
+		os.Remove(path)
+	}
+	h.tempFiles = nil
+	h.mut.Unlock()
+	return err
+}
+
+//State returns the State of the running Program
+func (h *Harness) State() overseer.State {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.state
+}
+
+//Restarts returns the number of times the Program was restarted
+func (h *Harness) Restarts() int {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.restarts
+}
+
+//Reloads returns the number of successful Reloads
+func (h *Harness) Reloads() int {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.reloads
+}
+
+//Upgrades returns the binaries accepted so far
+func (h *Harness) Upgrades() []Upgrade {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return append([]Upgrade{}, h.upgrades...)
+}
+
+//Err returns the last fetch, upgrade or restart error
+func (h *Harness) Err() error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.err
+}
+
+//WaitForRestarts blocks until the Program has been restarted
+//n times, returning false if it hasn't after timeout
+func (h *Harness) WaitForRestarts(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		h.mut.Lock()
+		restarts, restarted := h.restarts, h.restarted
+		h.mut.Unlock()
+		if restarts >= n {
+			return true
+		}
+		select {
+		case <-restarted:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+//AssertRestarts fails t unless the Program is restarted
+//n times within timeout
+func (h *Harness) AssertRestarts(t testing.TB, n int, timeout time.Duration) {
+	t.Helper()
+	if !h.WaitForRestarts(n, timeout) {
+		t.Fatalf("expected %d restarts within %s, got %d (last error: %v)", n, timeout, h.Restarts(), h.Err())
+	}
+}
+
+//AssertNoRestart fails t if the Program is restarted within d
+func (h *Harness) AssertNoRestart(t testing.TB, d time.Duration) {
+	t.Helper()
+	n := h.Restarts()
+	if h.WaitForRestarts(n+1, d) {
+		t.Fatalf("expected no restart within %s, got %d", d, h.Restarts()-n)
+	}
+}
@@ -0,0 +1,129 @@
+package overseer
+
+//platform checks ensure fetched binaries were built
+//for this OS and architecture before they are executed
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+)
+
+//checkPlatform returns a descriptive error when the binary
+//at path was not built for runtime.GOOS and runtime.GOARCH
+func checkPlatform(path string) error {
+	expected := ""
+	switch runtime.GOOS {
+	case "darwin", "ios":
+		expected = "mach-o"
+	case "windows":
+		expected = "pe"
+	case "plan9", "js", "wasip1":
+		return nil //not checked
+	default:
+		expected = "elf"
+	}
+	format, archs := binaryPlatform(path)
+	if format != expected {
+		return fmt.Errorf("binary format is %s, expected %s for %s/%s", format, expected, runtime.GOOS, runtime.GOARCH)
+	}
+	for _, arch := range archs {
+		if arch == "" || arch == runtime.GOARCH {
+			return nil //unknown or matching architecture
+		}
+	}
+	return fmt.Errorf("binary was built for %v, expected %s/%s", archs, runtime.GOOS, runtime.GOARCH)
+}
+
+//binaryPlatform returns the executable format of the binary at
+//path and its architectures ("" when the architecture is unknown)
+func binaryPlatform(path string) (string, []string) {
+	if f, err := elf.Open(path); err == nil {
+		defer f.Close()
+		return "elf", []string{elfArch(f)}
+	}
+	if f, err := macho.Open(path); err == nil {
+		defer f.Close()
+		return "mach-o", []string{machoArch(f.Cpu)}
+	}
+	if f, err := macho.OpenFat(path); err == nil {
+		defer f.Close()
+		archs := []string{}
+		for _, a := range f.Arches {
+			archs = append(archs, machoArch(a.Cpu))
+		}
+		return "mach-o", archs
+	}
+	if f, err := pe.Open(path); err == nil {
+		defer f.Close()
+		return "pe", []string{peArch(f.Machine)}
+	}
+	return "unknown", nil
+}
+
+func elfArch(f *elf.File) string {
+	le := f.ByteOrder == binary.LittleEndian
+	is64 := f.Class == elf.ELFCLASS64
+	switch f.Machine {
+	case elf.EM_X86_64:
+		return "amd64"
+	case elf.EM_386:
+		return "386"
+	case elf.EM_ARM:
+		return "arm"
+	case elf.EM_AARCH64:
+		return "arm64"
+	case elf.EM_PPC64:
+		if le {
+			return "ppc64le"
+		}
+		return "ppc64"
+	case elf.EM_MIPS:
+		arch := "mips"
+		if is64 {
+			arch = "mips64"
+		}
+		if le {
+			arch += "le"
+		}
+		return arch
+	case elf.EM_S390:
+		return "s390x"
+	case elf.EM_RISCV:
+		return "riscv64"
+	}
+	return ""
+}
+
+func machoArch(cpu macho.Cpu) string {
+	switch cpu {
+	case macho.CpuAmd64:
+		return "amd64"
+	case macho.Cpu386:
+		return "386"
+	case macho.CpuArm:
+		return "arm"
+	case macho.CpuArm64:
+		return "arm64"
+	case macho.CpuPpc64:
+		return "ppc64"
+	}
+	return ""
+}
+
+func peArch(machine uint16) string {
+	switch machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return "amd64"
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return "386"
+	case pe.IMAGE_FILE_MACHINE_ARMNT:
+		return "arm"
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return "arm64"
+	}
+	return ""
+}
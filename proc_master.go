@@ -1,54 +1,161 @@
 package overseer
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"log/slog"
+	mrand "math/rand"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/kardianos/osext"
+	"github.com/willas/overseer/fetcher"
 )
 
-var tmpBinPath = filepath.Join(os.TempDir(), "overseer-"+token())
-
 //a overseer master process
 type master struct {
 	*Config
+	startedAt           time.Time
 	slaveID             int
+	crashes             int
+	stopping            bool
 	slaveCmd            *exec.Cmd
+	slaveDone           chan bool
+	slaveStartedAt      time.Time
+	slaveCode           int
 	slaveExtraFiles     []*os.File
+	droppedFiles        []*os.File
+	listenAddrs         []string
+	backupAddrs         []string
+	listenMux           sync.Mutex
+	additionalFiles     []*os.File
+	user                *childUser
+	sandboxUser         *childUser
 	binPath, tmpBinPath string
+	memoryExec          bool
+	memBin              *os.File
+	backupBinPath       string
+	dryRunBinPath       string
+	stagedBinPath       string
+	stagedHash          []byte
+	stagedVersion       string
+	stagedConfig        []byte
+	configPath          string
+	config              []byte
+	backupConfig        []byte
 	binPerms            os.FileMode
 	binHash             []byte
+	slaveHash           []byte
+	binVersion          string
+	logVersionMux       sync.Mutex
+	loggedVersion       string
+	prevBinHash         []byte
+	backupHash          []byte
 	restartMux          sync.Mutex
+	upgradeMux          sync.Mutex
+	pendingMux          sync.Mutex
+	pending             *pendingUpgrade
+	acceptMux           sync.Mutex
+	fetchSeq            uint64
+	upgradeSeq          uint64
+	upgrades            chan bool
+	statusMux           sync.Mutex
+	status              Status
+	statusW             *os.File
+	reloads             int
+	reloaded            chan string
 	restarting          bool
+	paused              bool //guarded by statusMux
+	fetchesPaused       bool //guarded by statusMux
 	restartedAt         time.Time
 	restarted           chan bool
 	awaitingUSR1        bool
 	descriptorsReleased chan bool
 	signalledAt         time.Time
 	printCheckUpdate    bool
+	fetchCtx            context.Context
+	fetcherReady        bool
+	fetchErrs           int
+	fetchDelayedTo      time.Time
+	stopFetch           context.CancelFunc
+	signals             chan os.Signal
+	stopRequested       bool
+	exited              chan bool
+	exitOnce            sync.Once
 }
 
+//errStopped ends the fork loop after Stop
+var errStopped = errors.New("stopped")
+
+//errSuperseded cancels the upgrade of a binary when a newer
+//binary was fetched meanwhile (see ConcurrentUpgrades)
+var errSuperseded = errors.New("superseded by a newer binary")
+
 func (mp *master) run() error {
 	mp.debugf("run")
+	mp.startedAt = time.Now()
+	if err := mp.initTempPaths(); err != nil {
+		return err
+	}
 	if err := mp.checkBinary(); err != nil {
 		return err
 	}
+	mp.loadConfig()
+	mp.cleanTempFiles()
+	if mp.Config.User != "" {
+		u, err := lookupUser(mp.Config.User)
+		if err != nil {
+			return err
+		}
+		mp.user = u
+	}
+	if sb := mp.Config.Sandbox; sb != nil && sb.User != "" {
+		u, err := lookupUser(sb.User)
+		if err != nil {
+			return err
+		}
+		mp.sandboxUser = u
+	}
+	//also cancels swaps when there's no fetcher
+	mp.fetchCtx, mp.stopFetch = context.WithCancel(context.Background())
 	if mp.Config.Fetcher != nil {
-		if err := mp.Config.Fetcher.Init(); err != nil {
+		if c, ok := mp.Config.Fetcher.(fetcher.Cancellable); ok {
+			c.SetContext(mp.fetchCtx)
+		}
+		if l, ok := mp.Config.Fetcher.(fetcher.Loggable); ok && mp.Config.LogHandler != nil {
+			l.SetLogger(handlerLogger{mp.Config.LogHandler})
+		} else if ok && mp.Config.Logger != nil {
+			l.SetLogger(mp.Config.Logger)
+		}
+		if mp.Config.PinVersion != "" {
+			mp.pinVersion(mp.Config.PinVersion)
+		}
+		if err := mp.Config.Fetcher.Init(); err == nil {
+			mp.fetcherReady = true
+		} else if mp.Config.FetchErrorBackoff > 0 {
+			mp.warnf("fetcher init failed (%s). retrying.", err)
+		} else {
 			mp.warnf("fetcher init failed (%s). fetcher disabled.", err)
 			mp.Config.Fetcher = nil
 		}
@@ -57,14 +164,91 @@ func (mp *master) run() error {
 	if err := mp.retreiveFileDescriptors(); err != nil {
 		return err
 	}
+	if err := mp.openAdditionalFiles(); err != nil {
+		return err
+	}
 	if mp.Config.Fetcher != nil {
 		mp.printCheckUpdate = true
 		mp.fetch()
+		if mp.Config.ConcurrentUpgrades {
+			mp.upgrades = make(chan bool, 1)
+			go mp.upgradeLoop()
+		}
 		go mp.fetchLoop()
+		go mp.nextPollLoop()
+	}
+	if mp.Config.IntegrityCheckInterval > 0 {
+		go mp.integrityLoop()
 	}
 	return mp.forkLoop()
 }
 
+func (mp *master) initTempPaths() error {
+	dir := mp.Config.TempDir
+	if dir == "" {
+		dir = os.TempDir()
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp dir (%s)", err)
+	}
+	mp.tmpBinPath = filepath.Join(dir, "overseer-"+token())
+	//holds the previous binary when RollbackOnFailure or HealthCheck is set
+	mp.backupBinPath = mp.tmpBinPath + "-prev"
+	//holds the last binary fetched when DryRun is set
+	mp.dryRunBinPath = mp.tmpBinPath + "-dryrun"
+	//holds the binary awaiting promotion when Staging is set
+	mp.stagedBinPath = mp.tmpBinPath + "-staged"
+	if mp.Config.StagePath != "" {
+		mp.stagedBinPath = mp.Config.StagePath
+	}
+	return nil
+}
+
+//tempPattern matches the temp binaries of overseer (see
+//initTempPaths) and of the fetcher package. The backup, dry run and
+//staged binaries are kept for the life of their master process, which
+//may be another one sharing the TempDir, so they never match.
+var tempPattern = regexp.MustCompile(`^overseer-([0-9a-f]{16}(-pending)?|(bundle|manifest|pipe|ranged|sftp|throttled|verified)-[0-9]+)$`)
+
+//cleanTempFiles removes temp binaries left in the TempDir by previous
+//runs which are older than TempMaxAge, besides the TempKeep most recent
+func (mp *master) cleanTempFiles() {
+	if mp.Config.TempMaxAge < 0 {
+		return
+	}
+	type leftover struct {
+		path    string
+		modTime time.Time
+	}
+	leftovers := []leftover{}
+	dir := filepath.Dir(mp.tmpBinPath)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		mp.debugf("failed to list temp binaries: %s", err)
+		return
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		//never the running binary
+		if e.Mode().IsRegular() && tempPattern.MatchString(e.Name()) && path != mp.binPath {
+			leftovers = append(leftovers, leftover{path, e.ModTime()})
+		}
+	}
+	//most recent first
+	sort.Slice(leftovers, func(i, j int) bool {
+		return leftovers[i].modTime.After(leftovers[j].modTime)
+	})
+	for i, l := range leftovers {
+		if i < mp.Config.TempKeep || time.Since(l.modTime) < mp.Config.TempMaxAge {
+			continue
+		}
+		if err := os.Remove(l.path); err != nil {
+			mp.debugf("failed to remove leftover temp binary: %s", err)
+		} else {
+			mp.debugf("removed leftover temp binary %s", l.path)
+		}
+	}
+}
+
 func (mp *master) checkBinary() error {
 	//get path to binary and confirm its writable
 	binPath, err := osext.Executable()
@@ -80,6 +264,9 @@ func (mp *master) checkBinary() error {
 		//copy permissions
 		mp.binPerms = info.Mode()
 	}
+	if mp.Config.BinPerms != 0 {
+		mp.binPerms = mp.Config.BinPerms
+	}
 	f, err := os.Open(binPath)
 	if err != nil {
 		return fmt.Errorf("cannot read binary (%s)", err)
@@ -89,12 +276,22 @@ func (mp *master) checkBinary() error {
 	io.Copy(hash, f)
 	mp.binHash = hash.Sum(nil)
 	f.Close()
+	//binaries are swapped in memory, the binary on disk isn't written
+	if mp.Config.MemoryExec {
+		if f, err := memoryFile("overseer"); err != nil {
+			mp.warnf("MemoryExec unavailable, binaries are written to disk: %s", err)
+		} else {
+			f.Close()
+			mp.memoryExec = true
+			return nil
+		}
+	}
 	//test bin<->tmpbin moves
 	if mp.Config.Fetcher != nil {
-		if err := move(tmpBinPath, mp.binPath); err != nil {
+		if err := move(mp.tmpBinPath, mp.binPath); err != nil {
 			return fmt.Errorf("cannot move binary (%s)", err)
 		}
-		if err := move(mp.binPath, tmpBinPath); err != nil {
+		if err := move(mp.binPath, mp.tmpBinPath); err != nil {
 			return fmt.Errorf("cannot move binary back (%s)", err)
 		}
 	}
@@ -105,11 +302,12 @@ func (mp *master) setupSignalling() {
 	//updater-forker comms
 	mp.restarted = make(chan bool)
 	mp.descriptorsReleased = make(chan bool)
+	mp.exited = make(chan bool)
 	//read all master process signals
-	signals := make(chan os.Signal)
-	signal.Notify(signals)
+	mp.signals = make(chan os.Signal)
+	signal.Notify(mp.signals)
 	go func() {
-		for s := range signals {
+		for s := range mp.signals {
 			mp.handleSignal(s)
 		}
 	}()
@@ -119,6 +317,9 @@ func (mp *master) handleSignal(s os.Signal) {
 	if s == mp.RestartSignal {
 		//user initiated manual restart
 		go mp.triggerRestart()
+	} else if mp.FetchSignal != nil && s == mp.FetchSignal {
+		//user initiated manual fetch
+		mp.triggerFetch()
 	} else if s.String() == "child exited" {
 		// will occur on every restart, ignore it
 	} else
@@ -127,15 +328,26 @@ func (mp *master) handleSignal(s os.Signal) {
 	//descriptors have been released
 	if mp.awaitingUSR1 && s == SIGUSR1 {
 		mp.debugf("signaled, sockets ready")
-		mp.awaitingUSR1 = false
-		mp.descriptorsReleased <- true
+		mp.releasedDescriptors()
 	} else
 	//while the slave process is running, proxy
 	//all signals through
 	if mp.slaveCmd != nil && mp.slaveCmd.Process != nil {
 		mp.debugf("proxy signal (%s)", s)
+		//shutting down, interrupt any pending fetch
+		if s == SIGTERM || s == os.Interrupt {
+			mp.stopping = true
+			mp.stopFetching()
+		}
 		mp.sendSignal(s)
 	} else
+	//terminated before the program started (e.g. mid-fetch),
+	//the fork loop exits instead of starting it
+	if s == SIGTERM {
+		mp.debugf("terminated with no slave")
+		mp.stopping = true
+		mp.stopFetching()
+	} else
 	//otherwise if not running, kill on CTRL+c
 	if s == os.Interrupt {
 		mp.debugf("interupt with no slave")
@@ -146,6 +358,10 @@ func (mp *master) handleSignal(s os.Signal) {
 }
 
 func (mp *master) sendSignal(s os.Signal) {
+	if !processSignals && s != os.Kill {
+		mp.debugf("signal (%s) not supported on this platform", s)
+		return
+	}
 	if mp.slaveCmd != nil && mp.slaveCmd.Process != nil {
 		if err := mp.slaveCmd.Process.Signal(s); err != nil {
 			mp.debugf("signal failed (%s), assuming slave process died unexpectedly", err)
@@ -155,59 +371,283 @@ func (mp *master) sendSignal(s os.Signal) {
 }
 
 func (mp *master) retreiveFileDescriptors() error {
+	if !socketInheritance {
+		return nil //slave will listen itself
+	}
 	mp.slaveExtraFiles = make([]*os.File, len(mp.Config.Addresses))
 	for i, addr := range mp.Config.Addresses {
-		a, err := net.ResolveTCPAddr("tcp", addr)
-		if err != nil {
-			return fmt.Errorf("Invalid address %s (%s)", addr, err)
-		}
-		l, err := net.ListenTCP("tcp", a)
+		f, err := listenFile(addr)
 		if err != nil {
 			return err
 		}
-		f, err := l.File()
+		mp.slaveExtraFiles[i] = f
+	}
+	mp.listenAddrs = mp.Config.Addresses
+	return nil
+}
+
+//listenFile binds addr and returns the socket's file
+func listenFile(addr string) (*os.File, error) {
+	network, address := listenNetwork(addr)
+	a, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address %s (%s)", addr, err)
+	}
+	l, err := net.ListenTCP(network, a)
+	if err != nil {
+		return nil, fileLimitError(err)
+	}
+	f, err := l.File()
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Failed to retreive fd for: %s (%s)", addr, fileLimitError(err))
+	}
+	if err := l.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to close listener for: %s (%s)", addr, err)
+	}
+	return f, nil
+}
+
+//bindAddresses returns the sockets for addrs, the current
+//socket of an unchanged address is reused so its pending
+//connections carry over to the next slave
+func (mp *master) bindAddresses(addrs []string) ([]*os.File, error) {
+	files := make([]*os.File, len(addrs))
+	for i, addr := range addrs {
+		for j, prev := range mp.listenAddrs {
+			if prev == addr {
+				files[i] = mp.slaveExtraFiles[j]
+				break
+			}
+		}
+		if files[i] != nil {
+			continue
+		}
+		f, err := listenFile(addr)
 		if err != nil {
-			return fmt.Errorf("Failed to retreive fd for: %s (%s)", addr, err)
+			mp.closeUnused(files)
+			return nil, fmt.Errorf("failed to listen on %s (%s)", addr, err)
 		}
-		if err := l.Close(); err != nil {
-			return fmt.Errorf("Failed to close listener for: %s (%s)", addr, err)
+		files[i] = f
+	}
+	return files, nil
+}
+
+//closeUnused closes the files from bindAddresses
+//which aren't passed to slaves
+func (mp *master) closeUnused(files []*os.File) {
+	for _, f := range files {
+		if f != nil && !containsFile(mp.slaveExtraFiles, f) {
+			f.Close()
 		}
-		mp.slaveExtraFiles[i] = f
 	}
+}
+
+//setListeners passes the sockets of addrs to the next slave.
+//sockets of dropped addresses are closed once it has started.
+func (mp *master) setListeners(addrs []string, files []*os.File) {
+	mp.listenMux.Lock()
+	defer mp.listenMux.Unlock()
+	for _, f := range mp.slaveExtraFiles {
+		if !containsFile(files, f) {
+			mp.droppedFiles = append(mp.droppedFiles, f)
+		}
+	}
+	mp.logf("listen addresses changed (%s -> %s)", strings.Join(mp.listenAddrs, ","), strings.Join(addrs, ","))
+	mp.slaveExtraFiles = files
+	mp.listenAddrs = addrs
+}
+
+//listenerNames lists each named address of addrs with the file
+//descriptor of its socket (e.g. "grpc=3,http=4"), addresses added
+//by an upgrade are unnamed until the master process restarts
+func (mp *master) listenerNames(addrs []string) string {
+	pairs := []string{}
+	for name, i := range listenerNames(mp.Config) {
+		for j, addr := range addrs {
+			if addr == mp.Config.Addresses[i] {
+				pairs = append(pairs, name+"="+strconv.Itoa(3+j))
+				break
+			}
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+//listenOn rebinds the sockets passed to slaves to addrs
+func (mp *master) listenOn(addrs []string) error {
+	if sameAddresses(mp.listenAddrs, addrs) {
+		return nil
+	}
+	files, err := mp.bindAddresses(addrs)
+	if err != nil {
+		return err
+	}
+	mp.setListeners(addrs, files)
+	return nil
+}
+
+func containsFile(files []*os.File, f *os.File) bool {
+	for _, g := range files {
+		if g == f {
+			return true
+		}
+	}
+	return false
+}
+
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//openAdditionalFiles opens the files passed to every slave
+func (mp *master) openAdditionalFiles() error {
+	if mp.Config.AdditionalFiles == nil {
+		return nil
+	}
+	files, err := mp.Config.AdditionalFiles()
+	if err != nil {
+		return fmt.Errorf("Failed to open additional files (%s)", err)
+	}
+	for i, f := range files {
+		if f == nil {
+			return fmt.Errorf("Additional file #%d is nil", i+1)
+		}
+	}
+	mp.additionalFiles = files
 	return nil
 }
 
 //fetchLoop is run in a goroutine
 func (mp *master) fetchLoop() {
 	min := mp.Config.MinFetchInterval
+	mp.delayFetches(min)
 	time.Sleep(min)
-	for {
+	//spread out the first fetch of a fleet starting together
+	if j := mp.Config.StartupJitter; j > 0 {
+		d := time.Duration(mrand.Int63n(int64(j)))
+		mp.delayFetches(d)
+		select {
+		case <-time.After(d):
+		case <-mp.fetchCtx.Done():
+		}
+	}
+	for mp.fetchCtx.Err() == nil {
 		t0 := time.Now()
 		mp.fetch()
+		//back off while fetches are failing
+		if n := mp.fetchErrs; n > 0 && mp.Config.FetchErrorBackoff > 0 {
+			if n > 6 {
+				n = 6
+			}
+			d := mp.Config.FetchErrorBackoff << uint(n-1)
+			mp.delayFetches(d)
+			select {
+			case <-time.After(d):
+			case <-mp.fetchCtx.Done():
+			}
+		}
 		//duration fetch of fetch
 		diff := time.Now().Sub(t0)
 		if diff < min {
 			delay := min - diff
 			//ensures at least MinFetchInterval delay.
 			//should be throttled by the fetcher!
+			mp.delayFetches(delay)
 			time.Sleep(delay)
 		}
 	}
 }
 
+//delayFetches records when the fetchLoop resumes after a delay of d
+func (mp *master) delayFetches(d time.Duration) {
+	mp.statusMux.Lock()
+	mp.fetchDelayedTo = time.Now().Add(d)
+	mp.statusMux.Unlock()
+}
+
+//nextPoll returns when the fetcher next polls, no earlier than
+//the end of a delay of the fetchLoop (e.g. a FetchErrorBackoff)
+func (mp *master) nextPoll() time.Time {
+	if _, fetches := mp.isPaused(); fetches {
+		return time.Time{}
+	}
+	next := time.Time{}
+	if s, ok := mp.Config.Fetcher.(fetcher.Scheduled); ok {
+		next = s.NextPoll()
+	}
+	mp.statusMux.Lock()
+	delayed := mp.fetchDelayedTo
+	mp.statusMux.Unlock()
+	if delayed.After(time.Now()) && delayed.After(next) {
+		next = delayed
+	}
+	return next
+}
+
+//nextPollLoop keeps Status.NextPoll current, as
+//fetchers schedule their polls without notice
+func (mp *master) nextPollLoop() {
+	for {
+		select {
+		case <-time.After(time.Second):
+		case <-mp.fetchCtx.Done():
+			return
+		}
+		next := mp.nextPoll()
+		mp.statusMux.Lock()
+		changed := !next.Equal(mp.status.NextPoll)
+		mp.statusMux.Unlock()
+		if changed {
+			mp.setStatus(func(s *Status) { s.NextPoll = next })
+		}
+	}
+}
+
 func (mp *master) fetch() {
 	if mp.restarting {
 		return //skip if restarting
 	}
+	if mp.fetchCtx.Err() != nil {
+		return //skip if shutting down
+	}
+	if _, fetches := mp.isPaused(); fetches {
+		return //skip while paused
+	}
 	if mp.printCheckUpdate {
 		mp.debugf("checking for updates...")
 	}
-	reader, err := mp.Fetcher.Fetch()
+	stats := FetchStats{StartedAt: time.Now()}
+	var reader io.Reader
+	err := mp.initFetcher()
+	defer func() { mp.fetchDone(err) }()
+	if err == nil {
+		reader, stats.Metadata, err = fetcher.FetchMetadata(mp.Fetcher)
+	}
 	if err != nil {
-		mp.debugf("failed to get latest version: %s", err)
+		stats.Err = err
+		mp.fetched(stats)
+		mp.fetchErrs++
+		//throttle logs of repeated failures (1st, 2nd, 4th, 8th...)
+		if n := mp.fetchErrs; n&(n-1) == 0 {
+			mp.event(slog.LevelDebug, eventFetch, []slog.Attr{slog.String("error", err.Error()), slog.Int("failures", n)},
+				"failed to get latest version (%d in a row): %s", n, err)
+		}
 		return
 	}
+	mp.fetchErrs = 0
 	if reader == nil {
+		stats.Skipped = true
+		mp.fetched(stats)
 		if mp.printCheckUpdate {
 			mp.debugf("no updates")
 		}
@@ -215,188 +655,1399 @@ func (mp *master) fetch() {
 		return //fetcher has explicitly said there are no updates
 	}
 	mp.printCheckUpdate = true
-	mp.debugf("streaming update...")
+	mp.event(slog.LevelDebug, eventDownload, []slog.Attr{
+		slog.String("version", stats.Metadata.Version),
+		slog.Int64("size", stats.Metadata.Size),
+	}, "streaming update...")
 	//optional closer
 	if closer, ok := reader.(io.Closer); ok {
 		defer closer.Close()
 	}
-	tmpBin, err := os.OpenFile(tmpBinPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		mp.warnf("failed to open temp binary: %s", err)
+	if err = mp.checkFreeSpace(stats.Metadata.Size); err != nil {
+		stats.Err = err
+		mp.fetched(stats)
+		mp.event(slog.LevelWarn, eventFetch, fetchErrAttrs(stats), "%s", err)
 		return
 	}
-	defer func() {
-		tmpBin.Close()
-		os.Remove(tmpBinPath)
-	}()
-	//tee off to sha1
-	hash := sha1.New()
-	reader = io.TeeReader(reader, hash)
-	//write to a temp file
-	_, err = io.Copy(tmpBin, reader)
-	if err != nil {
-		mp.warnf("failed to write temp binary: %s", err)
-		return
+	if len(mp.Config.Transforms) > 0 {
+		var closers []io.Closer
+		reader, closers, err = mp.transform(reader, &stats.Metadata)
+		for _, c := range closers {
+			defer c.Close()
+		}
+		if err != nil {
+			stats.Err = err
+			mp.fetched(stats)
+			mp.event(slog.LevelWarn, eventFetch, fetchErrAttrs(stats), "%s", err)
+			return
+		}
 	}
-	//compare hash
-	newHash := hash.Sum(nil)
-	if bytes.Equal(mp.binHash, newHash) {
-		mp.debugf("hash match - skip")
+	if mp.upgrades != nil {
+		err = mp.queueUpgrade(reader, stats)
 		return
 	}
-	//copy permissions
-	if err := chmod(tmpBin, mp.binPerms); err != nil {
-		mp.warnf("failed to make temp binary executable: %s", err)
-		return
+	if err = mp.upgrade(reader, &stats, ""); err != nil {
+		mp.event(slog.LevelWarn, eventError, []slog.Attr{slog.String("error", err.Error())}, "%s", err)
 	}
-	if err := chown(tmpBin, uid, gid); err != nil {
-		mp.warnf("failed to change owner of binary: %s", err)
-		return
+}
+
+//checkFreeSpace fails when the filesystems written by an upgrade lack
+//room for a binary of size bytes, its copies and the FreeSpaceHeadroom
+func (mp *master) checkFreeSpace(size int64) error {
+	headroom := mp.Config.FreeSpaceHeadroom
+	if size < 0 || headroom < 0 {
+		return nil //unknown size or disabled
 	}
-	if _, err := tmpBin.Stat(); err != nil {
-		mp.warnf("failed to stat temp binary: %s", err)
-		return
+	//the temp binary, unless it is kept in memory
+	tmpNeed := size
+	if mp.memoryExec && !mp.Config.DryRun && !mp.Config.Staging {
+		tmpNeed = 0
 	}
-	tmpBin.Close()
-	if _, err := os.Stat(tmpBinPath); err != nil {
-		mp.warnf("failed to stat temp binary by path: %s", err)
-		return
+	//the spooled binary
+	if mp.upgrades != nil {
+		tmpNeed += size
 	}
-	if mp.Config.PreUpgrade != nil {
-		if err := mp.Config.PreUpgrade(tmpBinPath); err != nil {
-			mp.warnf("user cancelled upgrade: %s", err)
-			return
+	//the backup of the current binary
+	if mp.Config.RollbackOnFailure || mp.Config.HealthCheck != nil {
+		if info, err := os.Stat(mp.binPath); err == nil {
+			tmpNeed += info.Size()
 		}
 	}
-	//overseer sanity check, dont replace our good binary with a non-executable file
-	tokenIn := token()
-	cmd := exec.Command(tmpBinPath)
-	cmd.Env = append(os.Environ(), []string{envBinCheck + "=" + tokenIn}...)
-	cmd.Args = os.Args
-	returned := false
-	go func() {
-		time.Sleep(5 * time.Second)
-		if !returned {
-			mp.warnf("sanity check against fetched executable timed-out, check overseer is running")
-			if cmd.Process != nil {
-				cmd.Process.Kill()
-			}
-		}
-	}()
-	tokenOut, err := cmd.CombinedOutput()
-	returned = true
+	tmpDir := filepath.Dir(mp.tmpBinPath)
+	tmpFree, tmpDev, err := diskSpace(tmpDir)
 	if err != nil {
-		mp.warnf("failed to run temp binary: %s (%s) output \"%s\"", err, tmpBinPath, tokenOut)
-		return
+		mp.debugf("free space of %s unknown: %s", tmpDir, err)
+		return nil
 	}
-	if tokenIn != string(tokenOut) {
-		mp.warnf("sanity check failed")
-		return
+	if tmpNeed+headroom > tmpFree {
+		return fmt.Errorf("download skipped, %s has %d bytes free, a binary of %d bytes needs %d (see FreeSpaceHeadroom)", tmpDir, tmpFree, size, tmpNeed+headroom)
 	}
-	//overwrite!
-	if err := move(mp.binPath, tmpBinPath); err != nil {
-		mp.warnf("failed to overwrite binary: %s", err)
-		return
+	if mp.memoryExec {
+		return nil
 	}
-	mp.debugf("upgraded binary (%x -> %x)", mp.binHash[:12], newHash[:12])
-	mp.binHash = newHash
-	//binary successfully replaced
-	if !mp.Config.NoRestartAfterFetch {
-		mp.triggerRestart()
+	//the binary is copied next to the current binary on another
+	//filesystem, on the same filesystem it is only renamed
+	binDir := filepath.Dir(mp.binPath)
+	binFree, binDev, err := diskSpace(binDir)
+	if err != nil || binDev == tmpDev {
+		return nil
 	}
-	//and keep fetching...
-	return
+	if size+headroom > binFree {
+		return fmt.Errorf("download skipped, %s has %d bytes free, a binary of %d bytes needs %d (see FreeSpaceHeadroom)", binDir, binFree, size, size+headroom)
+	}
+	return nil
 }
 
-func (mp *master) triggerRestart() {
-	if mp.restarting {
-		mp.debugf("already graceful restarting")
-		return //skip
-	} else if mp.slaveCmd == nil || mp.restarting {
-		mp.debugf("no slave process")
-		return //skip
+//transform passes the fetched binary through the Transforms, returning
+//the Closers among their readers. The declared size and checksum
+//describe the fetched bytes, so they are verified while those are read.
+func (mp *master) transform(r io.Reader, meta *fetcher.Metadata) (io.Reader, []io.Closer, error) {
+	var closers []io.Closer
+	if meta.Size >= 0 || meta.SHA256 != nil {
+		r = newDeclaredReader(r, *meta)
+		meta.Size, meta.SHA256 = -1, nil
 	}
-	mp.debugf("graceful restart triggered")
-	mp.restarting = true
-	mp.awaitingUSR1 = true
-	mp.signalledAt = time.Now()
-	mp.sendSignal(mp.Config.RestartSignal) //ask nicely to terminate
-	select {
-	case <-mp.restarted:
-		//success
-		mp.debugf("restart success")
-	case <-time.After(mp.TerminateTimeout):
-		//times up mr. process, we did ask nicely!
-		mp.debugf("graceful timeout, forcing exit")
-		mp.sendSignal(os.Kill)
+	for i, t := range mp.Config.Transforms {
+		next, err := t(r)
+		if err == nil && next == nil {
+			err = errors.New("no reader")
+		}
+		if err != nil {
+			return nil, closers, fmt.Errorf("binary rejected by transform #%d: %s", i+1, err)
+		}
+		if c, ok := next.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+		r = next
 	}
+	return r, closers, nil
 }
 
-//not a real fork
-func (mp *master) forkLoop() error {
-	//loop, restart command
+//awaitSwap blocks while upgrades are paused and until the program has
+//run MinUptimeBeforeUpgrade, returning early on shutdown or when a
+//newer binary is pending
+func (mp *master) awaitSwap() {
+	held := false
 	for {
-		if err := mp.fork(); err != nil {
-			return err
+		wait := time.Duration(0)
+		if started := mp.slaveStartedAt; !started.IsZero() {
+			wait = mp.Config.MinUptimeBeforeUpgrade - time.Since(started)
+		}
+		paused, _ := mp.isPaused()
+		if wait <= 0 && !paused {
+			return
+		}
+		if !held && paused {
+			mp.debugf("upgrade held until resumed")
+			held = true
+		} else if !held {
+			mp.debugf("upgrade deferred for %s (MinUptimeBeforeUpgrade)", wait.Round(time.Second))
+			held = true
+		}
+		d := time.Second
+		if !paused && wait < d {
+			d = wait
+		}
+		select {
+		case <-mp.fetchCtx.Done():
+			return
+		case <-time.After(d):
+			if mp.upgrades != nil && mp.superseded() {
+				return
+			}
 		}
 	}
 }
 
-func (mp *master) fork() error {
-	mp.debugf("starting %s", mp.binPath)
-	cmd := exec.Command(mp.binPath)
-	//mark this new process as the "active" slave process.
-	//this process is assumed to be holding the socket files.
-	mp.slaveCmd = cmd
-	mp.slaveID++
-	//provide the slave process with some state
-	e := os.Environ()
-	e = append(e, envBinID+"="+hex.EncodeToString(mp.binHash))
-	e = append(e, envBinPath+"="+mp.binPath)
-	e = append(e, envSlaveID+"="+strconv.Itoa(mp.slaveID))
-	e = append(e, envIsSlave+"=1")
-	e = append(e, envNumFDs+"="+strconv.Itoa(len(mp.slaveExtraFiles)))
-	cmd.Env = e
-	//inherit master args/stdfiles
-	cmd.Args = os.Args
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	//include socket files
-	cmd.ExtraFiles = mp.slaveExtraFiles
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("Failed to start slave process: %s", err)
+//pendingUpgrade is a fetched binary awaiting its upgrade
+type pendingUpgrade struct {
+	path    string
+	stats   FetchStats
+	version string
+	seq     uint64
+}
+
+//queueUpgrade spools the binary read from reader to disk and hands it
+//to the upgradeLoop, replacing any binary still pending
+func (mp *master) queueUpgrade(reader io.Reader, stats FetchStats) error {
+	path := filepath.Join(filepath.Dir(mp.tmpBinPath), "overseer-"+token()+"-pending")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		stats.Err = err
+		mp.fetched(stats)
+		mp.warnf("failed to open pending binary: %s", err)
+		return err
 	}
-	//was scheduled to restart, notify success
-	if mp.restarting {
-		mp.restartedAt = time.Now()
-		mp.restarting = false
-		mp.restarted <- true
+	if mp.Config.OnProgress != nil {
+		reader = newProgressReader(reader, mp.Config.OnProgress)
 	}
-	//convert wait into channel
-	cmdwait := make(chan error)
-	go func() {
-		cmdwait <- cmd.Wait()
-	}()
-	//wait....
+	//upgrade rejects binaries past the limit
+	if mp.Config.MaxSize > 0 {
+		reader = io.LimitReader(reader, mp.Config.MaxSize+1)
+	}
+	//while a newer binary is read, the fetcher isn't told of
+	//the acceptance of its previous binary (see accepted)
+	mp.acceptMux.Lock()
+	mp.fetchSeq++
+	seq := mp.fetchSeq
+	n, err := io.Copy(f, &cancelReader{Reader: reader, ctx: mp.fetchCtx})
+	mp.acceptMux.Unlock()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		stats.Bytes, stats.Err = n, err
+		mp.fetched(stats)
+		if mp.fetchCtx.Err() != nil {
+			mp.debugf("shutting down, download cancelled")
+			return nil
+		}
+		mp.warnf("failed to write pending binary: %s", err)
+		return err
+	}
+	stats.Bytes = n
+	//the fetcher moves on, so its version is taken now
+	version := ""
+	if v, ok := mp.Fetcher.(fetcher.Versioned); ok {
+		version = v.Version()
+	}
+	mp.pendingMux.Lock()
+	if p := mp.pending; p != nil {
+		os.Remove(p.path)
+		p.stats.Err = errSuperseded
+		mp.fetched(p.stats)
+		mp.debugf("pending binary superseded")
+	}
+	mp.pending = &pendingUpgrade{path: path, stats: stats, version: version, seq: seq}
+	mp.pendingMux.Unlock()
 	select {
-	case err := <-cmdwait:
-		//program exited before releasing descriptors
-		//proxy exit code out to master
-		code := 0
-		if err != nil {
-			code = 1
-			if exiterr, ok := err.(*exec.ExitError); ok {
-				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-					code = status.ExitStatus()
-				}
+	case mp.upgrades <- true:
+	default: //already signalled
+	}
+	return nil
+}
+
+//upgradeLoop upgrades the pending binary, one at a time,
+//while the fetchLoop polls for the next
+func (mp *master) upgradeLoop() {
+	for {
+		select {
+		case <-mp.upgrades:
+		case <-mp.fetchCtx.Done():
+			mp.pendingMux.Lock()
+			if p := mp.pending; p != nil {
+				os.Remove(p.path)
+				mp.pending = nil
 			}
+			mp.pendingMux.Unlock()
+			return
 		}
-		mp.debugf("prog exited with %d", code)
-		//if a restarts are disabled or if it was an
-		//unexpected crash, proxy this exit straight
-		//through to the main process
-		if mp.NoRestart || !mp.restarting {
+		//let a restart in progress complete first
+		for mp.restarting && mp.fetchCtx.Err() == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+		mp.pendingMux.Lock()
+		p := mp.pending
+		mp.pending = nil
+		mp.pendingMux.Unlock()
+		if p != nil {
+			mp.upgradePending(p)
+		}
+	}
+}
+
+func (mp *master) upgradePending(p *pendingUpgrade) {
+	defer os.Remove(p.path)
+	f, err := os.Open(p.path)
+	if err != nil {
+		mp.warnf("failed to open pending binary: %s", err)
+		return
+	}
+	defer f.Close()
+	mp.upgradeSeq = p.seq
+	err = mp.upgrade(f, &p.stats, p.version)
+	if err == errSuperseded {
+		mp.debugf("upgrade cancelled, %s", err)
+	} else if err != nil {
+		mp.event(slog.LevelWarn, eventError, []slog.Attr{slog.String("error", err.Error())}, "%s", err)
+	}
+}
+
+//superseded is true when a newer binary is pending
+func (mp *master) superseded() bool {
+	mp.pendingMux.Lock()
+	defer mp.pendingMux.Unlock()
+	return mp.pending != nil
+}
+
+//upgrade validates the binary read from reader and replaces the
+//current binary with it. stats is nil for binaries which were not
+//fetched (see SwapTo and Promote), these bypass the fetcher and
+//OnFetch, and are identified by version instead.
+func (mp *master) upgrade(reader io.Reader, stats *FetchStats, version string) error {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	mp.setStatus(func(s *Status) { s.Upgrading = true })
+	defer mp.setStatus(func(s *Status) { s.Upgrading = false })
+	report := func(n int64, skipped bool, err error) {
+		if stats != nil {
+			stats.Bytes, stats.Skipped, stats.Err = n, skipped, err
+			mp.fetched(*stats)
+		}
+	}
+	meta := fetcher.Metadata{Size: -1, Rollout: -1}
+	if stats != nil {
+		meta = stats.Metadata
+	}
+	tmpPath := mp.tmpBinPath
+	if mp.Config.TempFileName != nil {
+		tmpPath = mp.Config.TempFileName(meta)
+		if !filepath.IsAbs(tmpPath) {
+			tmpPath = filepath.Join(filepath.Dir(mp.tmpBinPath), tmpPath)
+		}
+	}
+	//binaries which are kept, rather than swapped in, go to disk
+	memory := mp.memoryExec && !mp.Config.DryRun && !(mp.Config.Staging && stats != nil)
+	var tmpBin *os.File
+	if memory {
+		f, err := memoryFile("overseer")
+		if err != nil {
+			mp.warnf("failed to create memory binary, writing to disk: %s", err)
+			memory = false
+		} else {
+			tmpBin, tmpPath = f, memoryPath(f)
+		}
+	}
+	if tmpBin == nil {
+		f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return fmt.Errorf("failed to open temp binary: %s", err)
+		}
+		tmpBin = f
+	}
+	defer func() {
+		if tmpBin != mp.memBin {
+			tmpBin.Close()
+		}
+		if !memory {
+			os.Remove(tmpPath)
+		}
+	}()
+	//pending binaries were reported while spooled
+	if mp.Config.OnProgress != nil && (mp.upgrades == nil || stats == nil) {
+		reader = newProgressReader(reader, mp.Config.OnProgress)
+	}
+	reader = &cancelReader{Reader: reader, ctx: mp.fetchCtx}
+	//tee off to sha1
+	hash := sha1.New()
+	reader = io.TeeReader(reader, hash)
+	//read at most one byte past the limit to detect oversized binaries
+	if mp.Config.MaxSize > 0 {
+		reader = io.LimitReader(reader, mp.Config.MaxSize+1)
+	}
+	//stream to a temp file, the binary is never held in memory
+	n, err := io.Copy(tmpBin, reader)
+	if err == nil && mp.Config.MaxSize > 0 && n > mp.Config.MaxSize {
+		err = fmt.Errorf("binary exceeds MaxSize of %d bytes", mp.Config.MaxSize)
+	}
+	if err != nil && mp.fetchCtx.Err() != nil {
+		report(n, false, err)
+		mp.debugf("shutting down, download cancelled")
+		return nil
+	} else if err != nil {
+		report(n, false, err)
+		return fmt.Errorf("failed to write temp binary: %s", err)
+	}
+	//compare hash
+	newHash := hash.Sum(nil)
+	//fetcher's identifier for this binary
+	if v, ok := mp.Fetcher.(fetcher.Versioned); ok && stats != nil && version == "" {
+		version = v.Version()
+	}
+	//records are about the new binary until it's swapped in, or not
+	mp.setLogVersion(version)
+	defer func() {
+		mp.setLogVersion(mp.binVersion)
+	}()
+	//the config fetched along with the binary, or staged with it
+	config := meta.Config
+	if stats == nil && mp.stagedHash != nil && bytes.Equal(mp.stagedHash, newHash) {
+		config = mp.stagedConfig
+	}
+	//fetched binaries are staged instead when Staging is set
+	staging := mp.Config.Staging && stats != nil
+	skipped := bytes.Equal(mp.binHash, newHash) && sameConfig(config, mp.config)
+	if staging && skipped && mp.stagedHash != nil {
+		mp.warnf("staged binary withdrawn, the current binary was fetched")
+		mp.discardStaged()
+	}
+	if staging && bytes.Equal(mp.stagedHash, newHash) && sameConfig(config, mp.stagedConfig) {
+		skipped = true
+	}
+	//verify new binaries, in the order of Checks
+	if !skipped {
+		err = mp.check(tmpPath, meta)
+		if err != nil {
+			mp.record(slog.LevelWarn, eventValidate, []slog.Attr{idAttr("id", newHash), slog.String("error", err.Error())}, "binary rejected")
+		} else {
+			mp.record(slog.LevelInfo, eventValidate, []slog.Attr{idAttr("id", newHash)}, "binary validated")
+		}
+	}
+	report(n, skipped, err)
+	if err != nil {
+		return err
+	}
+	if skipped {
+		mp.binVersion = version
+		mp.debugf("hash match - skip")
+		if stats != nil {
+			mp.accepted()
+		}
+		return nil
+	}
+	//copy permissions
+	if err := chmod(tmpBin, mp.binPerms); err != nil {
+		return fmt.Errorf("failed to make temp binary executable: %s", err)
+	}
+	if err := chown(tmpBin, uid, gid); err != nil {
+		return fmt.Errorf("failed to change owner of binary: %s", err)
+	}
+	if _, err := tmpBin.Stat(); err != nil {
+		return fmt.Errorf("failed to stat temp binary: %s", err)
+	}
+	if mp.Config.VerifyWrites {
+		if err := tmpBin.Sync(); err != nil {
+			return fmt.Errorf("failed to sync temp binary: %s", err)
+		}
+	}
+	if memory {
+		//a file open for writing can't be executed, reopen it
+		f, err := os.Open(tmpPath)
+		if err != nil {
+			return fmt.Errorf("failed to reopen memory binary: %s", err)
+		}
+		tmpBin.Close()
+		tmpBin, tmpPath = f, memoryPath(f)
+	} else if err := tmpBin.Close(); err != nil && mp.Config.VerifyWrites {
+		return fmt.Errorf("failed to close temp binary: %s", err)
+	}
+	if mp.Config.VerifyWrites {
+		if err := verifyFile(tmpPath, n, newHash); err != nil {
+			return fmt.Errorf("temp binary corrupted: %s", err)
+		}
+	}
+	if _, err := os.Stat(tmpPath); err != nil {
+		return fmt.Errorf("failed to stat temp binary by path: %s", err)
+	}
+	if err := mp.checkVersion(tmpPath); err != nil {
+		return err
+	}
+	if mp.Config.Validate != nil {
+		if err := mp.Config.Validate(tmpPath); err != nil {
+			return fmt.Errorf("binary rejected by validate: %s", err)
+		}
+	}
+	if stats != nil && !mp.Config.DryRun && !staging {
+		mp.awaitSwap()
+	}
+	//the newest binary wins
+	if mp.upgrades != nil && stats != nil && mp.superseded() {
+		return errSuperseded
+	}
+	if mp.fetchCtx.Err() != nil {
+		mp.debugf("shutting down, upgrade cancelled")
+		return nil
+	}
+	if mp.Config.PreUpgrade != nil && !mp.Config.DryRun && !staging {
+		if err := mp.Config.PreUpgrade(tmpPath); err != nil {
+			return fmt.Errorf("user cancelled upgrade: %s", err)
+		}
+	}
+	//overseer sanity check, dont replace our good binary with a non-executable file
+	tokenIn := token()
+	tokenOut, err := mp.runCheck(tmpPath, "sanity check", mp.args(tmpPath), envBinCheck+"="+tokenIn, envBinCheckAddrs+"=1")
+	if err != nil {
+		return fmt.Errorf("failed to run temp binary: %s (%s) output \"%s\"", err, tmpPath, tokenOut)
+	}
+	lines := strings.Split(string(tokenOut), "\n")
+	if tokenIn != lines[0] {
+		return errors.New("sanity check failed")
+	}
+	//the new binary lists its addresses after the token (older binaries
+	//don't), bind changed addresses now so a busy port rejects the binary
+	var listenFiles []*os.File
+	addrs := lines[1:]
+	if socketInheritance && len(addrs) > 0 && !sameAddresses(mp.listenAddrs, addrs) && !mp.Config.DryRun && !staging {
+		files, err := mp.bindAddresses(addrs)
+		if err != nil {
+			return fmt.Errorf("binary rejected: %s", err)
+		}
+		listenFiles = files
+		defer func() {
+			if listenFiles != nil {
+				mp.closeUnused(listenFiles)
+			}
+		}()
+	}
+	//and the optional smoke test
+	if sb := mp.Config.Sandbox; sb != nil && len(sb.Args) > 0 {
+		args := append([]string{tmpPath}, sb.Args...)
+		if out, err := mp.runCheck(tmpPath, "smoke test", args); err != nil {
+			return fmt.Errorf("binary rejected by smoke test: %s output \"%s\"", err, bytes.TrimSpace(out))
+		}
+	}
+	if mp.Config.ShadowStart != nil && socketInheritance && !staging {
+		shadowAddrs := addrs
+		if len(shadowAddrs) == 0 {
+			shadowAddrs = mp.listenAddrs
+		}
+		if err := mp.shadowStart(tmpPath, newHash, version, config, shadowAddrs); err != nil {
+			return fmt.Errorf("binary rejected by shadow start: %s", err)
+		}
+	}
+	if len(mp.Config.PostDownloadCommand) > 0 && !mp.Config.DryRun && !staging {
+		if err := mp.postDownload(tmpPath); err != nil {
+			return fmt.Errorf("upgrade cancelled by post-download command: %s", err)
+		}
+	}
+	if mp.Config.DryRun {
+		if err := move(mp.dryRunBinPath, tmpPath); err != nil {
+			return fmt.Errorf("dry run: failed to keep binary: %s", err)
+		}
+		mp.warnf("dry run: would upgrade binary (%x -> %x), saved to %s", mp.binHash[:12], newHash[:12], mp.dryRunBinPath)
+		return nil
+	}
+	if staging {
+		if err := move(mp.stagedBinPath, tmpPath); err != nil {
+			return fmt.Errorf("failed to stage binary: %s", err)
+		}
+		mp.stagedHash = newHash
+		mp.stagedVersion = version
+		mp.stagedConfig = config
+		mp.setStatus(func(s *Status) { s.Staged, s.StagedVersion = mp.stagedBinPath, version })
+		mp.debugf("staged binary (%x) at %s, awaiting promotion", newHash[:12], mp.stagedBinPath)
+		mp.accepted()
+		return nil
+	}
+	if mp.Config.WaitForBarrier != nil {
+		if err := mp.waitForBarrier(version, newHash); err != nil {
+			return fmt.Errorf("upgrade cancelled by barrier: %s", err)
+		}
+	}
+	if mp.fetchCtx.Err() != nil {
+		mp.debugf("shutting down, upgrade cancelled")
+		return nil
+	}
+	//keep a copy of the current binary for rollbacks
+	if mp.Config.RollbackOnFailure || mp.Config.HealthCheck != nil {
+		if err := copyFile(mp.backupBinPath, mp.binPath); err != nil {
+			return fmt.Errorf("failed to backup binary: %s", err)
+		}
+		mp.backupHash = mp.binHash
+		mp.backupAddrs = mp.listenAddrs
+		mp.backupConfig = mp.config
+	}
+	//the config goes first, so the program starts with both
+	prevConfig := mp.config
+	if config != nil {
+		if err := mp.writeConfig(config); err != nil {
+			if mp.backupHash != nil {
+				mp.discardBackup()
+			}
+			return fmt.Errorf("failed to write config: %s", err)
+		}
+	}
+	//overwrite!
+	if memory {
+		mp.setMemoryBinary(tmpBin)
+	} else if err := mp.replaceBinary(tmpPath, n, newHash); err != nil {
+		//the current binary is untouched
+		if mp.backupHash != nil {
+			mp.discardBackup()
+		}
+		if config != nil {
+			if err := mp.writeConfig(prevConfig); err != nil {
+				mp.warnf("failed to restore previous config: %s", err)
+			}
+		}
+		return fmt.Errorf("failed to overwrite binary: %s", err)
+	}
+	upgraded := []slog.Attr{idAttr("id", newHash), idAttr("previous_id", mp.binHash)}
+	if bytes.Equal(mp.binHash, newHash) {
+		mp.event(slog.LevelInfo, eventUpgrade, upgraded, "updated config of binary (%x)", newHash[:12])
+	} else {
+		mp.event(slog.LevelInfo, eventUpgrade, upgraded, "upgraded binary (%x -> %x)", mp.binHash[:12], newHash[:12])
+	}
+	if mp.prevBinHash == nil {
+		mp.prevBinHash = mp.binHash
+	}
+	mp.binHash = newHash
+	mp.binVersion = version
+	if listenFiles != nil {
+		mp.setListeners(addrs, listenFiles)
+		listenFiles = nil
+	}
+	mp.setStatus(func(s *Status) {
+		s.LastUpgrade = time.Now()
+		s.Upgrades++
+	})
+	if stats != nil {
+		mp.accepted()
+	}
+	//binary successfully replaced, swaps always restart
+	if !mp.Config.NoRestartAfterFetch || stats == nil {
+		mp.triggerRestart()
+	}
+	//and keep fetching...
+	return nil
+}
+
+//initFetcher retries the Init of a fetcher which previously failed
+func (mp *master) initFetcher() error {
+	if mp.fetcherReady {
+		return nil
+	}
+	if err := mp.Fetcher.Init(); err != nil {
+		return fmt.Errorf("fetcher init failed (%s)", err)
+	}
+	mp.fetcherReady = true
+	return nil
+}
+
+//cancelReader fails once ctx is done, so a shutdown also
+//aborts the downloads of fetchers which ignore their context
+type cancelReader struct {
+	io.Reader
+	ctx context.Context
+}
+
+func (c *cancelReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Reader.Read(b)
+}
+
+//progressReader reports the bytes read from a binary
+type progressReader struct {
+	io.Reader
+	read, total int64
+	reported    time.Time
+	fn          func(read, total int64)
+}
+
+func newProgressReader(r io.Reader, fn func(read, total int64)) *progressReader {
+	p := &progressReader{Reader: r, total: -1, reported: time.Now(), fn: fn}
+	if s, ok := r.(fetcher.Sized); ok {
+		p.total = s.Size()
+	}
+	return p
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.read += int64(n)
+	if err == io.EOF || time.Since(p.reported) >= time.Second {
+		p.reported = time.Now()
+		p.fn(p.read, p.total)
+	}
+	return n, err
+}
+
+//fileLimitError explains a failure caused by reaching the
+//limit of open files, which restarts need headroom below
+func fileLimitError(err error) error {
+	if errTooManyFiles == nil || !errors.Is(err, errTooManyFiles) {
+		return err
+	}
+	limit := "the limit of open files"
+	if n := fileLimit(); n > 0 {
+		limit = fmt.Sprintf("the limit of %d open files", n)
+	}
+	return fmt.Errorf("%s (%s was reached, raise it to leave headroom for restarts, e.g. with ulimit -n)", err, limit)
+}
+
+//startExecutable starts cmd, retrying while its executable is busy
+//(ETXTBSY): a process forked meanwhile briefly inherits the files
+//open for writing, like a binary being written, until it executes.
+//Should it stay busy, a copy of the executable is started instead.
+//A Cmd only starts once, so the started Cmd is returned.
+func (mp *master) startExecutable(cmd *exec.Cmd) (*exec.Cmd, error) {
+	err := cmd.Start()
+	for i := 0; i < 10 && isTextBusy(err); i++ {
+		time.Sleep(100 * time.Millisecond)
+		cmd = cloneCmd(cmd)
+		err = cmd.Start()
+	}
+	if !isTextBusy(err) {
+		return cmd, err
+	}
+	path := mp.tmpBinPath + "-exec-" + token()
+	if err := copyFile(path, cmd.Path); err != nil {
+		return cmd, fmt.Errorf("%s is busy, failed to copy it (%s)", cmd.Path, err)
+	}
+	//the started process keeps the removed copy
+	defer os.Remove(path)
+	mp.warnf("%s is busy, starting a copy", cmd.Path)
+	cmd = cloneCmd(cmd)
+	cmd.Path = path
+	return cmd, cmd.Start()
+}
+
+//isTextBusy is true when err is caused by executing a file open for writing
+func isTextBusy(err error) bool {
+	return errTextBusy != nil && errors.Is(err, errTextBusy)
+}
+
+//cloneCmd returns an unstarted copy of cmd
+func cloneCmd(cmd *exec.Cmd) *exec.Cmd {
+	c := exec.Command(cmd.Path)
+	c.Args = cmd.Args
+	c.Env = cmd.Env
+	c.Dir = cmd.Dir
+	c.Stdin = cmd.Stdin
+	c.Stdout = cmd.Stdout
+	c.Stderr = cmd.Stderr
+	c.ExtraFiles = cmd.ExtraFiles
+	c.SysProcAttr = cmd.SysProcAttr
+	c.WaitDelay = cmd.WaitDelay
+	return c
+}
+
+//postDownload runs the PostDownloadCommand against the
+//temp binary at path, logging its output
+func (mp *master) postDownload(path string) error {
+	ctx, cancel := context.WithTimeout(mp.fetchCtx, mp.Config.PostDownloadTimeout)
+	defer cancel()
+	args := append(append([]string{}, mp.Config.PostDownloadCommand[1:]...), path)
+	cmd := exec.CommandContext(ctx, mp.Config.PostDownloadCommand[0], args...)
+	//don't wait on output held open by orphaned processes
+	cmd.WaitDelay = time.Second
+	mp.debugf("running post-download command %v", cmd.Args)
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line != "" {
+			mp.warnf("post-download command: %s", line)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", mp.Config.PostDownloadTimeout)
+	}
+	return err
+}
+
+//waitForBarrier calls WaitForBarrier with the version of the new
+//binary (or its hash), giving up after the BarrierTimeout
+func (mp *master) waitForBarrier(version string, hash []byte) error {
+	if version == "" {
+		version = hex.EncodeToString(hash)
+	}
+	mp.debugf("waiting for barrier (%s)", version)
+	done := make(chan error, 1)
+	go func() {
+		done <- mp.Config.WaitForBarrier(version)
+	}()
+	var timeout <-chan time.Time
+	if mp.Config.BarrierTimeout > 0 {
+		timer := time.NewTimer(mp.Config.BarrierTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		return fmt.Errorf("timed out after %s", mp.Config.BarrierTimeout)
+	case <-mp.fetchCtx.Done():
+		return mp.fetchCtx.Err()
+	}
+}
+
+//fetchDone records the outcome of a fetch attempt in the Status
+func (mp *master) fetchDone(err error) {
+	mp.setStatus(func(s *Status) {
+		s.LastFetch = time.Now()
+		s.Fetches++
+		if err != nil {
+			s.FailedFetches++
+			s.LastError = err.Error()
+		} else {
+			s.LastSuccess = s.LastFetch
+			s.LastError = ""
+		}
+	})
+}
+
+//setStatus applies update to the Status and sends
+//the result to the current slave process
+func (mp *master) setStatus(update func(s *Status)) {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	update(&mp.status)
+	mp.sendStatus()
+}
+
+//statusMessage is sent over the status pipe, Reloads
+//counts the reloads requested of the program
+type statusMessage struct {
+	Status
+	Reloads int `json:",omitempty"`
+}
+
+//sendStatus writes the Status over the status pipe,
+//statusMux must be held
+func (mp *master) sendStatus() {
+	if mp.statusW == nil {
+		return
+	}
+	if err := json.NewEncoder(mp.statusW).Encode(statusMessage{mp.status, mp.reloads}); err != nil {
+		mp.debugf("failed to send status: %s", err)
+	}
+}
+
+//fetched reports a completed fetch attempt
+func (mp *master) fetched(stats FetchStats) {
+	stats.Duration = time.Since(stats.StartedAt)
+	mp.fetchRecord(stats)
+	if mp.Config.OnFetch != nil {
+		mp.Config.OnFetch(stats)
+	}
+}
+
+//integrityLoop re-hashes the binary on each IntegrityCheckInterval,
+//reporting each modified binary once (see Config.OnIntegrityFailure)
+func (mp *master) integrityLoop() {
+	var reported []byte
+	for {
+		select {
+		case <-time.After(mp.Config.IntegrityCheckInterval):
+		case <-mp.fetchCtx.Done():
+			return
+		}
+		//not while the binary is being replaced
+		mp.upgradeMux.Lock()
+		path, expected := mp.binPath, mp.binHash
+		actual, err := hashFile(path)
+		if err == nil && !bytes.Equal(actual, expected) && mp.Config.RefetchOnIntegrityFailure {
+			//the fetched binary no longer matches, so it replaces this one
+			mp.binHash = actual
+		}
+		mp.upgradeMux.Unlock()
+		if err != nil {
+			mp.warnf("integrity check failed to read binary: %s", err)
+			continue
+		}
+		if bytes.Equal(actual, expected) {
+			reported = nil
+			continue
+		}
+		if bytes.Equal(actual, reported) {
+			continue
+		}
+		reported = actual
+		mp.warnf("binary %s was modified (sha1 %x, expected %x)", path, actual[:12], expected[:12])
+		if mp.Config.OnIntegrityFailure != nil {
+			mp.Config.OnIntegrityFailure(path, hex.EncodeToString(expected), hex.EncodeToString(actual))
+		}
+		if mp.Config.RefetchOnIntegrityFailure {
+			mp.triggerFetch()
+		}
+	}
+}
+
+//hashFile returns the SHA-1 hash of the file at path
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha1.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func (mp *master) stopFetching() {
+	if mp.stopFetch != nil {
+		mp.stopFetch()
+	}
+}
+
+//readCommands handles slave commands until the pipe is closed
+func (mp *master) readCommands(r *os.File) {
+	defer r.Close()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		c, arg := s.Text(), ""
+		if i := strings.IndexByte(c, ' '); i >= 0 {
+			c, arg = c[:i], c[i+1:]
+		}
+		switch c {
+		case cmdFetch:
+			mp.triggerFetch()
+		case cmdRestart:
+			go mp.triggerRestart()
+		case cmdPin:
+			mp.pinVersion(arg)
+		case cmdSwap:
+			mp.swapTo(arg)
+		case cmdPromote:
+			mp.promote()
+		case cmdInterval:
+			if d, err := time.ParseDuration(arg); err == nil {
+				mp.setFetchInterval(d)
+			}
+		case cmdPause:
+			mp.pause(arg == "fetches")
+		case cmdResume:
+			mp.resume()
+		case cmdStop:
+			timeout, _ := time.ParseDuration(arg)
+			go func() {
+				if err := mp.stop(timeout); err != nil {
+					mp.warnf("stop failed: %s", err)
+				}
+			}()
+		case cmdReloaded:
+			mp.statusMux.Lock()
+			if mp.reloaded != nil {
+				mp.reloaded <- arg
+				mp.reloaded = nil
+			}
+			mp.statusMux.Unlock()
+		case cmdRelease:
+			if mp.awaitingUSR1 {
+				mp.debugf("sockets ready")
+				mp.releasedDescriptors()
+			}
+		default:
+			mp.debugf("unknown command (%s)", c)
+		}
+	}
+}
+
+//releasedDescriptors allows a restart to start the
+//next slave process before the previous one has exited
+func (mp *master) releasedDescriptors() {
+	mp.awaitingUSR1 = false
+	mp.descriptorsReleased <- true
+}
+
+//accepted tells the fetcher the binary it last fetched was accepted
+//(see fetcher.Acceptable). With ConcurrentUpgrades, it isn't told
+//once a newer binary has been fetched, which is accepted in turn.
+func (mp *master) accepted() {
+	a, ok := mp.Config.Fetcher.(fetcher.Acceptable)
+	if !ok {
+		return
+	}
+	if mp.upgrades != nil {
+		if !mp.acceptMux.TryLock() {
+			return //a newer binary is being read
+		}
+		defer mp.acceptMux.Unlock()
+		if mp.fetchSeq != mp.upgradeSeq {
+			return
+		}
+	}
+	a.Accepted()
+}
+
+func (mp *master) triggerFetch() {
+	if t, ok := mp.Config.Fetcher.(fetcher.Triggerable); ok {
+		mp.debugf("fetch triggered")
+		t.Trigger()
+	}
+}
+
+//pause holds fetched binaries (and with fetches, fetching) until resume
+func (mp *master) pause(fetches bool) {
+	if fetches {
+		mp.debugf("fetches and upgrades paused")
+	} else {
+		mp.debugf("upgrades paused")
+	}
+	mp.setStatus(func(s *Status) {
+		mp.paused, mp.fetchesPaused = true, fetches
+		s.Paused, s.FetchesPaused = true, fetches
+	})
+}
+
+func (mp *master) resume() {
+	if paused, _ := mp.isPaused(); !paused {
+		return
+	}
+	mp.debugf("upgrades resumed")
+	mp.setStatus(func(s *Status) {
+		mp.paused, mp.fetchesPaused = false, false
+		s.Paused, s.FetchesPaused = false, false
+	})
+}
+
+//isPaused returns whether upgrades, and fetches, are paused
+func (mp *master) isPaused() (upgrades, fetches bool) {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	return mp.paused, mp.fetchesPaused
+}
+
+//swapTo upgrades to the binary at path, bypassing the fetcher
+func (mp *master) swapTo(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		mp.warnf("swap failed: %s", err)
+		return err
+	}
+	go func() {
+		defer f.Close()
+		if mp.restarting {
+			mp.warnf("swap to %s skipped, already restarting", path)
+			return
+		}
+		mp.debugf("swapping to %s...", path)
+		if err := mp.upgrade(f, nil, ""); err != nil {
+			mp.warnf("swap failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+//promote upgrades to the staged binary
+func (mp *master) promote() error {
+	mp.upgradeMux.Lock()
+	hash, version := mp.stagedHash, mp.stagedVersion
+	mp.upgradeMux.Unlock()
+	if hash == nil {
+		err := errors.New("no binary staged")
+		mp.warnf("promote failed: %s", err)
+		return err
+	}
+	f, err := os.Open(mp.stagedBinPath)
+	if err != nil {
+		mp.warnf("promote failed: %s", err)
+		return err
+	}
+	go func() {
+		defer f.Close()
+		if mp.restarting {
+			mp.warnf("promote skipped, already restarting")
+			return
+		}
+		mp.debugf("promoting staged binary (%x)...", hash[:12])
+		if err := mp.upgrade(f, nil, version); err != nil {
+			mp.warnf("promote failed: %s", err)
+			return
+		}
+		mp.upgradeMux.Lock()
+		defer mp.upgradeMux.Unlock()
+		if bytes.Equal(mp.stagedHash, hash) {
+			mp.discardStaged()
+		}
+	}()
+	return nil
+}
+
+//discardStaged removes the staged binary, it
+//must be called with upgradeMux held
+func (mp *master) discardStaged() {
+	os.Remove(mp.stagedBinPath)
+	mp.stagedHash = nil
+	mp.stagedVersion = ""
+	mp.stagedConfig = nil
+	mp.setStatus(func(s *Status) { s.Staged, s.StagedVersion = "", "" })
+}
+
+func (mp *master) pinVersion(version string) {
+	p, ok := mp.Config.Fetcher.(fetcher.Pinnable)
+	if !ok {
+		mp.warnf("fetcher does not support pinning versions")
+		return
+	}
+	if version == "" {
+		mp.debugf("version unpinned")
+	} else {
+		mp.debugf("version pinned to %s", version)
+	}
+	p.Pin(version)
+	mp.triggerFetch()
+}
+
+func (mp *master) setFetchInterval(d time.Duration) {
+	a, ok := mp.Config.Fetcher.(fetcher.Adjustable)
+	if !ok {
+		mp.warnf("fetcher does not support changing its interval")
+		return
+	}
+	if d == 0 {
+		mp.debugf("fetch interval restored")
+	} else {
+		mp.debugf("fetch interval set to %s", d)
+	}
+	a.SetInterval(d)
+}
+
+func (mp *master) triggerRestart() {
+	if mp.restarting {
+		mp.debugf("already graceful restarting")
+		return //skip
+	} else if mp.slaveCmd == nil || mp.restarting {
+		mp.debugf("no slave process")
+		return //skip
+	}
+	if mp.Config.Reload != nil && !mp.NoRestart && bytes.Equal(mp.slaveHash, mp.binHash) {
+		if mp.reload() {
+			return
+		}
+	}
+	mp.event(slog.LevelInfo, eventRestart, []slog.Attr{idAttr("id", mp.binHash), slog.String("reason", "graceful")}, "graceful restart triggered")
+	mp.restarting = true
+	mp.awaitingUSR1 = true
+	mp.signalledAt = time.Now()
+	if processSignals {
+		mp.sendSignal(mp.Config.RestartSignal) //ask nicely to terminate
+	} else {
+		mp.debugf("cannot signal, forcing restart")
+		mp.sendSignal(os.Kill)
+	}
+	if mp.TerminateTimeout < 0 {
+		<-mp.restarted
+		mp.debugf("restart success")
+		return
+	}
+	//the program may defer the restart
+	timeout := mp.TerminateTimeout
+	if mp.CanRestart != nil {
+		timeout += mp.MaxRestartDefer
+	}
+	select {
+	case <-mp.restarted:
+		//success
+		mp.debugf("restart success")
+	case <-time.After(timeout):
+		//times up mr. process, we did ask nicely!
+		mp.warnf("program did not exit within %s of the restart signal, forcing exit", timeout)
+		mp.sendSignal(os.Kill)
+	}
+}
+
+//reload asks the program to reload in-process, as its binary is
+//unchanged, and returns false if it must be restarted instead
+func (mp *master) reload() bool {
+	mp.debugf("reload triggered")
+	mp.restarting = true
+	defer func() { mp.restarting = false }()
+	result := make(chan string, 1)
+	mp.statusMux.Lock()
+	if mp.statusW == nil {
+		mp.statusMux.Unlock()
+		return false
+	}
+	mp.reloaded = result
+	mp.reloads++
+	mp.sendStatus()
+	mp.statusMux.Unlock()
+	var expired <-chan time.Time
+	if mp.TerminateTimeout >= 0 {
+		expired = time.After(mp.TerminateTimeout)
+	}
+	select {
+	case err := <-result:
+		if err != "" {
+			mp.warnf("reload failed, restarting: %s", err)
+			return false
+		}
+		mp.debugf("reload success")
+		return true
+	case <-expired:
+		mp.warnf("program did not reload within %s, restarting", mp.TerminateTimeout)
+		return false
+	}
+}
+
+//stop ends fetching and terminates the program, killing it after
+//timeout, the master's run then returns instead of exiting
+func (mp *master) stop(timeout time.Duration) error {
+	if mp.exited == nil {
+		return errors.New("overseer not started")
+	}
+	if timeout == 0 {
+		timeout = mp.TerminateTimeout
+	}
+	if !mp.stopRequested {
+		mp.debugf("stop requested")
+		mp.stopRequested = true
+		mp.stopping = true
+		mp.stopFetching()
+		mp.signalStop(SIGTERM)
+	}
+	if timeout < 0 {
+		<-mp.exited
+		return nil
+	}
+	select {
+	case <-mp.exited:
+		return nil
+	case <-time.After(timeout):
+		mp.warnf("program did not exit within %s of stopping, forcing exit", timeout)
+		mp.signalStop(os.Kill)
+		<-mp.exited
+		return fmt.Errorf("program killed after %s", timeout)
+	}
+}
+
+//signalStop sends s to the program, unlike sendSignal it
+//doesn't exit when the program has already exited
+func (mp *master) signalStop(s os.Signal) {
+	if !processSignals {
+		s = os.Kill
+	}
+	if cmd := mp.slaveCmd; cmd != nil && cmd.Process != nil {
+		cmd.Process.Signal(s)
+	}
+}
+
+//not a real fork
+func (mp *master) forkLoop() error {
+	//loop, restart command
+	for {
+		if err := mp.fork(); err == errStopped {
+			signal.Stop(mp.signals)
+			mp.debugf("stopped")
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//args returns the arguments to run the binary at path with
+func (mp *master) args(path string) []string {
+	var args []string
+	if mp.Config.ArgsOf != nil {
+		args = mp.Config.ArgsOf(path)
+	}
+	if args == nil {
+		args = mp.Config.Args
+	}
+	if args == nil {
+		return os.Args
+	}
+	return append([]string{os.Args[0]}, args...)
+}
+
+func (mp *master) fork() error {
+	if mp.stopRequested {
+		mp.exitOnce.Do(func() { close(mp.exited) })
+		return errStopped
+	}
+	if mp.stopping {
+		mp.terminate()
+	}
+	args := mp.args(mp.binPath)
+	if mp.Config.OnBeforeExec != nil {
+		if err := mp.Config.OnBeforeExec(mp.binPath, args); err != nil {
+			err = fmt.Errorf("start of %s vetoed: %s", mp.binPath, err)
+			mp.event(slog.LevelWarn, eventError, []slog.Attr{slog.String("error", err.Error())}, "%s", err)
+			//an upgraded binary is rejected, the previous one is started instead
+			if mp.restoreBackup() {
+				return nil
+			}
+			return err
+		}
+	}
+	mp.debugf("starting %s", mp.binPath)
+	cmd := exec.Command(mp.binPath)
+	//mark this new process as the "active" slave process.
+	//this process is assumed to be holding the socket files.
+	mp.slaveCmd = cmd
+	mp.slaveID++
+	//the first process of an upgraded binary is
+	//on probation until it outlives the grace period
+	probation := mp.backupHash != nil && mp.prevBinHash != nil
+	//provide the slave process with some state
+	e := os.Environ()
+	mp.slaveHash = mp.binHash
+	e = append(e, envBinID+"="+hex.EncodeToString(mp.binHash))
+	e = append(e, envBinPath+"="+mp.binPath)
+	e = append(e, envBinVersion+"="+mp.binVersion)
+	if mp.config != nil {
+		e = append(e, envConfigFile+"="+mp.configPath)
+	}
+	e = append(e, envSlaveID+"="+strconv.Itoa(mp.slaveID))
+	e = append(e, envMasterStarted+"="+strconv.FormatInt(mp.startedAt.UnixNano(), 10))
+	e = append(e, envIsSlave+"=1")
+	mp.listenMux.Lock()
+	listeners, dropped := mp.slaveExtraFiles, mp.droppedFiles
+	names := mp.listenerNames(mp.listenAddrs)
+	mp.droppedFiles = nil
+	mp.listenMux.Unlock()
+	e = append(e, envNumFDs+"="+strconv.Itoa(len(listeners)))
+	if names != "" {
+		e = append(e, envListenerNames+"="+names)
+	}
+	//first process since an upgrade
+	if mp.prevBinHash != nil {
+		e = append(e, envPrevBinID+"="+hex.EncodeToString(mp.prevBinHash))
+		mp.prevBinHash = nil
+	}
+	cmd.Env = e
+	//inherit master args (see Config.Args) and stdfiles
+	cmd.Args = args
+	mp.user.apply(cmd)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	//include socket files
+	for _, f := range listeners {
+		passFile(cmd, f)
+	}
+	//and additional files, in order
+	if len(mp.additionalFiles) > 0 {
+		fds := make([]string, len(mp.additionalFiles))
+		for i, f := range mp.additionalFiles {
+			fds[i] = strconv.FormatUint(uint64(passFile(cmd, f)), 10)
+		}
+		cmd.Env = append(cmd.Env, envFiles+"="+strings.Join(fds, ","))
+	}
+	//and a control pipe, which the slave uses to send commands
+	controlR, controlW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Failed to create control pipe: %s", fileLimitError(err))
+	}
+	fd := passFile(cmd, controlW)
+	cmd.Env = append(cmd.Env, envControlFD+"="+strconv.FormatUint(uint64(fd), 10))
+	//and a status pipe, which the master uses to send its Status
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		controlR.Close()
+		controlW.Close()
+		return fmt.Errorf("Failed to create status pipe: %s", fileLimitError(err))
+	}
+	fd = passFile(cmd, statusR)
+	cmd.Env = append(cmd.Env, envStatusFD+"="+strconv.FormatUint(uint64(fd), 10))
+	startedAt := time.Now()
+	mp.slaveStartedAt = startedAt
+	cmd, err = mp.startExecutable(cmd)
+	mp.slaveCmd = cmd
+	controlW.Close()
+	statusR.Close()
+	//the previous slave holds its own copies of dropped sockets
+	for _, f := range dropped {
+		f.Close()
+	}
+	if err != nil {
+		controlR.Close()
+		statusW.Close()
+		return fmt.Errorf("Failed to start slave process: %s", fileLimitError(err))
+	}
+	go mp.readCommands(controlR)
+	//replace the previous slave's status pipe
+	mp.statusMux.Lock()
+	if mp.statusW != nil {
+		mp.statusW.Close()
+	}
+	mp.statusW = statusW
+	mp.sendStatus()
+	mp.statusMux.Unlock()
+	if probation && mp.HealthCheck != nil {
+		go mp.checkHealth(cmd, startedAt)
+	}
+	//was scheduled to restart, notify success
+	if mp.restarting {
+		mp.restartedAt = time.Now()
+		mp.restarting = false
+		mp.restarted <- true
+	}
+	//convert wait into channel
+	cmdwait := make(chan error, 1)
+	done := make(chan bool)
+	mp.slaveDone = done
+	go func() {
+		err := cmd.Wait()
+		if mp.Config.OnChildExit != nil {
+			mp.Config.OnChildExit(exitCode(err), err)
+		}
+		mp.slaveCode = exitCode(err)
+		close(done)
+		cmdwait <- err
+	}()
+	//wait....
+	select {
+	case err := <-cmdwait:
+		//program exited before releasing descriptors
+		//proxy exit code out to master
+		code := exitCode(err)
+		mp.debugf("prog exited with %d", code)
+		if mp.stopRequested {
+			mp.exitOnce.Do(func() { close(mp.exited) })
+			return errStopped
+		}
+		if probation && !mp.restarting {
+			if code != 0 && time.Since(startedAt) < mp.StartupGracePeriod {
+				mp.warnf("upgraded binary exited with %d after %s, rolling back", code, time.Since(startedAt))
+				if mp.restoreBackup() {
+					return nil //start previous binary
+				}
+			} else {
+				mp.discardBackup()
+			}
+		}
+		//optionally restart crashed programs
+		if !mp.NoRestart && !mp.restarting && !mp.stopping && code != 0 && mp.RestartOnCrash {
+			if mp.crashBackoff(time.Since(startedAt)) {
+				return nil
+			}
+		}
+		//if a restarts are disabled or if it was an
+		//unexpected crash, proxy this exit straight
+		//through to the main process
+		if mp.NoRestart || !mp.restarting {
+			if mp.stopping {
+				mp.awaitUpgrade()
+			}
 			os.Exit(code)
 		}
 	case <-mp.descriptorsReleased:
@@ -411,14 +2062,339 @@ func (mp *master) fork() error {
 	return nil
 }
 
+//terminate exits the master process once terminated between programs
+//(e.g. during a restart or the first fetch), rather than starting the
+//next program. The previous program is left to drain and exit first.
+func (mp *master) terminate() {
+	mp.debugf("terminated, not starting %s", mp.binPath)
+	code := 0
+	if mp.slaveDone != nil {
+		<-mp.slaveDone
+		code = mp.slaveCode
+	}
+	mp.awaitUpgrade()
+	os.Exit(code)
+}
+
+//awaitUpgrade lets an upgrade cancelled by a shutdown remove its
+//temp binary, waiting at most TerminateTimeout
+func (mp *master) awaitUpgrade() {
+	done := make(chan bool)
+	go func() {
+		mp.upgradeMux.Lock()
+		mp.upgradeMux.Unlock()
+		close(done)
+	}()
+	if mp.TerminateTimeout < 0 {
+		<-done
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(mp.TerminateTimeout):
+		mp.warnf("upgrade still running after %s, exiting", mp.TerminateTimeout)
+	}
+}
+
+//crashBackoff waits before restarting a crashed program, backing off
+//exponentially while it keeps crashing within CrashLoopWindow. It
+//returns false once the program has crashed CrashLoopLimit times in a row.
+func (mp *master) crashBackoff(ran time.Duration) bool {
+	if ran >= mp.CrashLoopWindow {
+		mp.crashes = 0
+	}
+	mp.crashes++
+	if mp.crashes == 1 {
+		mp.event(slog.LevelWarn, eventRestart, []slog.Attr{slog.String("reason", "crash"), slog.Duration("ran", ran)}, "program crashed after %s, restarting", ran)
+		return true
+	}
+	if mp.crashes > mp.CrashLoopLimit {
+		mp.warnf("program crashed %d times in a row within %s of starting, giving up", mp.crashes, mp.CrashLoopWindow)
+		return false
+	}
+	delay := time.Second << uint(mp.crashes-2)
+	if delay > time.Minute {
+		delay = time.Minute
+	}
+	mp.event(slog.LevelWarn, eventRestart, []slog.Attr{slog.String("reason", "crash"), slog.Duration("ran", ran), slog.Int("crashes", mp.crashes), slog.Duration("delay", delay)},
+		"program is crash looping (%d crashes in a row), restarting in %s", mp.crashes, delay)
+	time.Sleep(delay)
+	return true
+}
+
+//exitCode of a program given its wait error, -1 when killed by a signal
+func exitCode(err error) int {
+	code := 0
+	if err != nil {
+		code = 1
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+				code = status.ExitStatus()
+			}
+		}
+	}
+	return code
+}
+
+//checkHealth retries HealthCheck on an upgraded program, rolling
+//back the upgrade if it has not passed within the grace period
+func (mp *master) checkHealth(cmd *exec.Cmd, startedAt time.Time) {
+	var err error
+	for time.Since(startedAt) < mp.StartupGracePeriod {
+		if err = mp.HealthCheck(); err == nil {
+			mp.debugf("health check passed after %s", time.Since(startedAt))
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	if mp.slaveCmd != cmd || mp.restarting {
+		return //program has already been replaced
+	}
+	mp.warnf("upgraded binary failed health check (%s), rolling back", err)
+	if mp.restoreBackup() {
+		mp.triggerRestart()
+	}
+}
+
+//restoreBackup moves the previous binary back into place
+func (mp *master) restoreBackup() bool {
+	if mp.backupHash == nil {
+		return false //already restored or discarded
+	}
+	if mp.memBin != nil {
+		if err := mp.loadMemoryBinary(mp.backupBinPath); err != nil {
+			mp.warnf("failed to restore previous binary: %s", err)
+			return false
+		}
+	} else if err := mp.replaceBinary(mp.backupBinPath, -1, mp.backupHash); err != nil {
+		mp.warnf("failed to restore previous binary: %s", err)
+		return false
+	}
+	mp.event(slog.LevelWarn, eventRollback, []slog.Attr{idAttr("id", mp.backupHash), idAttr("previous_id", mp.binHash)}, "rolled back binary (%x -> %x)", mp.binHash[:12], mp.backupHash[:12])
+	if !bytes.Equal(mp.config, mp.backupConfig) {
+		if err := mp.writeConfig(mp.backupConfig); err != nil {
+			mp.warnf("failed to restore previous config: %s", err)
+		}
+	}
+	if err := mp.listenOn(mp.backupAddrs); err != nil {
+		mp.warnf("failed to restore previous addresses: %s", err)
+	}
+	mp.binHash = mp.backupHash
+	mp.binVersion = "" //unknown
+	mp.setLogVersion("")
+	mp.backupHash = nil
+	mp.prevBinHash = nil
+	return true
+}
+
+//setMemoryBinary makes the memory file f the binary (see
+//Config.MemoryExec), the binary on disk is left untouched
+func (mp *master) setMemoryBinary(f *os.File) {
+	if mp.memBin != nil {
+		mp.memBin.Close()
+	}
+	mp.memBin = f
+	mp.binPath = memoryPath(f)
+}
+
+//loadMemoryBinary copies the binary at src into a memory file
+func (mp *master) loadMemoryBinary(src string) error {
+	f, err := memoryFile("overseer")
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err == nil {
+		_, err = io.Copy(f, in)
+		in.Close()
+	}
+	if err == nil {
+		err = chmod(f, mp.binPerms)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	//a file open for writing can't be executed
+	ro, err := os.Open(memoryPath(f))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	mp.setMemoryBinary(ro)
+	return nil
+}
+
+//replaceBinary atomically replaces the binary with the file at src.
+//src is first moved next to the binary, so the final rename never
+//crosses filesystems and a partially written binary is never seen.
+//With VerifyWrites, the staged copy is checked against size and hash.
+func (mp *master) replaceBinary(src string, size int64, hash []byte) error {
+	dir, name := filepath.Split(mp.binPath)
+	staged := filepath.Join(dir, "."+name+".overseer-"+token())
+	if err := move(staged, src); err != nil {
+		return fmt.Errorf("failed to stage binary in %s (%s)", dir, err)
+	}
+	if err := syncFile(staged); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("failed to sync staged binary (%s)", err)
+	}
+	if mp.Config.VerifyWrites {
+		if err := verifyFile(staged, size, hash); err != nil {
+			os.Remove(staged)
+			return fmt.Errorf("staged binary corrupted (%s)", err)
+		}
+	}
+	if err := os.Rename(staged, mp.binPath); err != nil {
+		os.Remove(staged)
+		if errors.Is(err, syscall.EXDEV) {
+			//e.g. the binary itself is a bind mount
+			return fmt.Errorf("%s is not on the same filesystem as %s, refusing a non-atomic copy", mp.binPath, dir)
+		}
+		return err
+	}
+	return nil
+}
+
+//copyFile copies src to dst, preserving its file mode
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+//verifyFile re-reads the file at path, checking it has the sha1
+//hash and, unless size is -1, the size of the bytes written to it
+func verifyFile(path string, size int64, hash []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha1.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("wrote %d bytes, read back %d", size, n)
+	}
+	if !bytes.Equal(h.Sum(nil), hash) {
+		return fmt.Errorf("hash mismatch (wrote %x, read back %x)", hash[:12], h.Sum(nil)[:12])
+	}
+	return nil
+}
+
+//syncFile flushes the file at path to disk
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+//discardBackup removes the previous binary once the upgrade is proven
+func (mp *master) discardBackup() {
+	mp.backupHash = nil
+	mp.backupConfig = nil
+	os.Remove(mp.backupBinPath)
+}
+
+//loadConfig reads the config file left by a previous run (see
+//Config.ConfigFile), the config of the current binary
+func (mp *master) loadConfig() {
+	mp.configPath = mp.Config.ConfigFile
+	if mp.configPath == "" {
+		mp.configPath = mp.binPath + ".config"
+	}
+	if b, err := ioutil.ReadFile(mp.configPath); err == nil {
+		mp.config = b
+	}
+}
+
+//writeConfig atomically replaces the config file with config, so
+//the program never reads a partial config, nil removes the file
+func (mp *master) writeConfig(config []byte) error {
+	if config == nil {
+		if err := os.Remove(mp.configPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		mp.config = nil
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(mp.configPath), "overseer-config-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(config)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = chown(f, uid, gid)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), mp.configPath); err != nil {
+		return err
+	}
+	mp.config = config
+	return nil
+}
+
+//sameConfig is true unless config, when fetched, differs from current
+func sameConfig(config, current []byte) bool {
+	return config == nil || bytes.Equal(config, current)
+}
+
 func (mp *master) debugf(f string, args ...interface{}) {
-	if mp.Config.Debug {
-		log.Printf("[overseer master] "+f, args...)
+	if h := mp.Config.LogHandler; h != nil {
+		logRecord(h, slog.LevelDebug, "master", mp.logVersion(), fmt.Sprintf(f, args...))
+	} else if mp.Config.Debug {
+		mp.logf(f, args...)
 	}
 }
 
 func (mp *master) warnf(f string, args ...interface{}) {
-	if mp.Config.Debug || !mp.Config.NoWarn {
+	if h := mp.Config.LogHandler; h != nil {
+		logRecord(h, slog.LevelWarn, "master", mp.logVersion(), fmt.Sprintf(f, args...))
+	} else if mp.Config.Debug || !mp.Config.NoWarn {
+		mp.logf(f, args...)
+	}
+}
+
+func (mp *master) logf(f string, args ...interface{}) {
+	if h := mp.Config.LogHandler; h != nil {
+		logRecord(h, slog.LevelInfo, "master", mp.logVersion(), fmt.Sprintf(f, args...))
+	} else if mp.Config.Logger != nil {
+		mp.Config.Logger.Printf("[overseer master] "+f, args...)
+	} else {
 		log.Printf("[overseer master] "+f, args...)
 	}
 }
@@ -428,3 +2404,50 @@ func token() string {
 	rand.Read(buff)
 	return hex.EncodeToString(buff)
 }
+
+//childUser is the Config.User which programs run as
+type childUser struct {
+	uid, gid   uint32
+	groups     []uint32
+	name, home string
+}
+
+//lookupUser finds the user by name, or otherwise by uid
+func lookupUser(name string) (*childUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("overseer.Config.User not found (%s)", err)
+		}
+	}
+	c := &childUser{name: u.Username, home: u.HomeDir}
+	ids := []string{u.Uid, u.Gid}
+	if gids, err := u.GroupIds(); err == nil {
+		ids = append(ids, gids...)
+	}
+	for i, id := range ids {
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("overseer.Config.User has invalid id %q", id)
+		}
+		switch i {
+		case 0:
+			c.uid = uint32(n)
+		case 1:
+			c.gid = uint32(n)
+		default:
+			c.groups = append(c.groups, uint32(n))
+		}
+	}
+	return c, nil
+}
+
+//apply runs cmd as the user, with its own HOME, USER and LOGNAME.
+//It is a no-op when Config.User is unset.
+func (u *childUser) apply(cmd *exec.Cmd) {
+	if u == nil {
+		return
+	}
+	runAs(cmd, u)
+	cmd.Env = append(cmd.Env, "HOME="+u.home, "USER="+u.name, "LOGNAME="+u.name)
+}
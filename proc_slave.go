@@ -1,13 +1,18 @@
 package overseer
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
-	"syscall"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,12 +33,22 @@ type State struct {
 	ID string
 	//StartedAt records the start time of the program
 	StartedAt time.Time
+	//MasterStartedAt records the start time of the master
+	//process, which outlives each restart of the program
+	MasterStartedAt time.Time
+	//RestartCount is the number of times the master process
+	//has restarted the program
+	RestartCount int
 	//Listener is the first net.Listener in Listeners
 	Listener net.Listener
 	//Listeners are the set of acquired sockets by the master
 	//process. These are all passed into this program in the
-	//same order they are specified in Config.Addresses.
+	//same order they are specified in Config.Addresses,
+	//followed by the Config.NamedAddresses (see NamedListener).
 	Listeners []net.Listener
+	//Files are the Config.AdditionalFiles opened by the master
+	//process, in the same order. Empty when overseer is disabled.
+	Files []*os.File
 	//Program's first listening address
 	Address string
 	//Program's listening addresses
@@ -43,8 +58,91 @@ type State struct {
 	GracefulShutdown chan bool
 	//Path of the binary currently being executed
 	BinPath string
+	//Version of the binary currently being executed, as
+	//reported by the fetcher (e.g. an ETag or release tag).
+	//Empty if the fetcher does not implement fetcher.Versioned.
+	Version string
+	//ConfigFile is the path of the config file fetched along
+	//with the binary (see Config.ConfigFile), empty if none was
+	ConfigFile string
+	//Shadow is set in a shadow program (see Config.ShadowStart), which
+	//serves no traffic and is killed once healthy. Programs may skip
+	//side effects here, such as consuming queues or running migrations.
+	Shadow bool
+	//names are the indices of the NamedAddresses in Listeners
+	names map[string]int
+	//status is updated by the master process
+	status *slaveStatus
+	//drain closes the Listeners gracefully
+	drain func() error
 }
 
+type slaveStatus struct {
+	mut sync.Mutex
+	Status
+}
+
+//Status returns the latest Status of the master process's
+//fetcher. It is empty when overseer is disabled or when the
+//master process does not provide one.
+func (s State) Status() Status {
+	if s.status == nil {
+		return Status{}
+	}
+	s.status.mut.Lock()
+	defer s.status.mut.Unlock()
+	return s.status.Status
+}
+
+//NamedListener returns the listener of the named address (see
+//Config.NamedAddresses), or nil when there is none
+func (s State) NamedListener(name string) net.Listener {
+	if i, ok := s.names[name]; ok && i < len(s.Listeners) {
+		return s.Listeners[i]
+	}
+	return nil
+}
+
+//Drain stops the Listeners accepting new connections and blocks
+//until their active connections have finished, or until
+//Config.DrainTimeout when the remaining connections are closed.
+//Programs typically Drain once GracefulShutdown is filled, before
+//returning. It is a no-op when overseer is disabled.
+func (s State) Drain() error {
+	if s.drain == nil {
+		return nil
+	}
+	return s.drain()
+}
+
+//Restart asks the master process to gracefully restart this
+//program into the same binary, handing over its listeners
+//as it would after an upgrade (e.g. to load new config).
+//The program is signalled through GracefulShutdown as usual,
+//unless Config.Reload reloads it in-process instead.
+func (s State) Restart() error {
+	if !s.Enabled || currentProcess == nil {
+		return errors.New("overseer not running")
+	}
+	currentProcess.triggerRestart()
+	return nil
+}
+
+//commands sent from the slave to the master over the control pipe
+const (
+	cmdFetch    = "fetch"
+	cmdRestart  = "restart"
+	cmdPin      = "pin"  //followed by a space and the version
+	cmdSwap     = "swap" //followed by a space and the binary path
+	cmdPromote  = "promote"
+	cmdRelease  = "release"
+	cmdStop     = "stop"     //followed by a space and the timeout
+	cmdInterval = "interval" //followed by a space and the interval
+	cmdPause    = "pause"    //optionally followed by a space and "fetches"
+	cmdResume   = "resume"
+	cmdReloaded = "reloaded" //followed by a space and the error, if any
+)
+
 //a overseer slave process
 
 type slave struct {
@@ -53,6 +151,7 @@ type slave struct {
 	listeners  []*overseerListener
 	masterPid  int
 	masterProc *os.Process
+	control    *os.File
 	state      State
 }
 
@@ -62,20 +161,46 @@ func (sp *slave) run() error {
 	sp.state.Enabled = true
 	sp.state.ID = os.Getenv(envBinID)
 	sp.state.StartedAt = time.Now()
+	if nsec, err := strconv.ParseInt(os.Getenv(envMasterStarted), 10, 64); err == nil {
+		sp.state.MasterStartedAt = time.Unix(0, nsec)
+	}
+	if n, err := strconv.Atoi(sp.id); err == nil && n > 0 {
+		sp.state.RestartCount = n - 1
+	}
 	sp.state.Address = sp.Config.Address
 	sp.state.Addresses = sp.Config.Addresses
+	sp.state.names = listenerNames(sp.Config)
 	sp.state.GracefulShutdown = make(chan bool, 1)
 	sp.state.BinPath = os.Getenv(envBinPath)
+	sp.state.Version = os.Getenv(envBinVersion)
+	sp.state.ConfigFile = os.Getenv(envConfigFile)
+	sp.state.Shadow = os.Getenv(envShadow) == "1"
+	sp.state.drain = sp.drain
 	if err := sp.watchParent(); err != nil {
 		return err
 	}
 	if err := sp.initFileDescriptors(); err != nil {
 		return err
 	}
+	if err := sp.initAdditionalFiles(); err != nil {
+		return err
+	}
+	sp.initControl()
 	sp.watchSignal()
+	if prevID := os.Getenv(envPrevBinID); prevID != "" && sp.Config.PostUpgrade != nil {
+		sp.debugf("post upgrade")
+		sp.Config.PostUpgrade(prevID)
+	}
 	//run program with state
 	sp.debugf("start program")
 	sp.Config.Program(sp.state)
+	//a restarted program may return as soon as its listeners
+	//stop accepting, finish its connections before exiting
+	select {
+	case <-sp.state.GracefulShutdown:
+		sp.drain()
+	default:
+	}
 	return nil
 }
 
@@ -87,14 +212,9 @@ func (sp *slave) watchParent() error {
 	}
 	sp.masterProc = proc
 	go func() {
-		//send signal 0 to master process forever
-		for {
-			//should not error as long as the process is alive
-			if err := sp.masterProc.Signal(syscall.Signal(0)); err != nil {
-				os.Exit(1)
-			}
-			time.Sleep(2 * time.Second)
-		}
+		//exit when the master process does
+		waitForExit(sp.masterProc)
+		os.Exit(1)
 	}()
 	return nil
 }
@@ -105,13 +225,100 @@ func (sp *slave) initFileDescriptors() error {
 	if err != nil {
 		return fmt.Errorf("invalid %s integer", envNumFDs)
 	}
-	sp.listeners = make([]*overseerListener, numFDs)
-	sp.state.Listeners = make([]net.Listener, numFDs)
+	if !socketInheritance {
+		return sp.listenAddresses()
+	}
+	inherited := make([]net.Listener, numFDs)
 	for i := 0; i < numFDs; i++ {
 		f := os.NewFile(uintptr(3+i), "")
 		l, err := net.FileListener(f)
+		//the listener holds its own copy of the socket, so
+		//close the inherited one rather than hold both
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to inherit file descriptor: %d (%s)", i, fileLimitError(err))
+		}
+		inherited[i] = l
+	}
+	//older masters don't rebind sockets when an upgraded binary
+	//changes its addresses (see bindAddresses), listen on changed
+	//addresses instead of silently serving the previous ones
+	//a shadow program keeps the loopback sockets in place of its addresses
+	if len(sp.Config.Addresses) > 0 && !sp.state.Shadow {
+		listeners := make([]net.Listener, len(sp.Config.Addresses))
+		named := sp.inheritedNames()
+		nameOf := map[int]string{}
+		for name, i := range sp.state.names {
+			nameOf[i] = name
+		}
+		for i, addr := range sp.Config.Addresses {
+			//named sockets are matched by name, others by position
+			j := i
+			if fd, ok := named[nameOf[i]]; ok {
+				j = fd - 3
+			}
+			if j >= 0 && j < numFDs && inherited[j] != nil && listenerMatches(inherited[j], addr) {
+				listeners[i], inherited[j] = inherited[j], nil
+				continue
+			}
+			l, err := net.Listen(listenNetwork(addr))
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s (%s)", addr, err)
+			}
+			if j >= 0 && j < numFDs && inherited[j] != nil {
+				sp.warnf("address changed, listening on %s instead of %s", l.Addr(), inherited[j].Addr())
+			} else {
+				sp.warnf("address added, listening on %s", l.Addr())
+			}
+			listeners[i] = l
+		}
+		//drop the stale sockets
+		for _, l := range inherited {
+			if l != nil {
+				l.Close()
+			}
+		}
+		inherited = listeners
+	}
+	sp.listeners = make([]*overseerListener, len(inherited))
+	sp.state.Listeners = make([]net.Listener, len(inherited))
+	for i, l := range inherited {
+		u := newOverseerListener(l)
+		sp.listeners[i] = u
+		sp.state.Listeners[i] = u
+	}
+	if len(sp.state.Listeners) > 0 {
+		sp.state.Listener = sp.state.Listeners[0]
+	}
+	return nil
+}
+
+//inheritedNames returns the file descriptor of each named
+//socket passed by the master process
+func (sp *slave) inheritedNames() map[string]int {
+	named := map[string]int{}
+	for _, pair := range strings.Split(os.Getenv(envListenerNames), ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		if fd, err := strconv.Atoi(kv[1]); err == nil {
+			named[kv[0]] = fd
+		}
+	}
+	return named
+}
+
+//listenAddresses is used on platforms which cannot
+//inherit sockets, the previous slave process must
+//have exited before these addresses can be bound.
+func (sp *slave) listenAddresses() error {
+	sp.listeners = make([]*overseerListener, len(sp.Config.Addresses))
+	sp.state.Listeners = make([]net.Listener, len(sp.Config.Addresses))
+	for i, addr := range sp.Config.Addresses {
+		l, err := net.Listen(listenNetwork(addr))
 		if err != nil {
-			return fmt.Errorf("failed to inherit file descriptor: %d", i)
+			return fmt.Errorf("failed to listen on %s (%s)", addr, err)
 		}
 		u := newOverseerListener(l)
 		sp.listeners[i] = u
@@ -123,56 +330,283 @@ func (sp *slave) initFileDescriptors() error {
 	return nil
 }
 
+//listenerMatches returns true if l is bound to addr
+func listenerMatches(l net.Listener, addr string) bool {
+	a, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return true //not a tcp socket, leave it
+	}
+	network, address := listenNetwork(addr)
+	want, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return true //the master already listened on it
+	}
+	if want.Port != 0 && want.Port != a.Port {
+		return false
+	}
+	//an explicit address family must match
+	switch v4 := a.IP.To4() != nil; network {
+	case "tcp4":
+		if !v4 {
+			return false
+		}
+	case "tcp6":
+		if v4 {
+			return false
+		}
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return a.IP.IsUnspecified()
+	}
+	return want.IP.Equal(a.IP)
+}
+
+//initAdditionalFiles inherits the master's Config.AdditionalFiles
+func (sp *slave) initAdditionalFiles() error {
+	env := os.Getenv(envFiles)
+	if env == "" {
+		return nil
+	}
+	for i, s := range strings.Split(env, ",") {
+		fd, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s file descriptor: %s", envFiles, s)
+		}
+		sp.state.Files = append(sp.state.Files, os.NewFile(uintptr(fd), "file"+strconv.Itoa(i)))
+	}
+	return nil
+}
+
+func (sp *slave) initControl() {
+	//older masters may not provide a control pipe
+	if fd, err := strconv.ParseUint(os.Getenv(envControlFD), 10, 64); err == nil {
+		sp.control = os.NewFile(uintptr(fd), "control")
+	}
+	//or a status pipe
+	if fd, err := strconv.ParseUint(os.Getenv(envStatusFD), 10, 64); err == nil {
+		sp.state.status = &slaveStatus{}
+		go sp.readStatus(os.NewFile(uintptr(fd), "status"))
+	}
+}
+
+//readStatus keeps the latest Status sent by the master,
+//reloading the program when the master requests it
+func (sp *slave) readStatus(r *os.File) {
+	defer r.Close()
+	d := json.NewDecoder(r)
+	reloads := -1
+	for {
+		msg := statusMessage{}
+		if err := d.Decode(&msg); err != nil {
+			return //master closed the pipe
+		}
+		sp.state.status.mut.Lock()
+		sp.state.status.Status = msg.Status
+		sp.state.status.mut.Unlock()
+		//the first message counts the reloads of previous programs
+		if reloads >= 0 && msg.Reloads > reloads {
+			go sp.reload()
+		}
+		reloads = msg.Reloads
+	}
+}
+
+//reload runs Config.Reload and reports the result to the master
+func (sp *slave) reload() {
+	sp.debugf("reload requested")
+	result := ""
+	if sp.Config.Reload == nil {
+		result = "reload not supported by program"
+	} else if err := sp.Config.Reload(); err != nil {
+		result = strings.Replace(err.Error(), "\n", " ", -1)
+	}
+	sp.sendCommand(strings.TrimSpace(cmdReloaded + " " + result))
+}
+
 func (sp *slave) watchSignal() {
 	signals := make(chan os.Signal)
 	signal.Notify(signals, sp.Config.RestartSignal)
 	go func() {
 		<-signals
 		signal.Stop(signals)
+		sp.awaitRestart()
 		sp.debugf("graceful shutdown requested")
 		//master wants to restart,
 		close(sp.state.GracefulShutdown)
 		//release any sockets and notify master
 		if len(sp.listeners) > 0 {
-			//start a new process first
+			//stop accepting first, so this process and the next
+			//never accept at once. connections meanwhile wait in
+			//the backlog of the sockets, held by the master. the
+			//accepted connections are drained until DrainTimeout.
+			for _, l := range sp.listeners {
+				l.release(sp.Config.DrainTimeout)
+			}
 			//signal release of held sockets, allows master to start
 			//a new process before this child has actually exited.
 			//early restarts not supported with restarts disabled.
 			if !sp.NoRestart {
-				sp.masterProc.Signal(SIGUSR1)
-			}
-			
-			//wait new process start
-			time.Sleep(3 * time.Second)
-
-			//perform graceful shutdown
-			for _, l := range sp.listeners {
-				l.release(sp.Config.TerminateTimeout)
+				if sp.control != nil {
+					//the master may not accept signals
+					//from this process (see Config.User)
+					sp.sendCommand(cmdRelease)
+				} else {
+					sp.masterProc.Signal(SIGUSR1)
+				}
 			}
 		}
 		//start death-timer
+		if sp.Config.TerminateTimeout < 0 {
+			return //disabled
+		}
 		go func() {
 			time.Sleep(sp.Config.TerminateTimeout)
-			sp.debugf("timeout. forceful shutdown")
+			sp.warnf("timeout. forceful shutdown")
 			os.Exit(1)
 		}()
 	}()
 }
 
+//drain releases every listener and waits for their connections
+func (sp *slave) drain() error {
+	for _, l := range sp.listeners {
+		l.release(sp.Config.DrainTimeout)
+	}
+	var err error
+	for _, l := range sp.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+//awaitRestart blocks while the program defers a restart
+func (sp *slave) awaitRestart() {
+	if sp.Config.CanRestart == nil {
+		return
+	}
+	deadline := time.Now().Add(sp.Config.MaxRestartDefer)
+	for !sp.Config.CanRestart() {
+		if time.Now().After(deadline) {
+			sp.warnf("restart deferred for %s, restarting anyway", sp.Config.MaxRestartDefer)
+			return
+		}
+		sp.debugf("restart deferred by program")
+		time.Sleep(time.Second)
+	}
+}
+
 func (sp *slave) triggerRestart() {
+	if sp.control != nil {
+		sp.sendCommand(cmdRestart)
+		return
+	}
+	//older masters may not provide a control pipe
 	if err := sp.masterProc.Signal(sp.Config.RestartSignal); err != nil {
 		os.Exit(1)
 	}
 }
 
+func (sp *slave) triggerFetch() {
+	sp.sendCommand(cmdFetch)
+}
+
+func (sp *slave) pinVersion(version string) {
+	sp.sendCommand(cmdPin + " " + version)
+}
+
+func (sp *slave) setFetchInterval(d time.Duration) {
+	sp.sendCommand(cmdInterval + " " + d.String())
+}
+
+func (sp *slave) pause(fetches bool) {
+	if fetches {
+		sp.sendCommand(cmdPause + " fetches")
+	} else {
+		sp.sendCommand(cmdPause)
+	}
+}
+
+func (sp *slave) resume() {
+	sp.sendCommand(cmdResume)
+}
+
+func (sp *slave) swapTo(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", abs)
+	}
+	if sp.control == nil {
+		return errors.New("swap not supported by master process")
+	}
+	if _, err := sp.control.Write([]byte(cmdSwap + " " + abs + "\n")); err != nil {
+		return fmt.Errorf("swap command failed: %s", err)
+	}
+	return nil
+}
+
+func (sp *slave) promote() error {
+	if sp.control == nil {
+		return errors.New("promote not supported by master process")
+	}
+	if _, err := sp.control.Write([]byte(cmdPromote + "\n")); err != nil {
+		return fmt.Errorf("promote command failed: %s", err)
+	}
+	return nil
+}
+
+func (sp *slave) stop(timeout time.Duration) error {
+	if sp.control == nil {
+		return errors.New("stop not supported by master process")
+	}
+	if _, err := sp.control.Write([]byte(cmdStop + " " + timeout.String() + "\n")); err != nil {
+		return fmt.Errorf("stop command failed: %s", err)
+	}
+	return nil
+}
+
+func (sp *slave) sendCommand(c string) {
+	if sp.control == nil {
+		sp.warnf("command (%s) not supported by master process", c)
+		return
+	}
+	if _, err := sp.control.Write([]byte(c + "\n")); err != nil {
+		sp.warnf("command (%s) failed: %s", c, err)
+	}
+}
+
 func (sp *slave) debugf(f string, args ...interface{}) {
-	if sp.Config.Debug {
-		log.Printf("[overseer slave#"+sp.id+"] "+f, args...)
+	if h := sp.Config.LogHandler; h != nil {
+		sp.record(h, slog.LevelDebug, f, args...)
+	} else if sp.Config.Debug {
+		sp.logf(f, args...)
 	}
 }
 
 func (sp *slave) warnf(f string, args ...interface{}) {
-	if sp.Config.Debug || !sp.Config.NoWarn {
+	if h := sp.Config.LogHandler; h != nil {
+		sp.record(h, slog.LevelWarn, f, args...)
+	} else if sp.Config.Debug || !sp.Config.NoWarn {
+		sp.logf(f, args...)
+	}
+}
+
+func (sp *slave) record(h slog.Handler, level slog.Level, f string, args ...interface{}) {
+	logRecord(h, level, "slave", os.Getenv(envBinVersion), fmt.Sprintf(f, args...), slog.String("slave_id", sp.id))
+}
+
+func (sp *slave) logf(f string, args ...interface{}) {
+	if sp.Config.Logger != nil {
+		sp.Config.Logger.Printf("[overseer slave#"+sp.id+"] "+f, args...)
+	} else {
 		log.Printf("[overseer slave#"+sp.id+"] "+f, args...)
 	}
 }
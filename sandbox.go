@@ -0,0 +1,123 @@
+package overseer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//Sandbox restricts the processes which run each fetched binary
+//before it replaces the current binary: overseer's sanity check
+//and the optional smoke test (see Config.Sandbox)
+type Sandbox struct {
+	//Timeout bounds each check, after which it is killed along
+	//with any processes it started. Defaults to 5 seconds.
+	Timeout time.Duration
+	//User runs the checks as this user name or uid, instead of
+	//Config.User. Linux and macOS only.
+	User string
+	//Env is the entire environment of the checks, instead of
+	//the master's environment (which may hold secrets)
+	Env []string
+	//MaxMemory limits the address space of each check in bytes
+	//and MaxCPU limits its CPU time. Linux only, the current binary
+	//applies the limits to itself before executing the check.
+	MaxMemory uint64
+	MaxCPU    time.Duration
+	//Args optionally smoke tests the binary with these arguments
+	//(e.g. "--version") after the sanity check. It must exit with
+	//a zero code within Timeout, or the binary is rejected.
+	Args []string
+}
+
+//runCheck runs the fetched binary at path with args and the extra
+//env, within the Sandbox when set, returning its combined output
+func (mp *master) runCheck(path, name string, args []string, env ...string) ([]byte, error) {
+	cmd := exec.Command(path)
+	cmd.Args = args
+	cmd.Env = append(os.Environ(), env...)
+	timeout := 5 * time.Second
+	u := mp.user
+	sb := mp.Config.Sandbox
+	if sb != nil {
+		cmd.Env = append(append([]string{}, sb.Env...), env...)
+		cmd.Dir = filepath.Dir(path)
+		if sb.Timeout > 0 {
+			timeout = sb.Timeout
+		}
+		if mp.sandboxUser != nil {
+			u = mp.sandboxUser
+		}
+	}
+	if sb != nil && (sb.MaxMemory > 0 || sb.MaxCPU > 0) {
+		//run the current (trusted) binary with its args (see
+		//Config.Args), so it reaches overseer.Run, where it
+		//limits itself then executes the check
+		spec, _ := json.Marshal(sandboxSpec{
+			Path:      path,
+			Args:      args,
+			MaxMemory: sb.MaxMemory,
+			MaxCPU:    uint64((sb.MaxCPU + time.Second - 1) / time.Second),
+		})
+		cmd.Path = mp.binPath
+		cmd.Args = mp.args(mp.binPath)
+		cmd.Env = append(cmd.Env, envSandbox+"="+string(spec))
+	}
+	u.apply(cmd)
+	isolate(cmd)
+	out := bytes.Buffer{}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	//don't wait on output held open by orphaned processes
+	cmd.WaitDelay = time.Second
+	cmd, err := mp.startExecutable(cmd)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-time.After(timeout):
+		mp.warnf("%s against fetched executable timed-out after %s", name, timeout)
+		killGroup(cmd.Process)
+		<-done
+		return out.Bytes(), fmt.Errorf("%s timed out after %s", name, timeout)
+	}
+}
+
+//sandboxSpec is passed to sandboxExec
+type sandboxSpec struct {
+	Path      string   `json:"path"`
+	Args      []string `json:"args"`
+	MaxMemory uint64   `json:"maxMemory"`
+	MaxCPU    uint64   `json:"maxCPU"` //seconds
+}
+
+//sandboxExec runs in the current binary on behalf of runCheck,
+//it applies the limits in spec then executes the binary being
+//checked. It never returns.
+func sandboxExec(spec string) {
+	s := sandboxSpec{}
+	if err := json.Unmarshal([]byte(spec), &s); err != nil {
+		fmt.Fprintf(os.Stderr, "[overseer sandbox] invalid %s (%s)\n", envSandbox, err)
+		os.Exit(1)
+	}
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envSandbox+"=") {
+			env = append(env, kv)
+		}
+	}
+	err := execLimited(s.Path, s.MaxMemory, s.MaxCPU, s.Args, env)
+	fmt.Fprintf(os.Stderr, "[overseer sandbox] %s\n", err)
+	os.Exit(1)
+}
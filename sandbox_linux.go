@@ -0,0 +1,24 @@
+// +build linux
+
+package overseer
+
+import "syscall"
+
+//the sandbox's resource limits are supported
+const resourceLimits = true
+
+//execLimited limits the resources of this process, then replaces
+//it with the binary at path. It only returns on failure.
+func execLimited(path string, maxMemory, maxCPU uint64, args, env []string) error {
+	if maxMemory > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: maxMemory, Max: maxMemory}); err != nil {
+			return err
+		}
+	}
+	if maxCPU > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: maxCPU, Max: maxCPU}); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(path, args, env)
+}
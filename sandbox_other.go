@@ -0,0 +1,12 @@
+// +build !linux
+
+package overseer
+
+import "errors"
+
+//the sandbox's resource limits are not supported
+const resourceLimits = false
+
+func execLimited(path string, maxMemory, maxCPU uint64, args, env []string) error {
+	return errors.New("resource limits not supported")
+}
@@ -0,0 +1,157 @@
+package overseer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+//Shadow configures the shadow start of fetched binaries (see
+//Config.ShadowStart). Once a binary has passed its checks, it is
+//started as a second program alongside the live one, with
+//State.Shadow set. Its Listeners are bound to loopback ports picked
+//by the master process instead of the Addresses, so it serves no
+//traffic, and it receives no AdditionalFiles. Its commands (e.g.
+//overseer.Restart) are ignored. Once it is healthy it is killed, then
+//the upgrade proceeds. A shadow which exits, or isn't healthy within
+//the Timeout, rejects the binary and the live program is untouched.
+type Shadow struct {
+	//HealthCheck probes the shadow program given the addresses of its
+	//Listeners, in order (e.g. requesting a health endpoint). It is
+	//retried each second until it returns nil. Without it, the shadow
+	//is healthy when it is still running at the Timeout.
+	HealthCheck func(addrs []string) error
+	//Timeout bounds the wait for a healthy shadow, after which it
+	//is killed along with any processes it started. Defaults to 10
+	//seconds.
+	Timeout time.Duration
+}
+
+//shadowStart runs the binary at path as a shadow program, which
+//listens on loopback in place of addrs, until it is healthy
+func (mp *master) shadowStart(path string, hash []byte, version string, config []byte, addrs []string) error {
+	sh := mp.Config.ShadowStart
+	timeout := 10 * time.Second
+	if sh.Timeout > 0 {
+		timeout = sh.Timeout
+	}
+	files := make([]*os.File, 0, len(addrs))
+	shadowAddrs := make([]string, 0, len(addrs))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, addr := range addrs {
+		network, _ := listenNetwork(addr)
+		loopback := "127.0.0.1:0"
+		if network == "tcp6" {
+			loopback = "[::1]:0"
+		}
+		l, err := net.Listen(network, loopback)
+		if err != nil {
+			return fmt.Errorf("failed to listen in place of %s (%s)", addr, fileLimitError(err))
+		}
+		f, err := l.(*net.TCPListener).File()
+		l.Close()
+		if err != nil {
+			return fmt.Errorf("failed to retrieve fd of %s (%s)", l.Addr(), fileLimitError(err))
+		}
+		files = append(files, f)
+		shadowAddrs = append(shadowAddrs, l.Addr().String())
+	}
+	cmd := exec.Command(path)
+	cmd.Args = mp.args(path)
+	e := os.Environ()
+	e = append(e, envIsSlave+"=1", envShadow+"=1", envSlaveID+"=shadow")
+	e = append(e, envBinID+"="+hex.EncodeToString(hash))
+	e = append(e, envBinPath+"="+path)
+	e = append(e, envBinVersion+"="+version)
+	e = append(e, envMasterStarted+"="+strconv.FormatInt(mp.startedAt.UnixNano(), 10))
+	e = append(e, envNumFDs+"="+strconv.Itoa(len(files)))
+	//the config to be written along with the binary
+	if config != nil {
+		configPath := mp.tmpBinPath + "-shadow-config"
+		if err := ioutil.WriteFile(configPath, config, 0644); err != nil {
+			return fmt.Errorf("failed to write config (%s)", err)
+		}
+		defer os.Remove(configPath)
+		e = append(e, envConfigFile+"="+configPath)
+	} else if mp.config != nil {
+		e = append(e, envConfigFile+"="+mp.configPath)
+	}
+	cmd.Env = e
+	for _, f := range files {
+		passFile(cmd, f)
+	}
+	//a control pipe whose commands are discarded
+	controlR, controlW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create control pipe (%s)", fileLimitError(err))
+	}
+	defer controlR.Close()
+	fd := passFile(cmd, controlW)
+	cmd.Env = append(cmd.Env, envControlFD+"="+strconv.FormatUint(uint64(fd), 10))
+	go io.Copy(ioutil.Discard, controlR)
+	mp.user.apply(cmd)
+	isolate(cmd)
+	out := bytes.Buffer{}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.WaitDelay = time.Second
+	mp.debugf("starting shadow program on %v", shadowAddrs)
+	cmd, err = mp.startExecutable(cmd)
+	controlW.Close()
+	if err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	fail := func(err error) error {
+		killGroup(cmd.Process)
+		<-exited
+		return fmt.Errorf("%s output \"%s\"", err, bytes.TrimSpace(out.Bytes()))
+	}
+	startedAt := time.Now()
+	deadline := time.After(timeout)
+	probeErr := errors.New("not probed")
+	for {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = fmt.Errorf("exited after %s", time.Since(startedAt).Round(time.Millisecond))
+			}
+			return fmt.Errorf("%s output \"%s\"", err, bytes.TrimSpace(out.Bytes()))
+		case <-deadline:
+			if sh.HealthCheck == nil {
+				killGroup(cmd.Process)
+				<-exited
+				mp.debugf("shadow program ran for %s", timeout)
+				return nil
+			}
+			return fail(fmt.Errorf("not healthy within %s (%s)", timeout, probeErr))
+		case <-mp.fetchCtx.Done():
+			return fail(mp.fetchCtx.Err())
+		case <-time.After(time.Second):
+			if sh.HealthCheck == nil {
+				continue
+			}
+			if probeErr = sh.HealthCheck(shadowAddrs); probeErr == nil {
+				killGroup(cmd.Process)
+				<-exited
+				mp.debugf("shadow program healthy after %s", time.Since(startedAt).Round(time.Millisecond))
+				return nil
+			}
+		}
+	}
+}
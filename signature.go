@@ -0,0 +1,135 @@
+package overseer
+
+//signature checks verify the OS code signature of fetched
+//binaries, using the tools of the platform
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/willas/overseer/fetcher"
+)
+
+//ErrUnverified is matched with errors.Is by the failures of
+//SignatureCheck and CosignCheck (e.g. in FetchStats.Err), so
+//unverified binaries can be alerted on apart from failed fetches
+var ErrUnverified = errors.New("binary signature not verified")
+
+//unverifiedError is a signature failure which matches ErrUnverified
+type unverifiedError struct {
+	err error
+}
+
+func (e *unverifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unverifiedError) Is(target error) bool {
+	return target == ErrUnverified
+}
+
+func (e *unverifiedError) Unwrap() error {
+	return e.err
+}
+
+//SignatureCheck rejects binaries without a valid code signature,
+//verified with codesign on macOS and Authenticode on Windows. When
+//identity is set, the binary must also be signed by it: on macOS the
+//signing authority (e.g. "Developer ID Application: Acme (TEAMID)")
+//or team identifier, on Windows the subject or common name of the
+//signing certificate. Other platforms reject every binary. Add it
+//to Config.Checks, it complements rather than replaces ChecksumCheck.
+//Its failures match ErrUnverified.
+func SignatureCheck(identity string) Check {
+	return Check{Name: "signature", Run: func(path string, _ fetcher.Metadata) error {
+		if err := checkSignature(path, identity); err != nil {
+			return &unverifiedError{err}
+		}
+		return nil
+	}}
+}
+
+func checkSignature(path, identity string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return checkCodesign(path, identity)
+	case "windows":
+		return checkAuthenticode(path, identity)
+	}
+	return fmt.Errorf("code signatures are not supported on %s", runtime.GOOS)
+}
+
+//checkCodesign verifies the signature with codesign, whose
+//details list the signing authorities, leaf first
+func checkCodesign(path, identity string) error {
+	if out, err := exec.Command("codesign", "--verify", "--strict", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("invalid signature: %s (%s)", err, bytes.TrimSpace(out))
+	}
+	if identity == "" {
+		return nil
+	}
+	out, err := exec.Command("codesign", "--display", "--verbose=2", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %s (%s)", err, bytes.TrimSpace(out))
+	}
+	authority := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if v := strings.TrimPrefix(line, "Authority="); v != line && authority == "" {
+			authority = v
+		} else if v := strings.TrimPrefix(line, "TeamIdentifier="); v != line && v == identity {
+			return nil
+		}
+	}
+	if authority != identity {
+		return fmt.Errorf("signed by %q, expected %q", authority, identity)
+	}
+	return nil
+}
+
+//checkAuthenticode verifies the signature with PowerShell,
+//which prints its status then the certificate subject
+func checkAuthenticode(path, identity string) error {
+	script := "$s = Get-AuthenticodeSignature -LiteralPath '" + strings.Replace(path, "'", "''", -1) + "'; " +
+		"$s.Status.ToString(); if ($s.SignerCertificate) { $s.SignerCertificate.Subject }"
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %s (%s)", err, bytes.TrimSpace(out))
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	status, subject := strings.TrimSpace(lines[0]), ""
+	if len(lines) > 1 {
+		subject = strings.TrimSpace(lines[1])
+	}
+	if status != "Valid" {
+		return fmt.Errorf("invalid signature (status %s)", status)
+	}
+	if identity == "" || subject == identity || commonName(subject) == identity {
+		return nil
+	}
+	return fmt.Errorf("signed by %q, expected %q", subject, identity)
+}
+
+//commonName returns the CN of a certificate subject
+//(e.g. "CN=Acme Inc, O=Acme Inc, C=US")
+func commonName(subject string) string {
+	quoted, start := false, 0
+	for i := 0; i <= len(subject); i++ {
+		if i < len(subject) && subject[i] == '"' {
+			quoted = !quoted
+		}
+		if i < len(subject) && (subject[i] != ',' || quoted) {
+			continue
+		}
+		part := strings.TrimSpace(subject[start:i])
+		if strings.HasPrefix(part, "CN=") {
+			return strings.Trim(strings.TrimPrefix(part, "CN="), `"`)
+		}
+		start = i + 1
+	}
+	return ""
+}
@@ -7,9 +7,11 @@ package overseer
 //in some other way on other OSs... TODO!
 
 import (
+	"errors"
 	"os"
 	"os/exec"
 	"syscall"
+	"time"
 )
 
 var (
@@ -19,6 +21,17 @@ var (
 	SIGUSR1   = syscall.SIGUSR1
 	SIGUSR2   = syscall.SIGUSR2
 	SIGTERM   = syscall.SIGTERM
+
+	//listening sockets are passed to the child process
+	socketInheritance = true
+	//signals can be sent to other processes
+	processSignals = true
+	//child processes can run as another user
+	userSwitching = true
+	//returned when the limit of open files is reached
+	errTooManyFiles error = syscall.EMFILE
+	//returned when executing a file open for writing
+	errTextBusy error = syscall.ETXTBSY
 )
 
 func move(dst, src string) error {
@@ -46,3 +59,70 @@ func chmod(f *os.File, perms os.FileMode) error {
 func chown(f *os.File, uid, gid int) error {
 	return f.Chown(uid, gid)
 }
+
+//fileLimit returns the limit of open files, 0 when unknown
+func fileLimit() uint64 {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return 0
+	}
+	return uint64(r.Cur)
+}
+
+//diskSpace returns the bytes available to unprivileged users
+//on the filesystem of dir, along with the device holding it
+func diskSpace(dir string) (int64, uint64, error) {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(dir, &s); err != nil {
+		return 0, 0, err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(uint64(s.Bavail) * uint64(s.Bsize)), uint64(st.Dev), nil
+}
+
+//passFile adds f to the files inherited by cmd and
+//returns its file descriptor in the child process
+func passFile(cmd *exec.Cmd, f *os.File) uintptr {
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	//extra files start at fd 3
+	return uintptr(2 + len(cmd.ExtraFiles))
+}
+
+//runAs starts cmd as u
+func runAs(cmd *exec.Cmd, u *childUser) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: u.uid, Gid: u.gid, Groups: u.groups}
+}
+
+//isolate starts cmd in its own process group
+func isolate(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+//killGroup kills proc and the processes it started
+func killGroup(proc *os.Process) {
+	if err := syscall.Kill(-proc.Pid, syscall.SIGKILL); err != nil {
+		proc.Kill()
+	}
+}
+
+//waitForExit blocks until proc has exited
+func waitForExit(proc *os.Process) {
+	//send signal 0 to the process forever,
+	//should not error as long as the process is alive.
+	//EPERM means it is alive though owned by another user.
+	for {
+		if err := proc.Signal(syscall.Signal(0)); err != nil && !errors.Is(err, syscall.EPERM) {
+			return
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
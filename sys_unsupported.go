@@ -5,6 +5,7 @@ package overseer
 import (
 	"errors"
 	"os"
+	"os/exec"
 )
 
 var (
@@ -14,6 +15,12 @@ var (
 	SIGUSR1   = os.Interrupt
 	SIGUSR2   = os.Interrupt
 	SIGTERM   = os.Kill
+
+	socketInheritance = false
+	processSignals    = false
+	userSwitching     = false
+	errTooManyFiles   error
+	errTextBusy       error
 )
 
 func move(dst, src string) error {
@@ -27,3 +34,27 @@ func chmod(f *os.File, perms os.FileMode) error {
 func chown(f *os.File, uid, gid int) error {
 	return errors.New("Not supported")
 }
+
+func passFile(cmd *exec.Cmd, f *os.File) uintptr {
+	return 0
+}
+
+func fileLimit() uint64 {
+	return 0
+}
+
+func diskSpace(dir string) (int64, uint64, error) {
+	return 0, 0, errors.New("Not supported")
+}
+
+func runAs(cmd *exec.Cmd, u *childUser) {}
+
+func isolate(cmd *exec.Cmd) {}
+
+func killGroup(proc *os.Process) {
+	proc.Kill()
+}
+
+func waitForExit(proc *os.Process) {
+	select {}
+}
@@ -4,6 +4,7 @@ package overseer
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -19,6 +20,20 @@ var (
 	SIGUSR1   = syscall.SIGTERM
 	SIGUSR2   = syscall.SIGTERM
 	SIGTERM   = syscall.SIGTERM
+
+	//windows cannot inherit listening sockets, so the
+	//child process binds its own listeners (with downtime)
+	socketInheritance = false
+	//windows can only kill other processes, restarts
+	//are therefore forced rather than graceful
+	processSignals = false
+	//windows cannot start processes as another user
+	//without their password
+	userSwitching = false
+	//handles have no limit like the open files of posix
+	errTooManyFiles error
+	//running executables are locked rather than busy
+	errTextBusy error
 )
 
 func move(dst, src string) error {
@@ -53,6 +68,39 @@ func chown(f *os.File, uid, gid int) error {
 	return nil
 }
 
+//passFile adds f to the handles inherited by cmd and
+//returns its handle in the child process
+func passFile(cmd *exec.Cmd, f *os.File) uintptr {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	h := syscall.Handle(f.Fd())
+	cmd.SysProcAttr.AdditionalInheritedHandles = append(cmd.SysProcAttr.AdditionalInheritedHandles, h)
+	return uintptr(h)
+}
+
+func fileLimit() uint64 {
+	return 0
+}
+
+func diskSpace(dir string) (int64, uint64, error) {
+	return 0, 0, errors.New("Not supported")
+}
+
+func runAs(cmd *exec.Cmd, u *childUser) {}
+
+func isolate(cmd *exec.Cmd) {}
+
+func killGroup(proc *os.Process) {
+	proc.Kill()
+}
+
+//waitForExit blocks until proc has exited
+func waitForExit(proc *os.Process) {
+	//windows process handles can be waited on by any process
+	proc.Wait()
+}
+
 // https://blogs.msdn.microsoft.com/twistylittlepassagesallalike/2011/04/23/everyone-quotes-command-line-arguments-the-wrong-way/
 var replShellMeta = strings.NewReplacer(
 	`(`, `^(`,